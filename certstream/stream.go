@@ -1,6 +1,7 @@
 package certstream
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -14,28 +15,31 @@ import (
 )
 
 const (
-	certStreamURL = "wss://certstream.calidog.io/"
+	// StreamURL sends the parsed fields of certificates
+	StreamURL = "wss://certstream.calidog.io/"
+	// FullStreamURL also sends the DER of certificates and their chains
+	FullStreamURL = "wss://certstream.calidog.io/full-stream"
 )
 
 // function to establish a new WebSocket connection
-func ConnectToCertStream() (*websocket.Conn, error) {
-	c, _, err := websocket.DefaultDialer.Dial(certStreamURL, http.Header{})
+func ConnectToCertStream(url string) (*websocket.Conn, error) {
+	c, _, err := websocket.DefaultDialer.Dial(url, http.Header{})
 	if err != nil {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
 	return c, nil
 }
 
-// ListenForEvents connects to CertStream and listens for events, sending raw messages to the provided channel.
+// ListenForEvents connects to the CertStream feed at url and listens for events, sending raw messages to the provided channel.
 // it stops processing when it receives a signal on the stopProcessing channel.
-func ListenForEvents(rawMessages chan []byte, stopProcessing chan struct{}, wg *sync.WaitGroup) {
+func ListenForEvents(url string, rawMessages chan []byte, stopProcessing chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for {
 		select {
 		case <-stopProcessing:
 			return // stop this goroutine
 		default:
-			c, err := ConnectToCertStream()
+			c, err := ConnectToCertStream(url)
 			if err != nil {
 				log.Printf("Error connecting to CertStream: %v. Retrying in 5 seconds...", err)
 				time.Sleep(5 * time.Second)
@@ -69,9 +73,20 @@ func MessageProcessor(rawMessages chan []byte, domains chan []swimModels.CertUpd
 		}
 
 		if data, ok := m["data"].(map[string]interface{}); ok {
+			// time the certificate was seen by CertStream, fall back to now if it's missing
+			seen := time.Now().Unix()
+			if seenAt, ok := data["seen"].(float64); ok {
+				seen = int64(seenAt)
+			}
+
 			if leafCert, ok := data["leaf_cert"].(map[string]interface{}); ok {
 				domainFlags := make(map[string]bool) // map to flag wildcard domains
 
+				// the full stream carries the DER, shared by the entries of every name
+				rawDER, rawChain := rawCertificate(leafCert, data)
+				updateType, _ := data["update_type"].(string)
+				entryType := entryTypes[updateType]
+
 				if domainsList, ok := leafCert["all_domains"].([]interface{}); ok {
 					for _, domainInterface := range domainsList {
 						if domain, ok := domainInterface.(string); ok {
@@ -88,6 +103,11 @@ func MessageProcessor(rawMessages chan []byte, domains chan []swimModels.CertUpd
 							domainInfo.NotAfter = int64(leafCert["not_after"].(float64))
 							domainInfo.SerialNumber = leafCert["serial_number"].(string)
 							domainInfo.Fingerprint = leafCert["fingerprint"].(string)
+							domainInfo.Issuer = issuerName(leafCert)
+							domainInfo.EntryType = entryType
+							domainInfo.Seen = seen
+							domainInfo.RawDER = rawDER
+							domainInfo.RawChain = rawChain
 
 							// extracting additional fields from the extensions object
 							if extensions, ok := leafCert["extensions"].(map[string]interface{}); ok {
@@ -136,3 +156,59 @@ func MessageProcessor(rawMessages chan []byte, domains chan []swimModels.CertUpd
 		domains <- batch
 	}
 }
+
+// entryTypes maps the update types of CertStream to the entry types stored
+var entryTypes = map[string]string{
+	"X509LogEntry":    "x509",
+	"PrecertLogEntry": "precert",
+}
+
+// issuerName returns the organization that issued a certificate, or the common name of
+// the issuing certificate if the organization is missing
+func issuerName(leafCert map[string]interface{}) string {
+	issuer, ok := leafCert["issuer"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, field := range []string{"O", "CN"} {
+		if name, ok := issuer[field].(string); ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// rawCertificate decodes the base64 DER of the leaf certificate and of its chain, which
+// only the full stream sends. It returns nil if the leaf has none or it can't be decoded.
+func rawCertificate(leafCert, data map[string]interface{}) ([]byte, [][]byte) {
+	encoded, ok := leafCert["as_der"].(string)
+	if !ok || encoded == "" {
+		return nil, nil
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Printf("Error decoding certificate: %v", err)
+		return nil, nil
+	}
+
+	var chain [][]byte
+	if certs, ok := data["chain"].([]interface{}); ok {
+		for _, c := range certs {
+			cert, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			encoded, ok := cert["as_der"].(string)
+			if !ok {
+				continue
+			}
+			chainDER, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				log.Printf("Error decoding chain certificate: %v", err)
+				return der, nil
+			}
+			chain = append(chain, chainDER)
+		}
+	}
+	return der, chain
+}
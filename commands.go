@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	swimConfig "github.com/dap-ware/swim/config"
+	swimDb "github.com/dap-ware/swim/database"
+	swimModels "github.com/dap-ware/swim/models"
+	swimQuery "github.com/dap-ware/swim/query"
+)
+
+// runCommand runs one of swim's maintenance commands instead of the server
+func runCommand(swimCfg *swimConfig.Config, name string, args []string) error {
+	switch name {
+	case "reindex", "migrate":
+		// partitions are migrated on start and sealed ones are never written to again
+		if swimCfg.Database.Partition != "" {
+			return fmt.Errorf("%s is not supported for partitioned databases", name)
+		}
+		if name == "reindex" {
+			return runReindex(swimCfg, args)
+		}
+		return runMigrate(swimCfg, args)
+	case "archive":
+		return runArchive(swimCfg, args)
+	case "backup":
+		return runBackup(swimCfg, args)
+	case "prune":
+		return runPrune(swimCfg, args)
+	case "query":
+		return runQuery(swimCfg, args)
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return nil
+	default:
+		printUsage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// printUsage lists the available commands
+func printUsage() {
+	fmt.Println("Usage: swim [command] [flags]")
+	fmt.Println()
+	fmt.Println("Without a command swim ingests CertStream data and serves the API.")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  archive    move old sightings to compressed archive segments once and report what was moved")
+	fmt.Println("  backup     write a snapshot of the database while swim keeps running")
+	fmt.Println("  migrate    show or change the schema version: migrate status|up|down")
+	fmt.Println("  prune      enforce the retention limits once and report what was pruned")
+	fmt.Println("  query      print the cert updates matching a query, e.g. 'issuer:\"Let's Encrypt\" AND wildcard:true'")
+	fmt.Println("  reindex    recompute derived columns (is_apex, parent_domain, reversed) of stored domains")
+	fmt.Println()
+	fmt.Println("Run 'swim <command> -h' for the flags of a command.")
+}
+
+// runReindex recomputes the derived columns of every stored domain. It is safe to run while
+// swim is ingesting, the rows are updated in small transactions.
+func runReindex(swimCfg *swimConfig.Config, args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	chunkSize := fs.Int("chunk", 5000, "number of rows to update per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if swimCfg.Database.Driver == "" || swimCfg.Database.Driver == "sqlite" {
+		if _, err := os.Stat(swimCfg.Database.FilePath); err != nil {
+			return fmt.Errorf("database not found: %w", err)
+		}
+	}
+
+	store, err := openStore(swimCfg, 1)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.SetupDatabase(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	log.Println("Reindexing names")
+	p, err := store.Reindex(*chunkSize, func(p swimDb.ReindexProgress) {
+		log.Printf("Reindex: %d/%d rows scanned, %d updated", p.Scanned, p.Total, p.Updated)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reindex completed in %s: %d rows scanned, %d updated", time.Since(start).Round(time.Millisecond), p.Scanned, p.Updated)
+	return nil
+}
+
+// runMigrate shows the applied schema migrations or moves the schema up or down
+func runMigrate(swimCfg *swimConfig.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected a subcommand: status, up or down")
+	}
+
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	target := fs.Int("to", -1, "schema version to migrate to (up: latest, down: one below the current)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	store, err := openStore(swimCfg, 1)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "status":
+		states, err := store.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-55s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+
+	case "up":
+		if *target < 0 {
+			*target = store.LatestSchemaVersion()
+		}
+		ran, err := store.MigrateUp(*target)
+		for _, m := range ran {
+			log.Printf("Applied migration %d: %s", m.Version, m.Name)
+		}
+		if err == nil && len(ran) == 0 {
+			log.Println("Database schema is already up to date")
+		}
+		return err
+
+	case "down":
+		if *target < 0 {
+			current, err := store.SchemaVersion()
+			if err != nil {
+				return err
+			}
+			if current == 0 {
+				log.Println("No migrations to revert")
+				return nil
+			}
+			*target = current - 1
+		}
+		reverted, err := store.MigrateDown(*target)
+		for _, m := range reverted {
+			log.Printf("Reverted migration %d: %s", m.Version, m.Name)
+		}
+		return err
+
+	default:
+		return fmt.Errorf("unknown migrate subcommand %q, expected status, up or down", args[0])
+	}
+}
+
+// runPrune runs the retention janitor once, the limits default to the configured ones
+func runPrune(swimCfg *swimConfig.Config, args []string) error {
+	policy := retentionPolicy(swimCfg)
+
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	fs.StringVar(&policy.MaxSize, "maxsize", policy.MaxSize, "maximum database size, e.g. 20G")
+	fs.DurationVar(&policy.MaxAge, "maxage", policy.MaxAge, "prune sightings older than this, e.g. 2160h")
+	fs.IntVar(&policy.ChunkSize, "chunk", policy.ChunkSize, "number of sightings to delete per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if !policy.Enabled() {
+		return fmt.Errorf("no retention limits configured, set -maxsize or -maxage")
+	}
+
+	store, err := openBackend(swimCfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.SetupDatabase(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	report, err := store.Prune(policy, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Prune completed in %s: %s", time.Since(start).Round(time.Millisecond), report)
+	return nil
+}
+
+// runArchive runs the archiver once, the age defaults to the configured one
+func runArchive(swimCfg *swimConfig.Config, args []string) error {
+	policy := archivePolicy(swimCfg)
+
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	fs.DurationVar(&policy.After, "after", policy.After, "archive sightings of days older than this, e.g. 2160h")
+	fs.IntVar(&policy.ChunkSize, "chunk", policy.ChunkSize, "number of archived sightings to delete per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if !policy.Enabled() {
+		return fmt.Errorf("no archive age configured, set -after")
+	}
+
+	store, err := openBackend(swimCfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.SetupDatabase(); err != nil {
+		return err
+	}
+
+	sqlStore, archive, err := openArchive(swimCfg, store)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	report, err := sqlStore.ArchiveSightings(archive, policy, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Archive completed in %s: %s", time.Since(start).Round(time.Millisecond), report)
+	return nil
+}
+
+// runBackup writes a snapshot of the database, the live database can keep ingesting meanwhile
+func runBackup(swimCfg *swimConfig.Config, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("dir", swimCfg.Backup.Dir, "directory to write the snapshot to")
+	keep := fs.Int("keep", swimCfg.Backup.Keep, "number of snapshots to keep in the directory, 0 keeps all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return fmt.Errorf("no backup directory configured, set -dir")
+	}
+
+	store, err := openBackend(swimCfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.SetupDatabase(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	snapshot, err := store.Snapshot(*dir, *keep)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Backup completed in %s", time.Since(start).Round(time.Millisecond))
+	for _, path := range snapshot.Removed {
+		log.Printf("Removed old snapshot %s", path)
+	}
+	return nil
+}
+
+// runQuery prints the cert updates matching a query, a line of tab separated fields or a
+// JSON document per cert update
+func runQuery(swimCfg *swimConfig.Config, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	size := fs.Int("size", 100, "maximum number of cert updates to print, 0 prints all")
+	sortKey := fs.String("sort", "name", "sort by "+strings.Join(swimModels.CertSortKeys, ", "))
+	desc := fs.Bool("desc", false, "sort in descending order")
+	asJSON := fs.Bool("json", false, "print a JSON document per cert update instead of domain, not_before, issuer and fingerprint")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: swim query [flags] <query>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing query")
+	}
+	if !slices.Contains(swimModels.CertSortKeys, *sortKey) {
+		return fmt.Errorf("invalid sort %q, expected one of %s", *sortKey, strings.Join(swimModels.CertSortKeys, ", "))
+	}
+
+	// the query can be given as one or several arguments
+	q := strings.Join(fs.Args(), " ")
+	query, err := swimQuery.Parse(q)
+	if err != nil {
+		var syntaxErr *swimQuery.Error
+		if errors.As(err, &syntaxErr) {
+			return fmt.Errorf("invalid query: %v\n%s", err, syntaxErr.Pointer(q))
+		}
+		return err
+	}
+
+	// stdout is left to the results
+	log.SetOutput(os.Stderr)
+
+	store, err := openBackend(swimCfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.SetupDatabase(); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	enc := json.NewEncoder(out)
+	write := func(u swimModels.CertUpdateInfo) error {
+		if *asJSON {
+			return enc.Encode(u)
+		}
+		_, err := fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", u.Domain, u.NotBeforeTime, u.Issuer, u.Fingerprint)
+		return err
+	}
+
+	opts := swimModels.ListOptions{Page: 1, Size: *size, Sort: *sortKey, Desc: *desc, Query: query}
+	if streamer, ok := store.(swimModels.RowStreamer); ok {
+		return streamer.StreamCertUpdates(opts, write)
+	}
+	updates, err := store.ListCertUpdates(opts)
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		if err := write(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
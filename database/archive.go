@@ -0,0 +1,686 @@
+package database
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// Sightings older than the archive age are moved out of the database into segment files,
+// one per UTC day the certificates were first seen. A segment is gzip compressed NDJSON,
+// one sighting per line, sorted by the reversed label key of the name so the sightings of a
+// domain and its subdomains are next to each other. Every archiveBlockRows lines start a
+// new gzip member, and the index file next to the segment holds the offset and first key
+// of each one: a lookup decompresses only the blocks its names can be in.
+
+// archiveBlockRows is the number of sightings per compressed block of a segment
+const archiveBlockRows = 1000
+
+// archiveDay is the time span of a segment, in seconds
+const archiveDay = 24 * 60 * 60
+
+// ArchivePolicy says which sightings the archiver moves out of the database
+type ArchivePolicy struct {
+	After     time.Duration // sightings of days older than this are archived, 0 archives nothing
+	Interval  time.Duration // time between archiver runs
+	ChunkSize int           // archived sightings deleted per transaction
+}
+
+// Validate checks the policy and fills in defaults
+func (p *ArchivePolicy) Validate() error {
+	if p.After < 0 {
+		return fmt.Errorf("invalid archive age %s", p.After)
+	}
+	if p.Interval <= 0 {
+		p.Interval = time.Hour
+	}
+	if p.ChunkSize <= 0 {
+		p.ChunkSize = 5000
+	}
+	// two parameters are bound per sighting, SQLite accepts at most 32766
+	if p.ChunkSize > 15000 {
+		return fmt.Errorf("chunk size %d is larger than 15000", p.ChunkSize)
+	}
+	return nil
+}
+
+// Enabled reports whether the policy archives anything
+func (p ArchivePolicy) Enabled() bool {
+	return p.After > 0
+}
+
+// Archiver is a store whose old sightings can be moved to an archive
+type Archiver interface {
+	ArchiveSightings(archive *Archive, policy ArchivePolicy, stop chan struct{}) (ArchiveReport, error)
+}
+
+// ArchiveReport summarizes what an archiver run moved
+type ArchiveReport struct {
+	Segments  int
+	Sightings int64
+	Bytes     int64 // compressed size of the segments written
+	Pruned    PruneReport
+}
+
+func (r ArchiveReport) String() string {
+	return fmt.Sprintf("%d sightings in %d segments (%d bytes), %d certificates and %d names removed, %d bytes freed",
+		r.Sightings, r.Segments, r.Bytes, r.Pruned.Certificates, r.Pruned.Names, r.Pruned.FreedBytes)
+}
+
+// ArchiveWorker archives the sightings selected by policy every policy.Interval until stop
+// is closed
+func ArchiveWorker(store Archiver, archive *Archive, policy ArchivePolicy, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := store.ArchiveSightings(archive, policy, stop)
+		if err != nil {
+			log.Printf("Error archiving sightings: %v", err)
+		}
+		if report.Sightings > 0 {
+			log.Printf("Archive: moved %s", report)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Archive is a directory of segment files
+type Archive struct {
+	dir string
+
+	mu       sync.RWMutex
+	segments []*segment // by day, then in the order they were written
+}
+
+// segment is the index of a segment file
+type segment struct {
+	path   string         // the NDJSON file
+	Day    int64          `json:"day"` // unix time the day of its sightings starts
+	Rows   int64          `json:"rows"`
+	Blocks []segmentBlock `json:"blocks"`
+}
+
+// segmentBlock is a gzip member of a segment
+type segmentBlock struct {
+	Key    string `json:"key"`    // reversed label key of its first sighting
+	Offset int64  `json:"offset"` // in the compressed file
+}
+
+// archivedSighting is a line of a segment: a name/certificate pair with the certificate
+type archivedSighting struct {
+	Name                string `json:"name"`
+	IsApex              bool   `json:"is_apex"`
+	ParentDomain        string `json:"parent_domain"`
+	Fingerprint         string `json:"fingerprint"`
+	EntryType           string `json:"entry_type,omitempty"`
+	SerialNumber        string `json:"serial_number"`
+	Issuer              string `json:"issuer"`
+	NotBefore           int64  `json:"not_before"`
+	NotAfter            int64  `json:"not_after"`
+	KeyUsage            string `json:"key_usage"`
+	ExtendedKeyUsage    string `json:"extended_key_usage"`
+	SubjectKeyID        string `json:"subject_key_id"`
+	AuthorityKeyID      string `json:"authority_key_id"`
+	AuthorityInfo       string `json:"authority_info"`
+	SubjectAltName      string `json:"subject_alt_name"`
+	CertificatePolicies string `json:"certificate_policies"`
+	Wildcard            bool   `json:"wildcard"`
+	Seen                int64  `json:"seen"`
+}
+
+// OpenArchive opens the archive in dir, creating the directory if needed. Segments without
+// an index are left over from an interrupted run and ignored, their sightings are still
+// in the database.
+func OpenArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating archive directory: %w", err)
+	}
+
+	indexes, err := filepath.Glob(filepath.Join(dir, "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archive{dir: dir}
+	for _, index := range indexes {
+		data, err := os.ReadFile(index)
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive index: %w", err)
+		}
+		seg := &segment{path: strings.TrimSuffix(index, ".idx") + ".ndjson.gz"}
+		if err := json.Unmarshal(data, seg); err != nil {
+			return nil, fmt.Errorf("error reading archive index %s: %w", index, err)
+		}
+		if _, err := os.Stat(seg.path); err != nil {
+			return nil, fmt.Errorf("archive segment of index %s: %w", index, err)
+		}
+		a.segments = append(a.segments, seg)
+	}
+	a.sortSegments()
+	return a, nil
+}
+
+// sortSegments orders the segments by day, and segments of the same day by file name
+func (a *Archive) sortSegments() {
+	sort.Slice(a.segments, func(i, j int) bool {
+		if a.segments[i].Day != a.segments[j].Day {
+			return a.segments[i].Day < a.segments[j].Day
+		}
+		return a.segments[i].path < a.segments[j].path
+	})
+}
+
+// segmentWriter writes the sightings of a segment, they have to come in key order
+type segmentWriter struct {
+	seg     *segment
+	file    *os.File
+	written *countingWriter
+	gz      *gzip.Writer
+	enc     *json.Encoder
+	lastKey string
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// create starts a segment for the sightings of day. Segments already written for the day
+// are kept, the new one gets the next sequence number.
+func (a *Archive) create(day int64) (*segmentWriter, error) {
+	base := filepath.Join(a.dir, time.Unix(day, 0).UTC().Format("2006-01-02"))
+	path := base + ".ndjson.gz"
+	for seq := 1; ; seq++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = fmt.Sprintf("%s.%d.ndjson.gz", base, seq)
+	}
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive segment: %w", err)
+	}
+	written := &countingWriter{w: bufio.NewWriter(file)}
+	return &segmentWriter{seg: &segment{path: path, Day: day}, file: file, written: written}, nil
+}
+
+// write appends a sighting to the segment
+func (w *segmentWriter) write(row *archivedSighting) error {
+	key := reverseLabels(row.Name)
+	if key < w.lastKey {
+		return fmt.Errorf("archive rows out of order: %q after %q", key, w.lastKey)
+	}
+	w.lastKey = key
+
+	if w.seg.Rows%archiveBlockRows == 0 {
+		if err := w.closeBlock(); err != nil {
+			return err
+		}
+		w.seg.Blocks = append(w.seg.Blocks, segmentBlock{Key: key, Offset: w.written.n})
+		w.gz = gzip.NewWriter(w.written)
+		w.enc = json.NewEncoder(w.gz)
+	}
+	w.seg.Rows++
+	return w.enc.Encode(row)
+}
+
+// closeBlock ends the current gzip member
+func (w *segmentWriter) closeBlock() error {
+	if w.gz == nil {
+		return nil
+	}
+	if err := w.gz.Close(); err != nil {
+		return fmt.Errorf("error compressing archive segment: %w", err)
+	}
+	w.gz = nil
+	return nil
+}
+
+// commit syncs the segment to disk and writes its index, the segment is complete once the
+// index exists
+func (w *segmentWriter) commit() (*segment, error) {
+	err := w.closeBlock()
+	if err == nil {
+		err = w.written.w.(*bufio.Writer).Flush()
+	}
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.file.Name(), w.seg.path)
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return nil, fmt.Errorf("error writing archive segment: %w", err)
+	}
+
+	index, err := json.Marshal(w.seg)
+	if err != nil {
+		return nil, err
+	}
+	indexPath := strings.TrimSuffix(w.seg.path, ".ndjson.gz") + ".idx"
+	if err := os.WriteFile(indexPath+".tmp", index, 0644); err != nil {
+		return nil, fmt.Errorf("error writing archive index: %w", err)
+	}
+	if err := os.Rename(indexPath+".tmp", indexPath); err != nil {
+		return nil, fmt.Errorf("error writing archive index: %w", err)
+	}
+	return w.seg, nil
+}
+
+// abort removes the unfinished segment
+func (w *segmentWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// add makes a committed segment visible to lookups
+func (a *Archive) add(seg *segment) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.segments = append(a.segments, seg)
+	a.sortSegments()
+}
+
+// scan calls f with the sightings of the segment whose key is in [from, to), in key order
+func (seg *segment) scan(from, to string, f func(key string, row *archivedSighting)) error {
+	// equal keys can continue in the next block, so the first block that can hold from is
+	// the last one starting before it
+	i := sort.Search(len(seg.Blocks), func(i int) bool { return seg.Blocks[i].Key >= from })
+	if i > 0 {
+		i--
+	}
+	if i == len(seg.Blocks) || seg.Blocks[i].Key >= to {
+		return nil
+	}
+
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return fmt.Errorf("error opening archive segment: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(seg.Blocks[i].Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// the reader continues with the following gzip members
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("error reading archive segment %s: %w", seg.path, err)
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var row archivedSighting
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return fmt.Errorf("error reading archive segment %s: %w", seg.path, err)
+		}
+		key := reverseLabels(row.Name)
+		if key >= to {
+			return nil
+		}
+		if key >= from {
+			f(key, &row)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading archive segment %s: %w", seg.path, err)
+	}
+	return nil
+}
+
+// lookup calls f with the archived sightings of domain, and of the names below it if
+// subdomains is set, that were seen in [since, until). 0 leaves the range open on that side.
+func (a *Archive) lookup(domain string, subdomains bool, since, until int64, f func(row *archivedSighting)) error {
+	a.mu.RLock()
+	segments := append([]*segment(nil), a.segments...)
+	a.mu.RUnlock()
+
+	// "com.example" is followed by "com.example.*" up to "com.example/", '/' comes after '.'
+	key := reverseLabels(domain)
+	to := key + "\x00"
+	if subdomains {
+		to = key + "/"
+	}
+
+	for _, seg := range segments {
+		if (since > 0 && seg.Day+archiveDay <= since) || (until > 0 && seg.Day >= until) {
+			continue
+		}
+		err := seg.scan(key, to, func(rowKey string, row *archivedSighting) {
+			if rowKey != key && !strings.HasPrefix(rowKey, key+".") {
+				return
+			}
+			if (since > 0 && row.Seen < since) || (until > 0 && row.Seen >= until) {
+				return
+			}
+			f(row)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivedName is the history of a name in the archive
+type archivedName struct {
+	firstSeen, lastSeen int64
+	certs               map[string]bool // fingerprints
+}
+
+// names returns the history of domain, and of the names below it if subdomains is set, in
+// the sightings archived for [since, until)
+func (a *Archive) names(domain string, subdomains bool, since, until int64) (map[string]*archivedName, error) {
+	names := make(map[string]*archivedName)
+	err := a.lookup(domain, subdomains, since, until, func(row *archivedSighting) {
+		n, ok := names[row.Name]
+		if !ok {
+			n = &archivedName{firstSeen: row.Seen, lastSeen: row.Seen, certs: make(map[string]bool)}
+			names[row.Name] = n
+		}
+		n.firstSeen = min(n.firstSeen, row.Seen)
+		n.lastSeen = max(n.lastSeen, row.Seen)
+		n.certs[row.Fingerprint] = true
+	})
+	return names, err
+}
+
+// SetArchive lets queries with opts.Archive read the sightings moved to archive
+func (s *SQLStore) SetArchive(archive *Archive) {
+	s.archive = archive
+}
+
+// archivedSubdomains returns the names below domain, at most opts.Depth labels below it if
+// set, with their history in the archive
+func (s *SQLStore) archivedSubdomains(domain string, opts swimModels.ListOptions) ([]swimModels.Subdomain, error) {
+	names, err := s.archive.names(domain, true, opts.Since, opts.Until)
+	if err != nil {
+		return nil, err
+	}
+
+	maxDots := strings.Count(domain, ".") + opts.Depth
+	subdomains := make([]swimModels.Subdomain, 0, len(names))
+	for name, n := range names {
+		if name == domain || (opts.Depth > 0 && strings.Count(name, ".") > maxDots) {
+			continue
+		}
+		subdomains = append(subdomains, swimModels.Subdomain{Name: name, FirstSeen: n.firstSeen, LastSeen: n.lastSeen, CertCount: int64(len(n.certs))})
+	}
+	return subdomains, nil
+}
+
+// SearchArchive returns a page of the archived sightings of domain, and of the names below
+// it if subdomains is set, ordered by name and time, all of them for a Size of 0.
+// first_seen, last_seen and cert_count describe the archived history of each name.
+func (s *SQLStore) SearchArchive(domain string, subdomains bool, opts swimModels.ListOptions) ([]swimModels.CertUpdateInfo, error) {
+	if s.archive == nil {
+		return nil, fmt.Errorf("archive search is not enabled")
+	}
+
+	var rows []*archivedSighting
+	err := s.archive.lookup(domain, subdomains, opts.Since, opts.Until, func(row *archivedSighting) {
+		rows = append(rows, row)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// segments of the same day written by an interrupted run can hold the same sighting twice
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Name != rows[j].Name {
+			return rows[i].Name < rows[j].Name
+		}
+		if rows[i].Seen != rows[j].Seen {
+			return rows[i].Seen < rows[j].Seen
+		}
+		return rows[i].Fingerprint < rows[j].Fingerprint
+	})
+	rows = slices.CompactFunc(rows, func(a, b *archivedSighting) bool {
+		return a.Name == b.Name && a.Fingerprint == b.Fingerprint
+	})
+
+	history := make(map[string]*archivedName)
+	for _, row := range rows {
+		n, ok := history[row.Name]
+		if !ok {
+			n = &archivedName{firstSeen: row.Seen, certs: make(map[string]bool)}
+			history[row.Name] = n
+		}
+		n.lastSeen = row.Seen
+		n.certs[row.Fingerprint] = true
+	}
+
+	rows = page(rows, opts)
+
+	updates := make([]swimModels.CertUpdateInfo, 0, len(rows))
+	for _, row := range rows {
+		n := history[row.Name]
+		updates = append(updates, swimModels.CertUpdateInfo{
+			Domain:              row.Name,
+			IsApex:              row.IsApex,
+			ParentDomain:        row.ParentDomain,
+			NotBefore:           row.NotBefore,
+			NotBeforeTime:       time.Unix(row.NotBefore, 0).Format(time.RFC3339),
+			NotAfter:            row.NotAfter,
+			NotAfterTime:        time.Unix(row.NotAfter, 0).Format(time.RFC3339),
+			SerialNumber:        row.SerialNumber,
+			Issuer:              row.Issuer,
+			Fingerprint:         row.Fingerprint,
+			EntryType:           row.EntryType,
+			KeyUsage:            row.KeyUsage,
+			ExtendedKeyUsage:    row.ExtendedKeyUsage,
+			SubjectKeyID:        row.SubjectKeyID,
+			AuthorityKeyID:      row.AuthorityKeyID,
+			AuthorityInfo:       row.AuthorityInfo,
+			SubjectAltName:      row.SubjectAltName,
+			CertificatePolicies: row.CertificatePolicies,
+			Wildcard:            row.Wildcard,
+			Seen:                row.Seen,
+			SeenTime:            time.Unix(row.Seen, 0).Format(time.RFC3339),
+			FirstSeen:           n.firstSeen,
+			FirstSeenTime:       time.Unix(n.firstSeen, 0).Format(time.RFC3339),
+			LastSeen:            n.lastSeen,
+			LastSeenTime:        time.Unix(n.lastSeen, 0).Format(time.RFC3339),
+			CertCount:           int64(len(n.certs)),
+		})
+	}
+	return updates, nil
+}
+
+// ArchiveSightings moves the sightings of every whole UTC day older than policy.After to
+// archive, a segment per day, oldest first. A day is written to its segment before it is
+// deleted from the database, in chunks of policy.ChunkSize sightings along with the
+// certificates and names left without sightings. It returns early, without error, once
+// stop is closed.
+func (s *SQLStore) ArchiveSightings(archive *Archive, policy ArchivePolicy, stop chan struct{}) (ArchiveReport, error) {
+	var report ArchiveReport
+	if err := policy.Validate(); err != nil {
+		return report, err
+	}
+	if !policy.Enabled() {
+		return report, nil
+	}
+
+	sizeBefore, err := s.usedBytes()
+	if err != nil {
+		return report, err
+	}
+
+	cutoff := time.Now().Add(-policy.After).Unix()
+	var from int64
+	for !stopped(stop) {
+		// sightings inserted while a day was archived stay behind, they go to another
+		// segment of that day on the next run
+		var oldest sql.NullInt64
+		if err := s.read.QueryRow(s.dialect.rebind("SELECT MIN(seen) FROM certificate_names WHERE seen >= ?"), from).Scan(&oldest); err != nil {
+			return report, fmt.Errorf("error finding the oldest sighting: %w", err)
+		}
+		if !oldest.Valid {
+			break
+		}
+		day := oldest.Int64 - oldest.Int64%archiveDay
+		if day+archiveDay > cutoff {
+			break
+		}
+		if err := s.archiveDay(archive, day, policy.ChunkSize, &report); err != nil {
+			return report, err
+		}
+		from = day + archiveDay
+	}
+
+	if report.Sightings > 0 {
+		if err := s.vacuumFreed(); err != nil {
+			return report, err
+		}
+	}
+
+	sizeAfter, err := s.usedBytes()
+	if err != nil {
+		return report, err
+	}
+	report.Pruned.FreedBytes = max(sizeBefore-sizeAfter, 0)
+	return report, nil
+}
+
+// sightingKey identifies a row of certificate_names
+type sightingKey struct {
+	certID, nameID int64
+}
+
+// archiveDay writes the sightings of the day starting at day to a new segment and deletes
+// them from the database
+func (s *SQLStore) archiveDay(archive *Archive, day int64, chunkSize int, report *ArchiveReport) error {
+	rows, err := s.read.Query(s.dialect.rebind(`SELECT cn.certificate_id, cn.name_id, n.name, n.is_apex, n.parent_domain, c.fingerprint, COALESCE(c.entry_type, ''), c.serial_number, COALESCE(c.issuer, ''), c.not_before, c.not_after, c.key_usage, c.extended_key_usage, c.subject_key_id, c.authority_key_id, c.authority_info, c.subject_alt_name, c.certificate_policies, cn.wildcard, cn.seen
+        FROM certificate_names cn
+        JOIN names n ON n.id = cn.name_id
+        JOIN certificates c ON c.id = cn.certificate_id
+        WHERE cn.seen >= ? AND cn.seen < ?
+        ORDER BY n.reversed, c.fingerprint`), day, day+archiveDay)
+	if err != nil {
+		return fmt.Errorf("error reading sightings to archive: %w", err)
+	}
+
+	w, err := archive.create(day)
+	if err != nil {
+		rows.Close()
+		return err
+	}
+
+	var keys []sightingKey
+	for rows.Next() {
+		var key sightingKey
+		var row archivedSighting
+		if err := rows.Scan(&key.certID, &key.nameID, &row.Name, &row.IsApex, &row.ParentDomain, &row.Fingerprint, &row.EntryType, &row.SerialNumber, &row.Issuer, &row.NotBefore, &row.NotAfter, &row.KeyUsage, &row.ExtendedKeyUsage, &row.SubjectKeyID, &row.AuthorityKeyID, &row.AuthorityInfo, &row.SubjectAltName, &row.CertificatePolicies, &row.Wildcard, &row.Seen); err != nil {
+			rows.Close()
+			w.abort()
+			return err
+		}
+		if err := w.write(&row); err != nil {
+			rows.Close()
+			w.abort()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		w.abort()
+		return fmt.Errorf("error reading sightings to archive: %w", err)
+	}
+	if len(keys) == 0 {
+		w.abort()
+		return nil
+	}
+
+	seg, err := w.commit()
+	if err != nil {
+		return err
+	}
+	archive.add(seg)
+	report.Segments++
+	report.Bytes += w.written.n
+
+	for start := 0; start < len(keys); start += chunkSize {
+		chunk := keys[start:min(start+chunkSize, len(keys))]
+		if err := s.deleteSightings(day, chunk, &report.Pruned); err != nil {
+			return err
+		}
+		report.Sightings += int64(len(chunk))
+	}
+	return nil
+}
+
+// deleteSightings deletes archived sightings of the day starting at day, with the
+// certificates and names left without sightings
+func (s *SQLStore) deleteSightings(day int64, keys []sightingKey, report *PruneReport) error {
+	tx, err := s.write.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := []interface{}{day, day + archiveDay}
+	pairs := make([]string, len(keys))
+	certIDs := make(map[int64]bool)
+	nameIDs := make(map[int64]bool)
+	for i, key := range keys {
+		pairs[i] = "(?, ?)"
+		args = append(args, key.certID, key.nameID)
+		certIDs[key.certID] = true
+		nameIDs[key.nameID] = true
+	}
+
+	// the seen range lets postgres skip the partitions of other months
+	if _, err := tx.Exec(s.dialect.rebind(`DELETE FROM certificate_names WHERE seen >= ? AND seen < ?
+        AND (certificate_id, name_id) IN (`+strings.Join(pairs, ", ")+`)`), args...); err != nil {
+		return fmt.Errorf("error deleting archived sightings: %w", err)
+	}
+
+	var orphans PruneReport
+	if err := s.pruneOrphans(tx, &orphans, certIDs, nameIDs); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	report.Sightings += int64(len(keys))
+	report.Names += orphans.Names
+	report.Certificates += orphans.Certificates
+	return nil
+}
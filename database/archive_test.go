@@ -0,0 +1,47 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+func TestSearchArchivePaging(t *testing.T) {
+	s := openTestStore(t)
+	insertCerts(t, s, 100, 10, 100)
+
+	archive, err := OpenArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetArchive(archive)
+	report, err := s.ArchiveSightings(archive, ArchivePolicy{After: 24 * time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sightings != 400 {
+		t.Fatalf("archived %d sightings, want 400", report.Sightings)
+	}
+
+	// apex domain 0 has 10 certificates of four names
+	apex := testApex(0, 10)
+	for _, test := range []struct {
+		opts swimModels.ListOptions
+		want int
+	}{
+		{swimModels.ListOptions{}, 40},
+		{swimModels.ListOptions{Page: 1, Size: 0}, 40},
+		{swimModels.ListOptions{Page: 1, Size: 15}, 15},
+		{swimModels.ListOptions{Page: 3, Size: 15}, 10},
+		{swimModels.ListOptions{Page: 4, Size: 15}, 0},
+	} {
+		updates, err := s.SearchArchive(apex, true, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(updates) != test.want {
+			t.Errorf("SearchArchive(%q, %+v) returned %d sightings, want %d", apex, test.opts, len(updates), test.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// certificateColumns are the columns of certificates c read into swimModels.Certificate
+const certificateColumns = `c.id, c.fingerprint, COALESCE(c.serial_number, ''), COALESCE(c.issuer, ''), COALESCE(c.entry_type, ''), COALESCE(c.not_before, 0), COALESCE(c.not_after, 0),
+    COALESCE(c.key_usage, ''), COALESCE(c.extended_key_usage, ''), COALESCE(c.subject_key_id, ''), COALESCE(c.authority_key_id, ''), COALESCE(c.authority_info, ''),
+    COALESCE(c.subject_alt_name, ''), COALESCE(c.certificate_policies, ''), COALESCE(c.seen, 0)`
+
+// lookupSchema indexes the identifiers certificates are looked up by
+var lookupSchema = []string{
+	`CREATE INDEX idx_certificates_serial_number ON certificates (serial_number)`,
+	`CREATE INDEX idx_certificates_subject_key_id ON certificates (subject_key_id)`,
+	`CREATE INDEX idx_certificates_authority_key_id ON certificates (authority_key_id)`,
+}
+
+// dropLookup reverts lookupSchema
+var dropLookup = []string{
+	`DROP INDEX idx_certificates_authority_key_id`,
+	`DROP INDEX idx_certificates_subject_key_id`,
+	`DROP INDEX idx_certificates_serial_number`,
+}
+
+// DomainDetail returns the sighting history of domain and the certificates covering it.
+// Wildcard certificates are found through the name they are stored with, the parent
+// domain: a certificate for *.example.com is linked to example.com with the wildcard flag.
+// Certificates listing only the wildcard and not the parent domain itself were never
+// stored with a name and can't be found.
+func (s *SQLStore) DomainDetail(domain string, size int) (*swimModels.DomainDetail, error) {
+	detail := &swimModels.DomainDetail{
+		Domain:               domain,
+		Reversed:             reverseLabels(domain),
+		Certificates:         []swimModels.Certificate{},
+		WildcardCertificates: []swimModels.Certificate{},
+	}
+
+	var nameID int64
+	err := s.read.QueryRow(s.dialect.rebind("SELECT id, COALESCE(first_seen, 0), COALESCE(last_seen, 0), cert_count FROM names WHERE name = ?"), domain).
+		Scan(&nameID, &detail.FirstSeen, &detail.LastSeen, &detail.CertCount)
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error reading name: %w", err)
+	}
+
+	if found {
+		detail.FirstSeenTime = time.Unix(detail.FirstSeen, 0).Format(time.RFC3339)
+		detail.LastSeenTime = time.Unix(detail.LastSeen, 0).Format(time.RFC3339)
+		detail.Certificates, err = s.certificates(`FROM certificate_names cn
+            JOIN certificates c ON c.id = cn.certificate_id`, []string{"cn.name_id = ?"}, []interface{}{nameID}, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, parent, ok := strings.Cut(domain, "."); ok && strings.Contains(parent, ".") {
+		detail.WildcardCertificates, err = s.certificates(`FROM names n
+            JOIN certificate_names cn ON cn.name_id = n.id
+            JOIN certificates c ON c.id = cn.certificate_id`, []string{"n.name = ?", "cn.wildcard = ?"}, []interface{}{parent, true}, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !found && len(detail.WildcardCertificates) == 0 {
+		return nil, nil
+	}
+	return detail, nil
+}
+
+// Certificate returns the certificate with the given fingerprint, nil if it was not stored
+func (s *SQLStore) Certificate(fingerprint string) (*swimModels.Certificate, error) {
+	certs, err := s.certificates("FROM certificates c", []string{"c.fingerprint = ?"}, []interface{}{fingerprint}, 1)
+	if err != nil || len(certs) == 0 {
+		return nil, err
+	}
+	return &certs[0], nil
+}
+
+// LookupCertificates returns the certificates matching every identifier set in lookup. The
+// identifiers are compared in each of the forms CertStream writes them in, see
+// identifierForms.
+func (s *SQLStore) LookupCertificates(lookup swimModels.CertificateLookup, size int) ([]swimModels.Certificate, error) {
+	var conds []string
+	var args []interface{}
+	add := func(column string, forms []string) {
+		conds = append(conds, column+" IN ("+placeholders(len(forms))+")")
+		for _, form := range forms {
+			args = append(args, form)
+		}
+	}
+
+	if lookup.Serial != "" {
+		add("c.serial_number", serialForms(lookup.Serial))
+	}
+	if lookup.SubjectKeyID != "" {
+		add("c.subject_key_id", identifierForms(lookup.SubjectKeyID, ""))
+	}
+	if lookup.AuthorityKeyID != "" {
+		add("c.authority_key_id", identifierForms(lookup.AuthorityKeyID, "keyid:"))
+	}
+	if len(conds) == 0 {
+		return []swimModels.Certificate{}, nil
+	}
+	return s.certificates("FROM certificates c", conds, args, size)
+}
+
+// serialForms returns the forms of a serial number in hex: CertStream drops its leading
+// zeros, other sources pad it to whole bytes
+func serialForms(digits string) []string {
+	digits = strings.ToUpper(digits)
+	trimmed := strings.TrimLeft(digits, "0")
+	if trimmed == "" {
+		trimmed = "0"
+	}
+	forms := []string{trimmed}
+	if len(trimmed)%2 == 1 {
+		forms = append(forms, "0"+trimmed)
+	}
+	if !slices.Contains(forms, digits) {
+		forms = append(forms, digits)
+	}
+	return forms
+}
+
+// identifierForms returns the forms of a key identifier in hex: the bytes separated by
+// colons, after prefix and followed by the newline CertStream leaves at the end of
+// authority key identifiers, and the bare digits
+func identifierForms(digits, prefix string) []string {
+	digits = strings.ToUpper(digits)
+	if len(digits)%2 == 1 {
+		digits = "0" + digits
+	}
+	pairs := make([]string, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		pairs = append(pairs, digits[i:i+2])
+	}
+	colons := strings.Join(pairs, ":")
+
+	forms := []string{prefix + colons, digits}
+	if prefix != "" {
+		forms = append(forms, prefix+colons+"\n", colons)
+	}
+	return forms
+}
+
+// certificates returns the certificates selected by from and conds, the newest first, with
+// the names they cover. A size of 0 returns all of them.
+func (s *SQLStore) certificates(from string, conds []string, args []interface{}, size int) ([]swimModels.Certificate, error) {
+	query := "SELECT " + certificateColumns + " " + from + " " + where(conds) + "ORDER BY c.not_before DESC, c.fingerprint"
+	if size > 0 {
+		query += " LIMIT ?"
+		args = append(args, size)
+	}
+
+	rows, err := s.read.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificates: %w", err)
+	}
+	defer rows.Close()
+
+	certs := []swimModels.Certificate{}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var cert swimModels.Certificate
+		err := rows.Scan(&id, &cert.Fingerprint, &cert.SerialNumber, &cert.Issuer, &cert.EntryType, &cert.NotBefore, &cert.NotAfter,
+			&cert.KeyUsage, &cert.ExtendedKeyUsage, &cert.SubjectKeyID, &cert.AuthorityKeyID, &cert.AuthorityInfo,
+			&cert.SubjectAltName, &cert.CertificatePolicies, &cert.Seen)
+		if err != nil {
+			return nil, err
+		}
+		cert.NotBeforeTime = time.Unix(cert.NotBefore, 0).Format(time.RFC3339)
+		cert.NotAfterTime = time.Unix(cert.NotAfter, 0).Format(time.RFC3339)
+		cert.SeenTime = time.Unix(cert.Seen, 0).Format(time.RFC3339)
+		certs = append(certs, cert)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	names, err := s.certificateNames(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range certs {
+		certs[i].Names = names[ids[i]]
+		slices.Sort(certs[i].Names)
+	}
+	return certs, nil
+}
+
+// certificateNames returns the names covered by each of the certificates with the given
+// ids, a name linked with the wildcard flag is covered by the wildcard as well
+func (s *SQLStore) certificateNames(ids []int64) (map[int64][]string, error) {
+	names := make(map[int64][]string, len(ids))
+	err := chunks(len(ids), func(start, end int) error {
+		args := make([]interface{}, end-start)
+		for i, id := range ids[start:end] {
+			args[i] = id
+		}
+
+		rows, err := s.read.Query(s.dialect.rebind(`SELECT cn.certificate_id, n.name, cn.wildcard
+            FROM certificate_names cn
+            JOIN names n ON n.id = cn.name_id
+            WHERE cn.certificate_id IN (`+placeholders(len(args))+`)`), args...)
+		if err != nil {
+			return fmt.Errorf("error reading certificate names: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+			var name string
+			var wildcard bool
+			if err := rows.Scan(&id, &name, &wildcard); err != nil {
+				return err
+			}
+			names[id] = append(names[id], name)
+			if wildcard {
+				names[id] = append(names[id], "*."+name)
+			}
+		}
+		return rows.Err()
+	})
+	return names, err
+}
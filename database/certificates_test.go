@@ -0,0 +1,87 @@
+package database
+
+import (
+	"slices"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+func TestSerialForms(t *testing.T) {
+	for _, test := range []struct {
+		digits string
+		want   []string
+	}{
+		{"0A1B", []string{"A1B", "0A1B"}},
+		{"a1b", []string{"A1B", "0A1B"}},
+		{"00A1B2", []string{"A1B2", "00A1B2"}},
+		{"000A1B", []string{"A1B", "0A1B", "000A1B"}},
+		{"A1B2", []string{"A1B2"}},
+		{"0", []string{"0", "00"}},
+		{"00", []string{"0", "00"}},
+	} {
+		if got := serialForms(test.digits); !slices.Equal(got, test.want) {
+			t.Errorf("serialForms(%q) = %q, want %q", test.digits, got, test.want)
+		}
+	}
+}
+
+func TestIdentifierForms(t *testing.T) {
+	for _, test := range []struct {
+		digits, prefix string
+		want           []string
+	}{
+		{"ab12cd", "", []string{"AB:12:CD", "AB12CD"}},
+		{"B12CD", "", []string{"0B:12:CD", "0B12CD"}},
+		{"AB12CD", "keyid:", []string{"keyid:AB:12:CD", "AB12CD", "keyid:AB:12:CD\n", "AB:12:CD"}},
+	} {
+		if got := identifierForms(test.digits, test.prefix); !slices.Equal(got, test.want) {
+			t.Errorf("identifierForms(%q, %q) = %q, want %q", test.digits, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestLookupCertificates(t *testing.T) {
+	s := openTestStore(t)
+	cert := func(name, fingerprint, serial, skid, akid string) swimModels.CertUpdateInfo {
+		return swimModels.CertUpdateInfo{Domain: name, Fingerprint: fingerprint, SerialNumber: serial, SubjectKeyID: skid, AuthorityKeyID: akid, NotBefore: testStart, NotAfter: testStart + 86400, Seen: testStart}
+	}
+	// the identifiers in the forms CertStream writes them in
+	err := s.InsertBatch([]swimModels.CertUpdateInfo{
+		cert("a.example.com", "AA", "A1B", "01:02:03", "keyid:AB:CD\n"),
+		cert("b.example.com", "BB", "C1", "0102FF", "keyid:AB:CD\n"),
+		cert("c.example.com", "CC", "C2", "", "AB:CD"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		lookup swimModels.CertificateLookup
+		want   []string
+	}{
+		// serials with their leading zeros dropped or padded to whole bytes
+		{swimModels.CertificateLookup{Serial: "0A1B"}, []string{"AA"}},
+		{swimModels.CertificateLookup{Serial: "A1B"}, []string{"AA"}},
+		{swimModels.CertificateLookup{Serial: "00C1"}, []string{"BB"}},
+		{swimModels.CertificateLookup{Serial: "000C2"}, []string{"CC"}},
+		{swimModels.CertificateLookup{SubjectKeyID: "010203"}, []string{"AA"}},
+		{swimModels.CertificateLookup{SubjectKeyID: "102FF"}, []string{"BB"}},
+		{swimModels.CertificateLookup{AuthorityKeyID: "ABCD"}, []string{"AA", "BB", "CC"}},
+		{swimModels.CertificateLookup{AuthorityKeyID: "ABCD", Serial: "C1"}, []string{"BB"}},
+		{swimModels.CertificateLookup{AuthorityKeyID: "ABCE"}, nil},
+	} {
+		certs, err := s.LookupCertificates(test.lookup, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range certs {
+			got = append(got, c.Fingerprint)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("LookupCertificates(%+v) = %v, want %v", test.lookup, got, test.want)
+		}
+	}
+}
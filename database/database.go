@@ -1,10 +1,12 @@
 package database
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,93 +14,21 @@ import (
 	swimModels "github.com/dap-ware/swim/models"
 )
 
-func SetupDatabase(db *sql.DB) error {
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS domains (
-        id INTEGER PRIMARY KEY,
-        domain TEXT NOT NULL UNIQUE,
-		is_apex BOOLEAN NOT NULL,
-		parent_domain TEXT,
-        not_before INTEGER,
-        not_after INTEGER,
-        serial_number TEXT,
-        fingerprint TEXT,
-        key_usage TEXT,
-        extended_key_usage TEXT,
-        subject_key_id TEXT,
-        authority_key_id TEXT,
-        authority_info TEXT,
-        subject_alt_name TEXT,
-        certificate_policies TEXT,
-        wildcard BOOLEAN
-    );`
-
-	_, err := db.Exec(createTableSQL)
-	if err != nil {
-		return fmt.Errorf("error creating domains table: %w", err)
-	}
-
-	// check if the parent_domain column exists
-	rows, err := db.Query("PRAGMA table_info(domains);")
-	if err != nil {
-		return fmt.Errorf("error getting domains table info: %w", err)
-	}
-	defer rows.Close()
-
-	hasParentDomain := false
-	for rows.Next() {
-		var cid int
-		var name string
-		var dataType string
-		var notnull bool
-		var dfltValue *string
-		var pk int
-		if err := rows.Scan(&cid, &name, &dataType, &notnull, &dfltValue, &pk); err != nil {
-			return fmt.Errorf("error scanning row: %w", err)
-		}
-		if name == "parent_domain" {
-			hasParentDomain = true
-			break
-		}
-	}
-
-	// if the parent_domain column doesn't exist, add it
-	if !hasParentDomain {
-		_, err := db.Exec("ALTER TABLE domains ADD COLUMN parent_domain TEXT;")
-		if err != nil {
-			return fmt.Errorf("error adding parent_domain column: %w", err)
-		}
-	}
-
-	return nil
+// BatchInserter is what DbInsertWorker writes batches to: a store, or a DedupStore in front of one
+type BatchInserter interface {
+	InsertBatch(batch []swimModels.CertUpdateInfo) error
 }
 
 // dbInsertWorker is responsible for batch inserting domains into the database
-func DbInsertWorker(db *sql.DB, domains chan []swimModels.CertUpdateInfo, wg *sync.WaitGroup) {
+func DbInsertWorker(store BatchInserter, domains chan []swimModels.CertUpdateInfo, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for batch := range domains {
 		var err error
 		for attempt := 0; attempt < 3; attempt++ { // retry up to 3 times
-			// start a transaction
-			tx, err := db.Begin()
-			if err != nil {
-				log.Printf("Error starting transaction: %v", err)
-				continue
-			}
-
-			err = insertBatch(tx, batch)
+			err = store.InsertBatch(batch)
 			if err == nil {
-				// commit the transaction if there was no error
-				if err := tx.Commit(); err != nil {
-					log.Printf("Error committing transaction: %v", err)
-				}
 				break
-			} else {
-				// rollback the transaction if there was an error
-				if err := tx.Rollback(); err != nil {
-					log.Printf("Error rolling back transaction: %v", err)
-				}
 			}
 
 			log.Printf("Retry %d: Error inserting batch: %v", attempt+1, err)
@@ -110,141 +40,6 @@ func DbInsertWorker(db *sql.DB, domains chan []swimModels.CertUpdateInfo, wg *sy
 	}
 }
 
-func insertBatch(tx *sql.Tx, batch []swimModels.CertUpdateInfo) error {
-	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO domains (domain, not_before, not_after, serial_number, fingerprint, key_usage, extended_key_usage, subject_key_id, authority_key_id, authority_info, subject_alt_name, certificate_policies, wildcard, is_apex, parent_domain) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	for _, domainInfo := range batch {
-
-		// check if the domain is an apex domain
-		domainInfo.IsApex = isApexDomain(domainInfo.Domain)
-
-		// determine the parent domain
-		parentDomain := getParentDomain(domainInfo.Domain)
-
-		_, err = stmt.Exec(domainInfo.Domain, domainInfo.NotBefore, domainInfo.NotAfter, domainInfo.SerialNumber, domainInfo.Fingerprint, domainInfo.KeyUsage, domainInfo.ExtendedKeyUsage, domainInfo.SubjectKeyID, domainInfo.AuthorityKeyID, domainInfo.AuthorityInfo, domainInfo.SubjectAltName, domainInfo.CertificatePolicies, domainInfo.Wildcard, domainInfo.IsApex, parentDomain)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func FetchCertUpdatesFromDatabase(db *sql.DB, page, size int) ([]swimModels.CertUpdateInfo, error) {
-	offset := (page - 1) * size
-	query := `SELECT id, domain, is_apex, parent_domain, not_before, not_after, serial_number, fingerprint, key_usage, extended_key_usage, subject_key_id, authority_key_id, authority_info, subject_alt_name, certificate_policies, wildcard FROM domains ORDER BY domain LIMIT ? OFFSET ?`
-
-	rows, err := db.Query(query, size, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var domains []swimModels.CertUpdateInfo
-	for rows.Next() {
-		var domain swimModels.CertUpdateInfo
-		if err := rows.Scan(
-			&domain.ID,
-			&domain.Domain,
-			&domain.IsApex,
-			&domain.ParentDomain,
-			&domain.NotBefore,
-			&domain.NotAfter,
-			&domain.SerialNumber,
-			&domain.Fingerprint,
-			&domain.KeyUsage,
-			&domain.ExtendedKeyUsage,
-			&domain.SubjectKeyID,
-			&domain.AuthorityKeyID,
-			&domain.AuthorityInfo,
-			&domain.SubjectAltName,
-			&domain.CertificatePolicies,
-			&domain.Wildcard,
-		); err != nil {
-			return nil, err
-		}
-
-		// convert Unix timestamp to human-readable time, if needed
-		domain.NotBeforeTime = time.Unix(domain.NotBefore, 0).Format(time.RFC3339)
-
-		domains = append(domains, domain)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return domains, nil
-}
-
-func FetchSubdomainsFromDatabase(db *sql.DB, domain string) (*swimModels.DomainWithSubdomains, error) {
-	// query for the subdomains
-	rows, err := db.Query("SELECT domain FROM domains WHERE parent_domain = ?", domain)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	// scan the rows into a slice
-	var subdomains []string
-	for rows.Next() {
-		var subdomain string
-		if err := rows.Scan(&subdomain); err != nil {
-			return nil, err
-		}
-		subdomains = append(subdomains, subdomain)
-	}
-
-	// check for errors from iterating over rows
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return &swimModels.DomainWithSubdomains{
-		Domain:     domain,
-		Subdomains: subdomains,
-	}, nil
-}
-
-func FetchDomainNamesFromDatabase(db *sql.DB, domainNamesCh chan<- []string, page int, size int) error {
-	// calculate the offset based on the page number and size
-	offset := (page - 1) * size
-
-	// define the SQL query with LIMIT and OFFSET clauses
-	// select only domains that are marked as apex and do not start with 'www.'
-	query := fmt.Sprintf("SELECT domain FROM domains WHERE is_apex = true AND domain NOT LIKE 'www.%%' LIMIT %d OFFSET %d;", size, offset)
-
-	rows, err := db.Query(query)
-	if err != nil {
-		log.Printf("Database query error: %v", err)
-		return err
-	}
-
-	var domains []string
-
-	for rows.Next() {
-		var domain string
-		if err := rows.Scan(&domain); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			rows.Close() // close the rows before returning
-			return err
-		}
-		domains = append(domains, domain)
-	}
-
-	// close the rows
-	rows.Close()
-
-	// send the chunk of domain names to the channel
-	domainNamesCh <- domains
-
-	return nil
-}
-
 func CheckDatabaseSize(dbPath, maxSizeStr string) bool {
 	fileInfo, err := os.Stat(dbPath)
 	if err != nil {
@@ -261,26 +56,44 @@ func CheckDatabaseSize(dbPath, maxSizeStr string) bool {
 	return currentSize <= maxSize
 }
 
+// parseSize parses a size such as "512", "64K", "1.5GB" or "2TiB" into bytes. Units are
+// case-insensitive powers of 1024, a bare number or a B suffix means bytes.
 func parseSize(sizeStr string) (int64, error) {
-	var size int64
-	var unit string
+	s := strings.ToUpper(strings.TrimSpace(sizeStr))
 
-	_, err := fmt.Sscanf(sizeStr, "%d%s", &size, &unit)
-	if err != nil {
-		return 0, err
+	number, unit := s, ""
+	if i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' }); i >= 0 {
+		number, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", sizeStr)
 	}
 
-	switch strings.ToUpper(unit) {
+	// K, KB and KiB all mean kibibytes
+	var multiplier float64
+	switch strings.TrimSuffix(strings.TrimSuffix(unit, "IB"), "B") {
+	case "":
+		multiplier = 1
+	case "K":
+		multiplier = 1 << 10
 	case "M":
-		size *= 1024 * 1024
+		multiplier = 1 << 20
 	case "G":
-		size *= 1024 * 1024 * 1024
-	// Add more units as necessary
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
 	default:
 		return 0, fmt.Errorf("unknown unit %s", unit)
 	}
 
-	return size, nil
+	// float64(math.MaxInt64) rounds up to 2^63, which doesn't fit an int64 either
+	size := value * multiplier
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", sizeStr)
+	}
+	return int64(size), nil
 }
 
 // isApexDomain checks if the given domain is an apex domain
@@ -298,3 +111,12 @@ func getParentDomain(domain string) string {
 	}
 	return ""
 }
+
+// reverseLabels returns domain with its labels in reverse order, "a.b.example.com" becomes
+// "com.example.b.a". The names below a domain then share the reversed domain plus a dot as
+// prefix, which an index can find with a range scan.
+func reverseLabels(domain string) string {
+	labels := strings.Split(domain, ".")
+	slices.Reverse(labels)
+	return strings.Join(labels, ".")
+}
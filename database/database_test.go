@@ -0,0 +1,37 @@
+package database
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		size string
+		want int64
+		err  bool
+	}{
+		{size: "512", want: 512},
+		{size: "512B", want: 512},
+		{size: "64K", want: 64 << 10},
+		{size: "64kb", want: 64 << 10},
+		{size: "1.5GB", want: 3 << 29},
+		{size: " 2TiB ", want: 2 << 40},
+		{size: "8388607T", want: 8388607 << 40},
+		{size: "8388608T", err: true},
+		{size: "9999999999T", err: true},
+		{size: "99999999999999999999", err: true},
+		{size: "-1G", err: true},
+		{size: "G", err: true},
+		{size: "1P", err: true},
+		{size: "", err: true},
+	} {
+		got, err := parseSize(test.size)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, want an error", test.size, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", test.size, got, err, test.want)
+		}
+	}
+}
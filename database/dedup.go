@@ -0,0 +1,365 @@
+package database
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// A certificate is sent by CertStream once for every CT log it is submitted to, and the
+// names it covers are the same every time. DedupStore remembers the certificates it
+// stored, so repeated sightings skip the insert transaction and only move the last_seen
+// time of their names forward, in one bulk update per batch.
+
+// dedupTarget is a store DedupStore can sit in front of
+type dedupTarget interface {
+	InsertBatch(batch []swimModels.CertUpdateInfo) error
+	Pruner
+	Archiver
+	// KnownCertificates returns which of fingerprints are stored
+	KnownCertificates(fingerprints []string) (map[string]bool, error)
+	// TouchNames moves the last_seen time of the given names forward to their time
+	TouchNames(lastSeen map[string]int64) error
+	// recentFingerprints calls f with the fingerprints of the newest limit certificates
+	recentFingerprints(limit int, f func(fingerprint string)) error
+}
+
+// dedupLogInterval is the time between two logs of the dedup counters
+const dedupLogInterval = 10 * time.Minute
+
+// DedupOptions sizes the caches of a DedupStore
+type DedupOptions struct {
+	CacheSize int // fingerprints kept in the LRU cache
+	BloomSize int // certificates the bloom filter is sized for, 0 disables it
+}
+
+// DedupStore filters the batches written to a store. Certificates found in an LRU cache of
+// recently stored fingerprints are known. With a bloom filter of stored fingerprints,
+// which can tell for sure that a certificate is new, the others that might be known are
+// looked up in one query per batch; without it they are written like new ones.
+type DedupStore struct {
+	target dedupTarget
+
+	mu     sync.Mutex
+	recent *lruSet
+	bloom  *bloomFilter
+
+	// counters logged every dedupLogInterval
+	sightings, known, lookups, falsePositives int64
+	lastLog                                   time.Time
+}
+
+// NewDedupStore returns a DedupStore in front of target
+func NewDedupStore(target dedupTarget, opts DedupOptions) (*DedupStore, error) {
+	if opts.CacheSize <= 0 {
+		return nil, fmt.Errorf("invalid dedup cache size %d", opts.CacheSize)
+	}
+	d := &DedupStore{target: target, recent: newLRUSet(opts.CacheSize), lastLog: time.Now()}
+	if opts.BloomSize > 0 {
+		d.bloom = newBloomFilter(opts.BloomSize, 0.01)
+	}
+	return d, nil
+}
+
+// Warm adds the fingerprints of the newest stored certificates to the bloom filter, as
+// many as it is sized for
+func (d *DedupStore) Warm() error {
+	if d.bloom == nil {
+		return nil
+	}
+
+	start := time.Now()
+	var n int
+	err := d.target.recentFingerprints(d.bloom.capacity, func(fingerprint string) {
+		d.bloom.add(fingerprint)
+		n++
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Warmed dedup filter with %d certificates in %s", n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// InsertBatch writes the sightings of new certificates to the store and touches the names
+// of known ones
+func (d *DedupStore) InsertBatch(batch []swimModels.CertUpdateInfo) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// sort the certificates of the batch into known, possibly known and new
+	known := make(map[string]bool)
+	var candidates []string
+	for _, domainInfo := range batch {
+		fingerprint := domainInfo.Fingerprint
+		if _, ok := known[fingerprint]; ok {
+			continue
+		}
+		switch {
+		case d.recent.contains(fingerprint):
+			known[fingerprint] = true
+		case d.bloom != nil && d.bloom.mayContain(fingerprint):
+			known[fingerprint] = false
+			candidates = append(candidates, fingerprint)
+		default:
+			known[fingerprint] = false
+		}
+	}
+	if len(candidates) > 0 {
+		stored, err := d.target.KnownCertificates(candidates)
+		if err != nil {
+			return err
+		}
+		d.lookups += int64(len(candidates))
+		for _, fingerprint := range candidates {
+			if stored[fingerprint] {
+				known[fingerprint] = true
+			} else {
+				d.falsePositives++
+			}
+		}
+	}
+
+	var fresh []swimModels.CertUpdateInfo
+	touched := make(map[string]int64)
+	for _, domainInfo := range batch {
+		if !known[domainInfo.Fingerprint] {
+			fresh = append(fresh, domainInfo)
+			continue
+		}
+		touched[domainInfo.Domain] = max(touched[domainInfo.Domain], domainInfo.Seen)
+	}
+
+	if len(fresh) > 0 {
+		if err := d.target.InsertBatch(fresh); err != nil {
+			return err
+		}
+	}
+	if len(touched) > 0 {
+		if err := d.target.TouchNames(touched); err != nil {
+			return err
+		}
+	}
+
+	// only remember certificates once they are stored
+	for fingerprint := range known {
+		d.recent.add(fingerprint)
+		if d.bloom != nil {
+			d.bloom.add(fingerprint)
+		}
+	}
+	d.sightings += int64(len(batch))
+	d.known += int64(len(batch) - len(fresh))
+	if time.Since(d.lastLog) >= dedupLogInterval {
+		d.logStats()
+	}
+	return nil
+}
+
+// Prune enforces policy on the store. The cache is cleared when certificates were
+// deleted, as they might be in it; the bloom filter can't forget them, but every hit is
+// looked up anyway.
+func (d *DedupStore) Prune(policy RetentionPolicy, stop chan struct{}) (PruneReport, error) {
+	report, err := d.target.Prune(policy, stop)
+	if report.Certificates > 0 {
+		d.mu.Lock()
+		d.recent.clear()
+		d.mu.Unlock()
+	}
+	return report, err
+}
+
+// ArchiveSightings moves old sightings of the store to archive, the cache is cleared like
+// by Prune when certificates were removed from the store
+func (d *DedupStore) ArchiveSightings(archive *Archive, policy ArchivePolicy, stop chan struct{}) (ArchiveReport, error) {
+	report, err := d.target.ArchiveSightings(archive, policy, stop)
+	if report.Pruned.Certificates > 0 {
+		d.mu.Lock()
+		d.recent.clear()
+		d.mu.Unlock()
+	}
+	return report, err
+}
+
+// logStats logs how many sightings were filtered since the last call and resets the counters
+func (d *DedupStore) logStats() {
+	log.Printf("Dedup: %d of %d sightings were known certificates (%.1f%%), %d bloom filter lookups, %d false positives",
+		d.known, d.sightings, float64(d.known)*100/float64(d.sightings), d.lookups, d.falsePositives)
+	d.sightings, d.known, d.lookups, d.falsePositives = 0, 0, 0, 0
+	d.lastLog = time.Now()
+}
+
+// recentFingerprints calls f with the fingerprints of the newest limit certificates
+func (s *SQLStore) recentFingerprints(limit int, f func(fingerprint string)) error {
+	rows, err := s.read.Query(s.dialect.rebind("SELECT fingerprint FROM certificates ORDER BY id DESC LIMIT ?"), limit)
+	if err != nil {
+		return fmt.Errorf("error reading fingerprints: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fingerprint string
+		if err := rows.Scan(&fingerprint); err != nil {
+			return err
+		}
+		f(fingerprint)
+	}
+	return rows.Err()
+}
+
+// KnownCertificates returns which of fingerprints are stored
+func (s *SQLStore) KnownCertificates(fingerprints []string) (map[string]bool, error) {
+	known := make(map[string]bool, len(fingerprints))
+	for start := 0; start < len(fingerprints); start += maxRowsPerStatement {
+		chunk := fingerprints[start:min(start+maxRowsPerStatement, len(fingerprints))]
+		args := make([]interface{}, len(chunk))
+		for i, fingerprint := range chunk {
+			args[i] = fingerprint
+		}
+
+		rows, err := s.read.Query(s.dialect.rebind("SELECT fingerprint FROM certificates WHERE fingerprint IN ("+placeholders(len(chunk))+")"), args...)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up certificates: %w", err)
+		}
+		for rows.Next() {
+			var fingerprint string
+			if err := rows.Scan(&fingerprint); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			known[fingerprint] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return known, nil
+}
+
+// TouchNames moves the last_seen time of the given names forward to their time, in one
+// statement per maxRowsPerStatement names
+func (s *SQLStore) TouchNames(lastSeen map[string]int64) error {
+	names := make([]string, 0, len(lastSeen))
+	for name := range lastSeen {
+		names = append(names, name)
+	}
+
+	tx, err := s.write.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = upsertRows(tx, s.dialect, len(names), 2, func(i int) []interface{} {
+		return []interface{}{names[i], lastSeen[names[i]]}
+	}, `WITH touched (name, seen) AS (VALUES %s)
+        UPDATE names SET last_seen = CAST(touched.seen AS BIGINT)
+        FROM touched WHERE names.name = touched.name AND COALESCE(names.last_seen, 0) < CAST(touched.seen AS BIGINT)`)
+	if err != nil {
+		return fmt.Errorf("error updating names: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// lruSet is a set of strings that holds at most size of them, dropping the least
+// recently used one to make room
+type lruSet struct {
+	size  int
+	order *list.List // front is the most recently used
+	items map[string]*list.Element
+}
+
+func newLRUSet(size int) *lruSet {
+	return &lruSet{size: size, order: list.New(), items: make(map[string]*list.Element, size)}
+}
+
+// contains reports whether key is in the set and marks it as used
+func (l *lruSet) contains(key string) bool {
+	e, ok := l.items[key]
+	if ok {
+		l.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// add puts key into the set
+func (l *lruSet) add(key string) {
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.order.PushFront(key)
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(string))
+	}
+}
+
+// clear empties the set
+func (l *lruSet) clear() {
+	l.order.Init()
+	clear(l.items)
+}
+
+// bloomFilter is a set of strings that can answer "maybe" for strings it doesn't contain
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64 // number of bits
+	k        int    // hashes per string
+	capacity int    // strings it was sized for
+	seeds    [2]maphash.Seed
+}
+
+// newBloomFilter returns a bloom filter with a false positive rate of about p once it
+// holds n strings
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := max(1, int(math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{
+		bits:     make([]uint64, m/64),
+		m:        m,
+		k:        k,
+		capacity: n,
+		seeds:    [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()},
+	}
+}
+
+// positions calls f with the bit positions of s, derived from two hashes
+func (b *bloomFilter) positions(s string, f func(bit uint64) bool) bool {
+	h1 := maphash.String(b.seeds[0], s)
+	h2 := maphash.String(b.seeds[1], s) | 1
+	for i := 0; i < b.k; i++ {
+		if !f((h1 + uint64(i)*h2) % b.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) add(s string) {
+	b.positions(s, func(bit uint64) bool {
+		b.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// mayContain reports false if s was never added
+func (b *bloomFilter) mayContain(s string) bool {
+	return b.positions(s, func(bit uint64) bool {
+		return b.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// dedupStream returns batches of certs new certificates each, every certificate being
+// sent again in the next repeats-1 batches like CertStream sends it once per CT log
+func dedupStream(batches, certs, repeats int) [][]swimModels.CertUpdateInfo {
+	stream := make([][]swimModels.CertUpdateInfo, 0, batches)
+	for k := 0; k < batches; k++ {
+		var batch []swimModels.CertUpdateInfo
+		for r := 0; r < repeats && r <= k; r++ {
+			batch = append(batch, generateCerts((k-r)*certs, certs, 500)...)
+		}
+		stream = append(stream, batch)
+	}
+	return stream
+}
+
+// BenchmarkDedupStore writes the same stream, in which every certificate is sent three
+// times, to a store directly and through a DedupStore, and reports the sightings written
+// per second
+func BenchmarkDedupStore(b *testing.B) {
+	// the migration logs of every store would break up the benchmark output
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	stream := dedupStream(50, 100, 3)
+	var rows int
+	for _, batch := range stream {
+		rows += len(batch)
+	}
+
+	for _, bench := range []struct {
+		name string
+		opts *DedupOptions
+	}{
+		{"direct", nil},
+		{"dedup", &DedupOptions{CacheSize: 100000}},
+		{"dedup-bloom", &DedupOptions{CacheSize: 1000, BloomSize: 100000}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				s := openTestStoreAt(b, filepath.Join(b.TempDir(), "swim-"+strconv.Itoa(i)+".db"))
+				var target BatchInserter = s
+				if bench.opts != nil {
+					dedup, err := NewDedupStore(s, *bench.opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+					target = dedup
+				}
+				b.StartTimer()
+
+				for _, batch := range stream {
+					if err := target.InsertBatch(batch); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(rows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+)
+
+// dialect is the SQL flavour spoken by a storage backend. Queries are written with ?
+// placeholders and in the subset of SQL both SQLite and PostgreSQL understand, rebind
+// adapts them where the syntax differs.
+type dialect int
+
+const (
+	sqliteDialect dialect = iota
+	postgresDialect
+)
+
+func (d dialect) String() string {
+	if d == postgresDialect {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// least returns the SQL for the smaller of a and b
+func (d dialect) least(a, b string) string {
+	if d == postgresDialect {
+		return "LEAST(" + a + ", " + b + ")"
+	}
+	return "MIN(" + a + ", " + b + ")"
+}
+
+// greatest returns the SQL for the larger of a and b
+func (d dialect) greatest(a, b string) string {
+	if d == postgresDialect {
+		return "GREATEST(" + a + ", " + b + ")"
+	}
+	return "MAX(" + a + ", " + b + ")"
+}
+
+// inserted returns the SQL telling, in the RETURNING clause of an upsert into a table
+// with an id key, whether the row was inserted rather than updated. PostgreSQL leaves the
+// xmax of inserted rows at 0. SQLite gives new rows an id above the largest one, lastID
+// read in the same transaction before the upsert.
+func (d dialect) inserted(lastID int64) string {
+	if d == postgresDialect {
+		return "(xmax = 0)"
+	}
+	return "(id > " + strconv.FormatInt(lastID, 10) + ")"
+}
+
+// rebind rewrites the ? placeholders of query into the form the dialect expects
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String()
+}
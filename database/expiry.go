@@ -0,0 +1,98 @@
+package database
+
+import (
+	"fmt"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// renewedCond matches the names n that have a certificate expiring after the certificate
+// c. Of certificates expiring at the same time, like a certificate and its precertificate,
+// the one with the highest fingerprint counts as the last.
+const renewedCond = `EXISTS (SELECT 1 FROM certificate_names rn
+            JOIN certificates r ON r.id = rn.certificate_id
+            WHERE rn.name_id = n.id AND (r.not_after > c.not_after OR (r.not_after = c.not_after AND r.fingerprint > c.fingerprint)))`
+
+// ListExpiring returns the names whose last certificate expires in the range expiry, a
+// name with a certificate expiring later has been renewed
+func (s *SQLStore) ListExpiring(suffix string, expiry swimModels.TimeRange, opts swimModels.ListOptions) ([]swimModels.CertUpdateInfo, error) {
+	conds, args := timeRange(expiry, "c.not_after")
+	if suffix != "" {
+		cond, condArgs := suffixRange(suffix)
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+	conds = append(conds, "NOT "+renewedCond)
+
+	query := `SELECT ` + certUpdateColumns + `
+    FROM names n
+    JOIN certificate_names cn ON cn.name_id = n.id
+    JOIN certificates c ON c.id = cn.certificate_id
+    ` + where(conds) + "ORDER BY c.not_after, n.name, c.fingerprint " + limit(opts)
+
+	rows, err := s.read.Query(s.dialect.rebind(query), append(args, limitArgs(opts)...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading expiring certificates: %w", err)
+	}
+	defer rows.Close()
+
+	updates := []swimModels.CertUpdateInfo{}
+	for rows.Next() {
+		update, err := scanCertUpdate(rows)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+	}
+	return updates, rows.Err()
+}
+
+// nameExpiry is the certificate of a name expiring last and the history of the name
+type nameExpiry struct {
+	notAfter    int64
+	fingerprint string
+	firstSeen   int64
+	lastSeen    int64
+	certCount   int64
+}
+
+// before reports whether e expires before the certificate expiring at notAfter with
+// fingerprint, in the order of renewedCond
+func (e nameExpiry) before(notAfter int64, fingerprint string) bool {
+	return notAfter > e.notAfter || (notAfter == e.notAfter && fingerprint > e.fingerprint)
+}
+
+// latestExpiry returns the certificate expiring last of each of the stored names
+func (s *SQLStore) latestExpiry(names []string) (map[string]nameExpiry, error) {
+	latest := make(map[string]nameExpiry, len(names))
+	err := chunks(len(names), func(start, end int) error {
+		args := make([]interface{}, end-start)
+		for i, name := range names[start:end] {
+			args[i] = name
+		}
+
+		rows, err := s.read.Query(s.dialect.rebind(`SELECT n.name, COALESCE(n.first_seen, 0), COALESCE(n.last_seen, 0), n.cert_count, COALESCE(c.not_after, 0), c.fingerprint
+            FROM names n
+            JOIN certificate_names cn ON cn.name_id = n.id
+            JOIN certificates c ON c.id = cn.certificate_id
+            WHERE n.name IN (`+placeholders(len(args))+`)`), args...)
+		if err != nil {
+			return fmt.Errorf("error reading certificate expiry: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name, fingerprint string
+			var e nameExpiry
+			if err := rows.Scan(&name, &e.firstSeen, &e.lastSeen, &e.certCount, &e.notAfter, &fingerprint); err != nil {
+				return err
+			}
+			if l, ok := latest[name]; !ok || l.before(e.notAfter, fingerprint) {
+				e.fingerprint = fingerprint
+				latest[name] = e
+			}
+		}
+		return rows.Err()
+	})
+	return latest, err
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"slices"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// expiringCert is a certificate of name expiring days after testStart
+func expiringCert(name, fingerprint, entryType string, days int64) swimModels.CertUpdateInfo {
+	return swimModels.CertUpdateInfo{
+		Domain:      name,
+		Issuer:      "Test CA",
+		Fingerprint: fingerprint,
+		EntryType:   entryType,
+		NotBefore:   testStart,
+		NotAfter:    testStart + days*86400,
+		Seen:        testStart,
+	}
+}
+
+// expiringNames returns the names and fingerprints of the listed updates
+func expiringNames(updates []swimModels.CertUpdateInfo) []string {
+	var got []string
+	for _, u := range updates {
+		got = append(got, u.Domain+" "+u.Fingerprint)
+	}
+	return got
+}
+
+func TestListExpiring(t *testing.T) {
+	s := openTestStore(t)
+	err := s.InsertBatch([]swimModels.CertUpdateInfo{
+		// renewed by a certificate expiring after the range
+		expiringCert("renewed.example.com", "A1", "x509", 10),
+		expiringCert("renewed.example.com", "A2", "x509", 90),
+		// not renewed, the later certificate is of another name
+		expiringCert("lapsed.example.com", "B1", "x509", 20),
+		expiringCert("other.example.com", "B2", "x509", 90),
+		// a certificate and its precertificate expire at the same time
+		expiringCert("tie.example.com", "CC", "precert", 15),
+		expiringCert("tie.example.com", "C1", "x509", 15),
+		expiringCert("lapsed.example.org", "D1", "x509", 12),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := swimModels.TimeRange{Since: testStart, Until: testStart + 30*86400}
+	for _, test := range []struct {
+		suffix string
+		want   []string
+	}{
+		{"", []string{"lapsed.example.org D1", "tie.example.com CC", "lapsed.example.com B1"}},
+		{"example.com", []string{"tie.example.com CC", "lapsed.example.com B1"}},
+		{"tie.example.com", []string{"tie.example.com CC"}},
+		{"example.net", nil},
+	} {
+		updates, err := s.ListExpiring(test.suffix, expiry, swimModels.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expiringNames(updates); !slices.Equal(got, test.want) {
+			t.Errorf("ListExpiring(%q) = %v, want %v", test.suffix, got, test.want)
+		}
+	}
+
+	// the renewal expires in the range too
+	updates, err := s.ListExpiring("renewed.example.com", swimModels.TimeRange{Since: testStart, Until: testStart + 100*86400}, swimModels.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := expiringNames(updates), []string{"renewed.example.com A2"}; !slices.Equal(got, want) {
+		t.Errorf("ListExpiring with the renewal in range = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"strings"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// filterSchema adds the entry type of certificates and the indexes the filters of cert
+// update listings seek with
+var filterSchema = []string{
+	`ALTER TABLE certificates ADD COLUMN entry_type TEXT`,
+	`CREATE INDEX idx_certificates_issuer ON certificates (issuer, not_before)`,
+	`CREATE INDEX idx_certificates_not_before ON certificates (not_before)`,
+	`CREATE INDEX idx_certificates_not_after ON certificates (not_after)`,
+}
+
+// dropFilter reverts filterSchema
+var dropFilter = []string{
+	`DROP INDEX idx_certificates_not_after`,
+	`DROP INDEX idx_certificates_not_before`,
+	`DROP INDEX idx_certificates_issuer`,
+	`ALTER TABLE certificates DROP COLUMN entry_type`,
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, with \ as escape character
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// certFilter returns the conditions selecting the cert updates matched by f, over the
+// names n, certificates c and certificate_names cn
+func certFilter(f swimModels.CertFilter) ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, condArgs []interface{}) {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	if f.Name != "" {
+		add(nameGlob(f.Name))
+	}
+	if f.Suffix != "" {
+		add(suffixRange(f.Suffix))
+	}
+	if f.Issuer != "" {
+		add("c.issuer = ?", []interface{}{f.Issuer})
+	}
+	if f.Wildcard != nil {
+		add("cn.wildcard = ?", []interface{}{*f.Wildcard})
+	}
+	if f.Apex != nil {
+		add("n.is_apex = ?", []interface{}{*f.Apex})
+	}
+	if f.EntryType != "" {
+		add("c.entry_type = ?", []interface{}{f.EntryType})
+	}
+	if f.KeyUsage != "" {
+		add(keyUsage(f.KeyUsage))
+	}
+	rangeConds, rangeArgs := timeRange(f.NotBefore, "c.not_before")
+	conds, args = append(conds, rangeConds...), append(args, rangeArgs...)
+	rangeConds, rangeArgs = timeRange(f.NotAfter, "c.not_after")
+	return append(conds, rangeConds...), append(args, rangeArgs...)
+}
+
+// byName reports whether f selects names by an index, so a listing is best driven from
+// the names it matches
+func byName(f swimModels.CertFilter) bool {
+	return f.Suffix != "" || (f.Name != "" && (!strings.ContainsAny(f.Name, "*?") || globParent(f.Name) != ""))
+}
+
+// byCertificate reports whether f selects certificates by an index
+func byCertificate(f swimModels.CertFilter) bool {
+	return f.Issuer != "" || f.NotBefore != (swimModels.TimeRange{}) || f.NotAfter != (swimModels.TimeRange{})
+}
+
+// nameGlob returns the condition matching names against a glob, * matches any characters
+// and ? a single one. The labels after the last wildcard bound a range scan over the
+// reversed label key, "*.bank.example.com" only reads the names below "bank.example.com".
+func nameGlob(glob string) (string, []interface{}) {
+	glob = strings.ToLower(glob)
+	if !strings.ContainsAny(glob, "*?") {
+		return "n.name = ?", []interface{}{glob}
+	}
+
+	cond, args := `n.name LIKE ? ESCAPE '\'`, []interface{}{likeGlob(glob)}
+	if parent := globParent(glob); parent != "" {
+		key := reverseLabels(parent)
+		cond = "n.reversed >= ? AND n.reversed < ? AND " + cond
+		args = append([]interface{}{key + ".", key + "/"}, args...)
+	}
+	return cond, args
+}
+
+// likeGlob translates a glob into a LIKE pattern
+func likeGlob(glob string) string {
+	return strings.NewReplacer("*", "%", "?", "_").Replace(likeEscaper.Replace(glob))
+}
+
+// globParent returns the domain every name matched by glob is below, the labels after the
+// last wildcard: a name ending in "x.example.com" is below "example.com". It is empty if
+// the wildcard is in the last label.
+func globParent(glob string) string {
+	i := strings.LastIndexAny(glob, "*?")
+	_, labels, _ := strings.Cut(glob[i+1:], ".")
+	return strings.ToLower(labels)
+}
+
+// suffixRange returns the condition matching domain and the names below it, found with a
+// range scan over the reversed label key
+func suffixRange(domain string) (string, []interface{}) {
+	key := reverseLabels(strings.ToLower(domain))
+	cond, args := belowRange(domain)
+	return "(n.reversed = ? OR " + cond + ")", append([]interface{}{key}, args...)
+}
+
+// belowRange returns the condition matching the names below domain, but not domain itself.
+// "com.example" is followed by "com.example.*" up to "com.example/", '/' comes after '.'.
+func belowRange(domain string) (string, []interface{}) {
+	key := reverseLabels(strings.ToLower(domain))
+	return "(n.reversed >= ? AND n.reversed < ?)", []interface{}{key + ".", key + "/"}
+}
+
+// keyUsage returns the condition matching certificates with usage among their key usages
+// or extended key usages, which are stored as comma separated lists
+func keyUsage(usage string) (string, []interface{}) {
+	pattern := "%, " + likeEscaper.Replace(strings.ToLower(strings.TrimSpace(usage))) + ",%"
+	return `(LOWER(', ' || c.key_usage || ',') LIKE ? ESCAPE '\' OR LOWER(', ' || c.extended_key_usage || ',') LIKE ? ESCAPE '\')`, []interface{}{pattern, pattern}
+}
+
+// timeRange returns the conditions restricting column to r
+func timeRange(r swimModels.TimeRange, column string) ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if r.Since > 0 {
+		conds = append(conds, column+" >= ?")
+		args = append(args, r.Since)
+	}
+	if r.Until > 0 {
+		conds = append(conds, column+" < ?")
+		args = append(args, r.Until)
+	}
+	return conds, args
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// testTLDs are the top level domains of generated names
+var testTLDs = []string{"com", "org", "net", "co.uk", "de"}
+
+// testStart is the seen time of the first generated certificate
+const testStart int64 = 1704067200 // 2024-01-01
+
+// openTestStore opens a migrated SQLite store in a temporary directory, it is closed when
+// the test ends
+func openTestStore(tb testing.TB) *SQLStore {
+	tb.Helper()
+	return openTestStoreAt(tb, filepath.Join(tb.TempDir(), "swim.db"))
+}
+
+// openTestStoreAt opens and migrates the SQLite store at path
+func openTestStoreAt(tb testing.TB, path string) *SQLStore {
+	tb.Helper()
+	db, err := Open(path, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := NewSQLiteStore(db)
+	tb.Cleanup(func() { s.Close() })
+	if err := s.SetupDatabase(); err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+// testApex returns the apex domain of the i-th of apexes generated apex domains
+func testApex(i, apexes int) string {
+	i %= apexes
+	return fmt.Sprintf("site%d.%s", i, testTLDs[i%len(testTLDs)])
+}
+
+// generateCerts returns the cert updates of the certificates [start, start+n). Certificate
+// i covers four names of apex domain i modulo apexes and is seen a minute after
+// certificate i-1, so the dataset grows with the number of certificates while the names
+// of an apex domain keep getting renewed.
+func generateCerts(start, n, apexes int) []swimModels.CertUpdateInfo {
+	batch := make([]swimModels.CertUpdateInfo, 0, 4*n)
+	for i := start; i < start+n; i++ {
+		apex := testApex(i, apexes)
+		seen := testStart + int64(i)*60
+		names := []string{
+			apex,
+			"www." + apex,
+			fmt.Sprintf("h%d.%s", (i/apexes)%50, apex),
+			fmt.Sprintf("a%d.b.%s", i%7, apex),
+		}
+		for j, name := range names {
+			batch = append(batch, swimModels.CertUpdateInfo{
+				Domain:           name,
+				IsApex:           j == 0,
+				ParentDomain:     apex,
+				NotBefore:        seen - 3600,
+				NotAfter:         seen + 90*86400,
+				SerialNumber:     fmt.Sprintf("%X", i),
+				Issuer:           []string{"Let's Encrypt", "DigiCert Inc", "Sectigo Limited"}[i%3],
+				Fingerprint:      testFingerprint(i),
+				EntryType:        swimModels.EntryTypes[i%2],
+				KeyUsage:         "Digital Signature, Key Encipherment",
+				ExtendedKeyUsage: "TLS Web Server Authentication",
+				SubjectAltName:   "DNS:" + name,
+				Wildcard:         j == 0 && i%5 == 0,
+				Seen:             seen,
+			})
+		}
+	}
+	return batch
+}
+
+// testFingerprint returns the fingerprint of generated certificate i
+func testFingerprint(i int) string {
+	hex := fmt.Sprintf("%040X", i)
+	fingerprint := hex[:2]
+	for j := 2; j < len(hex); j += 2 {
+		fingerprint += ":" + hex[j:j+2]
+	}
+	return fingerprint
+}
+
+// insertCerts stores the certificates [0, n) in batches of batchSize certificates
+func insertCerts(tb testing.TB, store swimModels.Store, n, apexes, batchSize int) {
+	tb.Helper()
+	for start := 0; start < n; start += batchSize {
+		if err := store.InsertBatch(generateCerts(start, min(batchSize, n-start), apexes)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
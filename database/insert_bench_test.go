@@ -0,0 +1,52 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// BenchmarkInsertBatch writes batches of new certificates, each larger than a multi-row
+// statement takes, with one writer and with sharded writers, and reports the sightings
+// written per second. The sharded writers need PostgreSQL and run against the database
+// SWIM_TEST_POSTGRES_DSN points to, like the postgres tests.
+func BenchmarkInsertBatch(b *testing.B) {
+	// the migration logs would break up the benchmark output
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	const certs = 1000 // 4000 sightings per batch
+	for _, bench := range []struct {
+		dialect dialect
+		writers int
+	}{
+		{sqliteDialect, 1},
+		{postgresDialect, 1},
+		{postgresDialect, 4},
+		{postgresDialect, 8},
+	} {
+		b.Run(fmt.Sprintf("%s/writers=%d", bench.dialect, bench.writers), func(b *testing.B) {
+			var s *SQLStore
+			if bench.dialect == postgresDialect {
+				s = openPostgresTest(b, bench.writers)
+			} else {
+				s = openTestStore(b)
+			}
+
+			var rows int
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				batch := generateCerts(i*certs, certs, 5000)
+				rows += len(batch)
+				b.StartTimer()
+
+				if err := s.InsertBatch(batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(rows)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy says how much data the janitor keeps. Sightings (the links between a
+// certificate and a name) are pruned oldest first, certificates and names are removed
+// once no sighting refers to them anymore.
+type RetentionPolicy struct {
+	MaxSize   string        // size limit such as "20G", empty for no limit
+	MaxAge    time.Duration // sightings older than this are pruned, 0 keeps them forever
+	Interval  time.Duration // time between janitor runs
+	ChunkSize int           // sightings deleted per transaction
+}
+
+// Validate checks the policy and fills in defaults
+func (p *RetentionPolicy) Validate() error {
+	if p.MaxSize != "" {
+		if _, err := parseSize(p.MaxSize); err != nil {
+			return fmt.Errorf("invalid max size: %w", err)
+		}
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("invalid max age %s", p.MaxAge)
+	}
+	if p.Interval <= 0 {
+		p.Interval = 10 * time.Minute
+	}
+	if p.ChunkSize <= 0 {
+		p.ChunkSize = 5000
+	}
+	// the ids of a chunk are bound as parameters, SQLite accepts at most 32766
+	if p.ChunkSize > 30000 {
+		return fmt.Errorf("chunk size %d is larger than 30000", p.ChunkSize)
+	}
+	return nil
+}
+
+// Enabled reports whether the policy limits anything
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxSize != "" || p.MaxAge > 0
+}
+
+// Pruner is a store the retention janitor can enforce a policy on
+type Pruner interface {
+	Prune(policy RetentionPolicy, stop chan struct{}) (PruneReport, error)
+}
+
+// PruneReport summarizes what a janitor run removed
+type PruneReport struct {
+	Sightings    int64
+	Certificates int64
+	Names        int64
+	Partitions   int64 // partition files deleted by a PartitionedStore
+	FreedBytes   int64
+}
+
+func (r PruneReport) String() string {
+	if r.Partitions > 0 {
+		return fmt.Sprintf("%d partitions, %d bytes freed", r.Partitions, r.FreedBytes)
+	}
+	return fmt.Sprintf("%d sightings, %d certificates, %d names, %d bytes freed", r.Sightings, r.Certificates, r.Names, r.FreedBytes)
+}
+
+// RetentionWorker enforces policy every policy.Interval until stop is closed
+func RetentionWorker(store Pruner, policy RetentionPolicy, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := store.Prune(policy, stop)
+		if err != nil {
+			log.Printf("Error enforcing retention: %v", err)
+		}
+		if report.Sightings > 0 || report.Partitions > 0 || report.FreedBytes > 0 {
+			log.Printf("Retention: pruned %s", report)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune runs the janitor once: it removes sightings older than the max age, then the
+// oldest sightings until the data fits in the max size, and finally hands freed pages
+// back to the file system. It returns early, without error, once stop is closed.
+func (s *SQLStore) Prune(policy RetentionPolicy, stop chan struct{}) (PruneReport, error) {
+	var report PruneReport
+	if err := policy.Validate(); err != nil {
+		return report, err
+	}
+
+	sizeBefore, err := s.usedBytes()
+	if err != nil {
+		return report, err
+	}
+
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().Add(-policy.MaxAge).Unix()
+		for !stopped(stop) {
+			n, err := s.pruneChunk(&report, cutoff, policy.ChunkSize)
+			if err != nil {
+				return report, err
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+
+	if policy.MaxSize != "" && s.overSize(policy.MaxSize) {
+		maxSize, _ := parseSize(policy.MaxSize)
+		for !stopped(stop) {
+			used, err := s.usedBytes()
+			if err != nil {
+				return report, err
+			}
+			if used <= maxSize {
+				break
+			}
+			n, err := s.pruneChunk(&report, 0, policy.ChunkSize)
+			if err != nil {
+				return report, err
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+
+	if report.Sightings > 0 {
+		if err := s.vacuumFreed(); err != nil {
+			return report, err
+		}
+	}
+
+	sizeAfter, err := s.usedBytes()
+	if err != nil {
+		return report, err
+	}
+	report.FreedBytes = max(sizeBefore-sizeAfter, 0)
+
+	return report, nil
+}
+
+// stopped reports whether stop has been closed
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// overSize is the cheap first check of the size limit. The file of a SQLite database only
+// shrinks when freed pages are vacuumed, so usedBytes decides how much is pruned.
+func (s *SQLStore) overSize(maxSize string) bool {
+	if s.dialect == sqliteDialect {
+		return !CheckDatabaseSize(s.path, maxSize)
+	}
+
+	used, err := s.usedBytes()
+	if err != nil {
+		log.Printf("Error reading database size: %v", err)
+		return false
+	}
+	limit, _ := parseSize(maxSize)
+	return used > limit
+}
+
+// usedBytes returns the space taken by data, not counting free pages
+func (s *SQLStore) usedBytes() (int64, error) {
+	var used int64
+	var err error
+	if s.dialect == postgresDialect {
+		err = s.write.QueryRow("SELECT pg_database_size(current_database())").Scan(&used)
+	} else {
+		err = s.write.QueryRow("SELECT (page_count - freelist_count) * page_size FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()").Scan(&used)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading database size: %w", err)
+	}
+	return used, nil
+}
+
+// pruneChunk deletes up to chunkSize of the oldest sightings, only those seen before
+// cutoff if it is not 0, along with the certificates and names left without sightings.
+// It returns the number of sightings deleted.
+func (s *SQLStore) pruneChunk(report *PruneReport, cutoff int64, chunkSize int) (int64, error) {
+	tx, err := s.write.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cond := ""
+	args := []interface{}{}
+	if cutoff > 0 {
+		cond = "WHERE seen < ?"
+		args = append(args, cutoff)
+	}
+	args = append(args, chunkSize)
+
+	rows, err := tx.Query(s.dialect.rebind(`DELETE FROM certificate_names WHERE (certificate_id, name_id, seen) IN (
+            SELECT certificate_id, name_id, seen FROM certificate_names `+cond+` ORDER BY seen LIMIT ?
+        ) RETURNING certificate_id, name_id`), args...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting sightings: %w", err)
+	}
+
+	certIDs := make(map[int64]bool)
+	nameIDs := make(map[int64]bool)
+	var deleted int64
+	for rows.Next() {
+		var certID, nameID int64
+		if err := rows.Scan(&certID, &nameID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		certIDs[certID] = true
+		nameIDs[nameID] = true
+		deleted++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	var orphans PruneReport
+	if err := s.pruneOrphans(tx, &orphans, certIDs, nameIDs); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	report.Sightings += deleted
+	report.Names += orphans.Names
+	report.Certificates += orphans.Certificates
+	return deleted, nil
+}
+
+// pruneOrphans updates the certificate counts of the names whose sightings were deleted
+// and removes the names and certificates left without sightings, taking them off the totals
+func (s *SQLStore) pruneOrphans(tx *sql.Tx, report *PruneReport, certIDs, nameIDs map[int64]bool) error {
+	names := idList(nameIDs)
+	if _, err := tx.Exec(s.dialect.rebind(`UPDATE names SET cert_count = (SELECT COUNT(*) FROM certificate_names cn WHERE cn.name_id = names.id)
+        WHERE id IN (`+placeholders(len(names))+`)`), names...); err != nil {
+		return fmt.Errorf("error updating certificate counts: %w", err)
+	}
+
+	rows, err := tx.Query(s.dialect.rebind(`DELETE FROM names WHERE id IN (`+placeholders(len(names))+`) AND cert_count = 0
+        RETURNING is_apex`), names...)
+	if err != nil {
+		return fmt.Errorf("error deleting names: %w", err)
+	}
+	var prunedNames, prunedApexes int64
+	for rows.Next() {
+		var isApex bool
+		if err := rows.Scan(&isApex); err != nil {
+			rows.Close()
+			return err
+		}
+		prunedNames++
+		if isApex {
+			prunedApexes++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error deleting names: %w", err)
+	}
+	if s.nameSearch && prunedNames > 0 {
+		if _, err := tx.Exec(`DELETE FROM names_fts WHERE rowid IN (`+placeholders(len(names))+`)
+            AND rowid NOT IN (SELECT id FROM names)`, names...); err != nil {
+			return fmt.Errorf("error removing names from the search index: %w", err)
+		}
+	}
+
+	// the DER of the certificates about to be deleted goes with them, chain certificates
+	// are shared and kept
+	certs := idList(certIDs)
+	if _, err := tx.Exec(s.dialect.rebind(`DELETE FROM raw_certificates WHERE fingerprint IN (
+            SELECT fingerprint FROM certificates WHERE id IN (`+placeholders(len(certs))+`)
+            AND NOT EXISTS (SELECT 1 FROM certificate_names cn WHERE cn.certificate_id = certificates.id)
+        )`), certs...); err != nil {
+		return fmt.Errorf("error deleting raw certificates: %w", err)
+	}
+
+	res, err := tx.Exec(s.dialect.rebind(`DELETE FROM certificates WHERE id IN (`+placeholders(len(certs))+`)
+        AND NOT EXISTS (SELECT 1 FROM certificate_names cn WHERE cn.certificate_id = certificates.id)`), certs...)
+	if err != nil {
+		return fmt.Errorf("error deleting certificates: %w", err)
+	}
+	prunedCerts, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if err := addTotals(tx, s.dialect, -prunedNames, -prunedApexes, -prunedCerts); err != nil {
+		return err
+	}
+
+	report.Names += prunedNames
+	report.Certificates += prunedCerts
+	return nil
+}
+
+// vacuumFreed returns the pages freed by pruning to the file system. SQLite databases
+// created without incremental auto vacuum keep them and reuse them for new data.
+func (s *SQLStore) vacuumFreed() error {
+	if s.dialect == postgresDialect {
+		// autovacuum makes the space reusable, VACUUM FULL would lock the tables
+		return nil
+	}
+
+	var mode int
+	if err := s.write.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	if mode != 2 { // incremental
+		return nil
+	}
+
+	// the pragma frees a page per step, so its rows have to be read to the end
+	rows, err := s.write.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return fmt.Errorf("error vacuuming: %w", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error vacuuming: %w", err)
+	}
+	if _, err := s.write.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("error checkpointing: %w", err)
+	}
+	return nil
+}
+
+// placeholders returns n comma separated ? placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// idList turns a set of ids into query arguments
+func idList(ids map[int64]bool) []interface{} {
+	list := make([]interface{}, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+	return list
+}
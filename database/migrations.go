@@ -0,0 +1,550 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one numbered step of the database schema. up moves the schema from
+// version-1 to version, down reverts it. Both run inside the transaction that also
+// records the change in the schema_version table.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+	down    func(tx *sql.Tx) error
+}
+
+// MigrationState describes a migration and whether it has been applied
+type MigrationState struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// sqliteMigrations lists every schema change of SQLite databases in order. Versions must be
+// consecutive and a migration must never be changed once released, add a new one instead.
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "create domains table",
+		up: execAll(`
+        CREATE TABLE domains (
+            id INTEGER PRIMARY KEY,
+            domain TEXT NOT NULL UNIQUE,
+            is_apex BOOLEAN NOT NULL,
+            parent_domain TEXT,
+            not_before INTEGER,
+            not_after INTEGER,
+            serial_number TEXT,
+            fingerprint TEXT,
+            key_usage TEXT,
+            extended_key_usage TEXT,
+            subject_key_id TEXT,
+            authority_key_id TEXT,
+            authority_info TEXT,
+            subject_alt_name TEXT,
+            certificate_policies TEXT,
+            wildcard BOOLEAN
+        )`),
+		down: execAll(`DROP TABLE domains`),
+	},
+	{
+		version: 2,
+		name:    "split domains into certificates and names",
+		up:      splitDomainsTable,
+		down: execAll(
+			`CREATE TABLE domains (
+                id INTEGER PRIMARY KEY,
+                domain TEXT NOT NULL UNIQUE,
+                is_apex BOOLEAN NOT NULL,
+                parent_domain TEXT,
+                not_before INTEGER,
+                not_after INTEGER,
+                serial_number TEXT,
+                fingerprint TEXT,
+                key_usage TEXT,
+                extended_key_usage TEXT,
+                subject_key_id TEXT,
+                authority_key_id TEXT,
+                authority_info TEXT,
+                subject_alt_name TEXT,
+                certificate_policies TEXT,
+                wildcard BOOLEAN
+            )`,
+			// the old table kept only the first certificate seen for a name
+			`INSERT INTO domains (domain, is_apex, parent_domain, not_before, not_after, serial_number, fingerprint, key_usage, extended_key_usage, subject_key_id, authority_key_id, authority_info, subject_alt_name, certificate_policies, wildcard)
+             SELECT n.name, n.is_apex, n.parent_domain, c.not_before, c.not_after, c.serial_number, c.fingerprint, c.key_usage, c.extended_key_usage, c.subject_key_id, c.authority_key_id, c.authority_info, c.subject_alt_name, c.certificate_policies, cn.wildcard
+             FROM names n
+             LEFT JOIN certificate_names cn ON cn.name_id = n.id AND cn.certificate_id = (SELECT MIN(certificate_id) FROM certificate_names WHERE name_id = n.id)
+             LEFT JOIN certificates c ON c.id = cn.certificate_id`,
+			`DROP TABLE certificate_names`,
+			`DROP TABLE names`,
+			`DROP TABLE certificates`,
+		),
+	},
+	{
+		version: 3,
+		name:    "track name sightings",
+		// the stream time of old sightings is unknown, so the not_before of the certificates stands in for it
+		up: execAll(
+			`ALTER TABLE names ADD COLUMN first_seen INTEGER`,
+			`ALTER TABLE names ADD COLUMN last_seen INTEGER`,
+			`ALTER TABLE names ADD COLUMN cert_count INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE names SET
+                first_seen = (SELECT MIN(c.not_before) FROM certificate_names cn JOIN certificates c ON c.id = cn.certificate_id WHERE cn.name_id = names.id),
+                last_seen = (SELECT MAX(c.not_before) FROM certificate_names cn JOIN certificates c ON c.id = cn.certificate_id WHERE cn.name_id = names.id),
+                cert_count = (SELECT COUNT(*) FROM certificate_names cn WHERE cn.name_id = names.id)`,
+		),
+		down: execAll(
+			`ALTER TABLE names DROP COLUMN cert_count`,
+			`ALTER TABLE names DROP COLUMN last_seen`,
+			`ALTER TABLE names DROP COLUMN first_seen`,
+		),
+	},
+	{
+		version: 4,
+		name:    "index names for subdomain, apex and sighting queries",
+		up: execAll(
+			`CREATE INDEX idx_names_parent_domain ON names (parent_domain)`,
+			`CREATE INDEX idx_names_is_apex ON names (is_apex, name)`,
+			`CREATE INDEX idx_names_first_seen ON names (first_seen)`,
+			`CREATE INDEX idx_names_last_seen ON names (last_seen)`,
+		),
+		down: execAll(
+			`DROP INDEX idx_names_last_seen`,
+			`DROP INDEX idx_names_first_seen`,
+			`DROP INDEX idx_names_is_apex`,
+			`DROP INDEX idx_names_parent_domain`,
+		),
+	},
+	{
+		version: 5,
+		name:    "record when certificates were seen",
+		// certificate_names carries the first sighting of its certificate so that sightings can be
+		// pruned or partitioned by time without a join; not_before stands in for old rows
+		up: execAll(
+			`ALTER TABLE certificates ADD COLUMN seen INTEGER`,
+			`ALTER TABLE certificate_names ADD COLUMN seen INTEGER`,
+			`UPDATE certificates SET seen = not_before`,
+			`UPDATE certificate_names SET seen = (SELECT c.seen FROM certificates c WHERE c.id = certificate_names.certificate_id)`,
+			`CREATE INDEX idx_certificate_names_seen ON certificate_names (seen)`,
+		),
+		down: execAll(
+			`DROP INDEX idx_certificate_names_seen`,
+			`ALTER TABLE certificate_names DROP COLUMN seen`,
+			`ALTER TABLE certificates DROP COLUMN seen`,
+		),
+	},
+	{
+		version: 6,
+		name:    "add reversed label key to names",
+		up:      addReversedNames,
+		down: execAll(
+			`DROP INDEX idx_names_reversed`,
+			`ALTER TABLE names DROP COLUMN reversed`,
+		),
+	},
+	{
+		version: 7,
+		name:    "add issuer and rollup tables",
+		up:      execAll(rollupSchema(`substr(n.reversed, 1, instr(n.reversed || '.', '.') - 1)`)...),
+		down:    execAll(dropRollups...),
+	},
+	{
+		version: 8,
+		name:    "add raw certificate tables",
+		up:      execAll(rawSchema("BLOB")...),
+		down:    execAll(dropRaw...),
+	},
+	{
+		version: 9,
+		name:    "add entry type and certificate filter indexes",
+		up:      execAll(filterSchema...),
+		down:    execAll(dropFilter...),
+	},
+	{
+		version: 10,
+		name:    "index certificate serial numbers and key identifiers",
+		up:      execAll(lookupSchema...),
+		down:    execAll(dropLookup...),
+	},
+	{
+		version: 11,
+		name:    "add totals rollup",
+		up:      execAll(totalsSchema...),
+		down:    execAll(dropTotals...),
+	},
+}
+
+// execAll returns a migration step running the given statements in order
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// splitDomainsTable moves the rows of the one-row-per-domain table into the
+// certificates, names and certificate_names tables and drops it
+func splitDomainsTable(tx *sql.Tx) error {
+	// very old databases predate the parent_domain column
+	hasParentDomain, err := columnExists(tx, "domains", "parent_domain")
+	if err != nil {
+		return err
+	}
+	if !hasParentDomain {
+		if _, err := tx.Exec("ALTER TABLE domains ADD COLUMN parent_domain TEXT;"); err != nil {
+			return fmt.Errorf("error adding parent_domain column: %w", err)
+		}
+	}
+
+	return execAll(
+		`CREATE TABLE certificates (
+            id INTEGER PRIMARY KEY,
+            fingerprint TEXT NOT NULL UNIQUE,
+            not_before INTEGER,
+            not_after INTEGER,
+            serial_number TEXT,
+            key_usage TEXT,
+            extended_key_usage TEXT,
+            subject_key_id TEXT,
+            authority_key_id TEXT,
+            authority_info TEXT,
+            subject_alt_name TEXT,
+            certificate_policies TEXT
+        )`,
+		`CREATE TABLE names (
+            id INTEGER PRIMARY KEY,
+            name TEXT NOT NULL UNIQUE,
+            is_apex BOOLEAN NOT NULL,
+            parent_domain TEXT
+        )`,
+		`CREATE TABLE certificate_names (
+            certificate_id INTEGER NOT NULL REFERENCES certificates(id),
+            name_id INTEGER NOT NULL REFERENCES names(id),
+            wildcard BOOLEAN NOT NULL DEFAULT FALSE,
+            PRIMARY KEY (certificate_id, name_id)
+        )`,
+		`CREATE INDEX idx_certificate_names_name_id ON certificate_names (name_id)`,
+		`INSERT OR IGNORE INTO certificates (fingerprint, not_before, not_after, serial_number, key_usage, extended_key_usage, subject_key_id, authority_key_id, authority_info, subject_alt_name, certificate_policies)
+         SELECT fingerprint, not_before, not_after, serial_number, key_usage, extended_key_usage, subject_key_id, authority_key_id, authority_info, subject_alt_name, certificate_policies
+         FROM domains WHERE fingerprint IS NOT NULL AND fingerprint != ''`,
+		`INSERT OR IGNORE INTO names (name, is_apex, parent_domain)
+         SELECT domain, is_apex, parent_domain FROM domains`,
+		`INSERT OR IGNORE INTO certificate_names (certificate_id, name_id, wildcard)
+         SELECT c.id, n.id, COALESCE(d.wildcard, FALSE) FROM domains d
+         JOIN certificates c ON c.fingerprint = d.fingerprint
+         JOIN names n ON n.name = d.domain`,
+		`DROP TABLE domains`,
+	)(tx)
+}
+
+// backfillChunkSize is the number of names a migration computes a column of at a time
+const backfillChunkSize = 10000
+
+// addReversedNames adds the reversed label key of every name, SQLite has no function to
+// compute it so it is filled in here. The names are walked in id order a chunk at a time,
+// like Reindex does, so large databases are not read into memory at once.
+func addReversedNames(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE names ADD COLUMN reversed TEXT`); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`UPDATE names SET reversed = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var lastID int64
+	for {
+		chunk, err := fetchReindexChunk(tx, sqliteDialect, lastID, backfillChunkSize)
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		for _, r := range chunk {
+			if _, err := stmt.Exec(reverseLabels(r.domain), r.id); err != nil {
+				return err
+			}
+		}
+		lastID = chunk[len(chunk)-1].id
+	}
+
+	_, err = tx.Exec(`CREATE INDEX idx_names_reversed ON names (reversed)`)
+	return err
+}
+
+// queryer is the part of *sql.DB and *sql.Tx needed to inspect the schema
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// tableExists reports whether the database has a table with the given name
+func tableExists(q queryer, table string) (bool, error) {
+	var n int
+	if err := q.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n); err != nil {
+		return false, fmt.Errorf("error looking for %s table: %w", table, err)
+	}
+	return n > 0, nil
+}
+
+// columnExists reports whether table has a column with the given name
+func columnExists(q queryer, table, column string) (bool, error) {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return false, fmt.Errorf("error getting %s table info: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name string
+		var dataType string
+		var notnull bool
+		var dfltValue *string
+		var pk int
+		if err := rows.Scan(&cid, &name, &dataType, &notnull, &dfltValue, &pk); err != nil {
+			return false, fmt.Errorf("error scanning row: %w", err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+// migrations returns the migrations of the store's dialect
+func (s *SQLStore) migrations() []migration {
+	if s.dialect == postgresDialect {
+		return postgresMigrations
+	}
+	return sqliteMigrations
+}
+
+// LatestSchemaVersion is the schema version a database has after all migrations ran
+func (s *SQLStore) LatestSchemaVersion() int {
+	migrations := s.migrations()
+	return migrations[len(migrations)-1].version
+}
+
+// SetupDatabase brings the schema up to date by applying all pending migrations
+func (s *SQLStore) SetupDatabase() error {
+	ran, err := s.MigrateUp(s.LatestSchemaVersion())
+	for _, m := range ran {
+		log.Printf("Applied database migration %d: %s", m.Version, m.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("error migrating database: %w", err)
+	}
+
+	return s.ensureSearchIndex()
+}
+
+// ensureSchemaVersionTable creates the schema_version table. SQLite databases created before
+// migrations existed get the versions their tables already correspond to recorded.
+func (s *SQLStore) ensureSchemaVersionTable() error {
+	tx, err := s.write.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if s.dialect == postgresDialect {
+		err = tx.QueryRow("SELECT to_regclass('schema_version') IS NOT NULL").Scan(&exists)
+	} else {
+		exists, err = tableExists(tx, "schema_version")
+	}
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE TABLE schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at BIGINT NOT NULL
+    )`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %w", err)
+	}
+
+	if s.dialect == sqliteDialect {
+		baseline, err := detectSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		for _, m := range sqliteMigrations[:baseline] {
+			if err := s.recordMigration(tx, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// detectSchemaVersion works out the version of a SQLite database that has no schema_version table
+func detectSchemaVersion(q queryer) (int, error) {
+	hasNames, err := tableExists(q, "names")
+	if err != nil {
+		return 0, err
+	}
+	if hasNames {
+		hasFirstSeen, err := columnExists(q, "names", "first_seen")
+		if err != nil {
+			return 0, err
+		}
+		if hasFirstSeen {
+			return 3, nil
+		}
+		return 2, nil
+	}
+
+	hasDomains, err := tableExists(q, "domains")
+	if err != nil {
+		return 0, err
+	}
+	if hasDomains {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+func (s *SQLStore) recordMigration(tx *sql.Tx, m migration) error {
+	_, err := tx.Exec(s.dialect.rebind("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)"), m.version, m.name, time.Now().Unix())
+	return err
+}
+
+func (s *SQLStore) forgetMigration(tx *sql.Tx, m migration) error {
+	_, err := tx.Exec(s.dialect.rebind("DELETE FROM schema_version WHERE version = ?"), m.version)
+	return err
+}
+
+// SchemaVersion returns the version of the newest applied migration, 0 for an empty database
+func (s *SQLStore) SchemaVersion() (int, error) {
+	if err := s.ensureSchemaVersionTable(); err != nil {
+		return 0, err
+	}
+
+	var version int
+	if err := s.write.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+// MigrationStatus lists every known migration and whether it has been applied
+func (s *SQLStore) MigrationStatus() ([]MigrationState, error) {
+	if err := s.ensureSchemaVersionTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.write.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_version: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(appliedAt, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	migrations := s.migrations()
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.version]
+		states = append(states, MigrationState{Version: m.version, Name: m.name, Applied: ok, AppliedAt: appliedAt})
+	}
+	return states, nil
+}
+
+// MigrateUp applies all pending migrations up to and including target and returns the ones it ran
+func (s *SQLStore) MigrateUp(target int) ([]MigrationState, error) {
+	if target < 0 || target > s.LatestSchemaVersion() {
+		return nil, fmt.Errorf("unknown schema version %d", target)
+	}
+
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []MigrationState
+	for _, m := range s.migrations() {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		if err := s.applyMigration(m, m.up, s.recordMigration); err != nil {
+			return ran, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		ran = append(ran, MigrationState{Version: m.version, Name: m.name, Applied: true, AppliedAt: time.Now()})
+	}
+	return ran, nil
+}
+
+// MigrateDown reverts applied migrations newest first until the schema is at target and returns the ones it reverted
+func (s *SQLStore) MigrateDown(target int) ([]MigrationState, error) {
+	if target < 0 || target > s.LatestSchemaVersion() {
+		return nil, fmt.Errorf("unknown schema version %d", target)
+	}
+
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := s.migrations()
+	var reverted []MigrationState
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		if err := s.applyMigration(m, m.down, s.forgetMigration); err != nil {
+			return reverted, fmt.Errorf("reverting migration %d (%s): %w", m.version, m.name, err)
+		}
+		reverted = append(reverted, MigrationState{Version: m.version, Name: m.name})
+	}
+	return reverted, nil
+}
+
+// applyMigration runs one direction of a migration and its bookkeeping in a single transaction
+func (s *SQLStore) applyMigration(m migration, step func(*sql.Tx) error, record func(*sql.Tx, migration) error) error {
+	tx, err := s.write.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := step(tx); err != nil {
+		return err
+	}
+	if err := record(tx, m); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
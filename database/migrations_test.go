@@ -0,0 +1,225 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// domainsTable is the table of databases created before migrations existed, one row per
+// name with the first certificate seen for it
+const domainsTable = `CREATE TABLE domains (
+    id INTEGER PRIMARY KEY,
+    domain TEXT NOT NULL UNIQUE,
+    is_apex BOOLEAN NOT NULL,
+    parent_domain TEXT,
+    not_before INTEGER,
+    not_after INTEGER,
+    serial_number TEXT,
+    fingerprint TEXT,
+    key_usage TEXT,
+    extended_key_usage TEXT,
+    subject_key_id TEXT,
+    authority_key_id TEXT,
+    authority_info TEXT,
+    subject_alt_name TEXT,
+    certificate_policies TEXT,
+    wildcard BOOLEAN
+)`
+
+// queryStrings returns the rows of a query of a single text column
+func queryStrings(t *testing.T, db *sql.DB, query string) []string {
+	t.Helper()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestUpgradeDomainsTable(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		parentDomains bool // whether the table has the parent_domain column
+	}{
+		{"domains table", true},
+		{"domains table before parent_domain", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "swim.db")
+			db, err := Open(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			table := domainsTable
+			if !test.parentDomains {
+				table = strings.Replace(domainsTable, "parent_domain TEXT,", "", 1)
+			}
+			stmts := []string{table}
+			for _, row := range []struct {
+				domain, parent string
+				values         string // is_apex, not_before, not_after, serial_number, fingerprint and wildcard
+			}{
+				{"example.com", "example.com", `true, 1704067200, 1711843200, '01', 'AA', false`},
+				{"www.example.com", "example.com", `false, 1704067200, 1711843200, '01', 'AA', false`},
+				{"api.example.org", "example.org", `false, 1704153600, 1711929600, '02', 'BB', true`},
+				// names stored without a certificate
+				{"old.example.net", "example.net", `false, NULL, NULL, NULL, NULL, NULL`},
+				{"empty.example.net", "example.net", `false, NULL, NULL, NULL, '', NULL`},
+			} {
+				columns, values := "domain, ", "'"+row.domain+"', "
+				if test.parentDomains {
+					columns, values = columns+"parent_domain, ", values+"'"+row.parent+"', "
+				}
+				stmts = append(stmts, `INSERT INTO domains (`+columns+`is_apex, not_before, not_after, serial_number, fingerprint, wildcard) VALUES (`+values+row.values+`)`)
+			}
+			for _, stmt := range stmts {
+				if _, err := db.Write.Exec(stmt); err != nil {
+					t.Fatalf("%s: %v", stmt, err)
+				}
+			}
+			db.Close()
+
+			s := openTestStoreAt(t, path)
+
+			// the baseline is recorded as migration 1, the rest were applied
+			versions := queryStrings(t, s.write, `SELECT version FROM schema_version ORDER BY version`)
+			var want []string
+			for _, m := range sqliteMigrations {
+				want = append(want, strconv.Itoa(m.version))
+			}
+			if !slices.Equal(versions, want) {
+				t.Errorf("schema versions %v, want %v", versions, want)
+			}
+			if exists, err := tableExists(s.write, "domains"); err != nil || exists {
+				t.Errorf("domains table exists after the upgrade: %v, %v", exists, err)
+			}
+
+			if got, want := queryStrings(t, s.write, `SELECT fingerprint || ' ' || serial_number || ' ' || not_after FROM certificates ORDER BY fingerprint`),
+				[]string{"AA 01 1711843200", "BB 02 1711929600"}; !slices.Equal(got, want) {
+				t.Errorf("certificates %v, want %v", got, want)
+			}
+			if got, want := queryStrings(t, s.write, `SELECT name || ' ' || is_apex || ' ' || reversed FROM names ORDER BY name`), []string{
+				"api.example.org 0 org.example.api",
+				"empty.example.net 0 net.example.empty",
+				"example.com 1 com.example",
+				"old.example.net 0 net.example.old",
+				"www.example.com 0 com.example.www",
+			}; !slices.Equal(got, want) {
+				t.Errorf("names %v, want %v", got, want)
+			}
+			if test.parentDomains {
+				if got, want := queryStrings(t, s.write, `SELECT name || ' ' || parent_domain FROM names ORDER BY name`), []string{
+					"api.example.org example.org",
+					"empty.example.net example.net",
+					"example.com example.com",
+					"old.example.net example.net",
+					"www.example.com example.com",
+				}; !slices.Equal(got, want) {
+					t.Errorf("parent domains %v, want %v", got, want)
+				}
+			}
+			if got, want := queryStrings(t, s.write, `SELECT c.fingerprint || ' ' || n.name || ' ' || cn.wildcard FROM certificate_names cn
+                JOIN certificates c ON c.id = cn.certificate_id
+                JOIN names n ON n.id = cn.name_id
+                ORDER BY c.fingerprint, n.name`), []string{
+				"AA example.com 0",
+				"AA www.example.com 0",
+				"BB api.example.org 1",
+			}; !slices.Equal(got, want) {
+				t.Errorf("certificate names %v, want %v", got, want)
+			}
+			assertTotals(t, s)
+		})
+	}
+}
+
+// schema returns the statements creating the tables, indexes and triggers of a database
+func schema(t *testing.T, s *SQLStore) []string {
+	t.Helper()
+	return queryStrings(t, s.write, `SELECT type || ' ' || name || ': ' || COALESCE(sql, '') FROM sqlite_master
+        WHERE name NOT LIKE 'sqlite_%' AND name NOT LIKE 'names_fts%' ORDER BY type, name`)
+}
+
+func TestMigrateDownUp(t *testing.T) {
+	s := openTestStore(t)
+	want := schema(t, s)
+
+	for _, target := range []int{5, 1, 0} {
+		if _, err := s.MigrateDown(target); err != nil {
+			t.Fatalf("migrating down to %d: %v", target, err)
+		}
+		if version, err := s.SchemaVersion(); err != nil || version != target {
+			t.Fatalf("schema version %d after migrating down to %d: %v", version, target, err)
+		}
+
+		ran, err := s.MigrateUp(s.LatestSchemaVersion())
+		if err != nil {
+			t.Fatalf("migrating up from %d: %v", target, err)
+		}
+		if len(ran) != s.LatestSchemaVersion()-target {
+			t.Errorf("migrating up from %d ran %d migrations, want %d", target, len(ran), s.LatestSchemaVersion()-target)
+		}
+		if got := schema(t, s); !slices.Equal(got, want) {
+			t.Errorf("schema after migrating down to %d and back differs\n%s\nwant\n%s", target, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestAddReversedNames(t *testing.T) {
+	s := openTestStore(t)
+	if _, err := s.MigrateDown(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// more names than a chunk of the backfill
+	n := backfillChunkSize + 5
+	_, err := s.write.Exec(`WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+        INSERT INTO names (name, is_apex, parent_domain) SELECT 'h' || i || '.site' || (i % 7) || '.example.com', false, 'example.com' FROM seq`, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.MigrateUp(6); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := s.write.Query(`SELECT name, reversed FROM names`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var count int
+	for rows.Next() {
+		var name string
+		var reversed sql.NullString
+		if err := rows.Scan(&name, &reversed); err != nil {
+			t.Fatal(err)
+		}
+		if !reversed.Valid || reversed.String != reverseLabels(name) {
+			t.Errorf("%s has the reversed key %q, want %q", name, reversed.String, reverseLabels(name))
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("%d names after the migration, want %d", count, n)
+	}
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"runtime"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// busyTimeout is how long a connection waits for a lock held by another connection or process
+const busyTimeout = 10 * time.Second
+
+// DB holds the connection pools of a swim database. SQLite allows a single writer at a
+// time, so all writes go through a pool of one connection while API queries use a
+// separate read-only pool that WAL mode lets run alongside the writer.
+type DB struct {
+	Path  string
+	Write *sql.DB
+	Read  *sql.DB
+}
+
+// Open opens the SQLite database at path, creating the file if it does not exist yet.
+// readConns is the size of the read pool, 0 picks one connection per CPU.
+func Open(path string, readConns int) (*DB, error) {
+	if readConns <= 0 {
+		readConns = runtime.NumCPU()
+	}
+
+	// _txlock=immediate takes the write lock when a transaction begins instead of failing
+	// halfway through it when another process got there first. Incremental auto vacuum lets
+	// the retention janitor hand pruned pages back to the file system, it only takes effect
+	// on databases created with it.
+	write, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=%d&_txlock=immediate&_auto_vacuum=incremental", path, busyTimeout.Milliseconds()))
+	if err != nil {
+		return nil, fmt.Errorf("error opening database for writing: %w", err)
+	}
+	write.SetMaxOpenConns(1)
+
+	// open the write connection now so the file exists and is in WAL mode before readers attach
+	if err := write.Ping(); err != nil {
+		write.Close()
+		return nil, fmt.Errorf("error opening database for writing: %w", err)
+	}
+
+	read, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d", path, busyTimeout.Milliseconds()))
+	if err != nil {
+		write.Close()
+		return nil, fmt.Errorf("error opening database for reading: %w", err)
+	}
+	read.SetMaxOpenConns(readConns)
+	read.SetMaxIdleConns(readConns)
+
+	return &DB{Path: path, Write: write, Read: read}, nil
+}
+
+// Close closes both connection pools
+func (d *DB) Close() error {
+	readErr := d.Read.Close()
+	if err := d.Write.Close(); err != nil {
+		return err
+	}
+	return readErr
+}
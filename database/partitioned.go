@@ -0,0 +1,1090 @@
+package database
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+const (
+	partitionPrefix     = "swim-"
+	partitionDateLayout = "20060102"
+
+	// partitionMargin widens the time range a partition is queried for. A partition holds
+	// what was ingested during its period, the seen time reported by the stream can lag behind.
+	partitionMargin = time.Hour
+)
+
+// PartitionedStore spreads a SQLite database over one file per day or week. Batches are
+// written to the partition of the current period, older partitions are sealed: made
+// read-only and optionally gzip compressed. Queries run on every partition overlapping
+// the requested time range and the results are merged, so dropping old data is a file
+// delete and the write performance does not degrade as the data grows.
+//
+// A name or certificate seen in several periods is stored in each of their partitions.
+// Merged results combine them, but Stats counts them once per partition.
+type PartitionedStore struct {
+	dir       string
+	period    string // "day" or "week"
+	compress  bool
+	readConns int
+	tempDir   string // decompressed copies of compressed partitions
+
+	// mu is held for reading while partitions are used and for writing while the list changes
+	mu         sync.RWMutex
+	partitions []*partition // ordered by start, the last one is written to
+}
+
+// partition is one database file of a PartitionedStore
+type partition struct {
+	start  time.Time
+	path   string // the .db file, or the .db.gz file of a compressed partition
+	sealed bool
+
+	mu    sync.Mutex // guards opening store
+	store *SQLStore  // opened on first use for sealed partitions
+	temp  string     // decompressed copy of a compressed partition
+}
+
+// compressed reports whether the partition file is gzip compressed
+func (p *partition) compressed() bool {
+	return strings.HasSuffix(p.path, ".gz")
+}
+
+// OpenPartitioned opens the partitioned database in dir, creating the directory if needed.
+// period is "day" or "week", compress gzips sealed partitions and readConns sizes the read
+// pool of each partition (0 for one connection per CPU).
+func OpenPartitioned(dir, period string, compress bool, readConns int) (*PartitionedStore, error) {
+	if period != "day" && period != "week" {
+		return nil, fmt.Errorf("unknown partition period %q, expected day or week", period)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating partition directory: %w", err)
+	}
+
+	tempDir, err := os.MkdirTemp("", "swim-partitions-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary directory: %w", err)
+	}
+
+	ps := &PartitionedStore{dir: dir, period: period, compress: compress, readConns: readConns, tempDir: tempDir}
+	if err := ps.load(); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+// load finds the partition files in the directory and opens the one written to. Partitions
+// of past periods left writable, for example because swim was stopped for a while, are sealed.
+func (ps *PartitionedStore) load() error {
+	entries, err := os.ReadDir(ps.dir)
+	if err != nil {
+		return fmt.Errorf("error reading partition directory: %w", err)
+	}
+
+	byStart := make(map[time.Time]*partition)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, partitionPrefix) {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") {
+			// swim stopped while compressing a partition, its uncompressed file is still there
+			log.Printf("Removing %s, it is an incomplete copy", name)
+			if err := os.Remove(filepath.Join(ps.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		date, ok := strings.CutSuffix(strings.TrimPrefix(name, partitionPrefix), ".db.gz")
+		if !ok {
+			date, ok = strings.CutSuffix(strings.TrimPrefix(name, partitionPrefix), ".db")
+		}
+		if !ok {
+			continue // -wal and -shm files
+		}
+		start, err := time.Parse(partitionDateLayout, date)
+		if err != nil {
+			continue
+		}
+
+		p := &partition{start: start, path: filepath.Join(ps.dir, name)}
+		if existing, ok := byStart[start]; ok {
+			// swim stopped between compressing a partition and deleting the uncompressed
+			// file, the .gz file is only renamed into place once it is complete
+			if existing.compressed() {
+				existing, p = p, existing
+			}
+			log.Printf("Removing %s, it was compressed already", filepath.Base(existing.path))
+			if err := os.Remove(existing.path); err != nil {
+				return err
+			}
+		}
+		byStart[start] = p
+	}
+
+	for _, p := range byStart {
+		info, err := os.Stat(p.path)
+		if err != nil {
+			return err
+		}
+		p.sealed = p.compressed() || info.Mode().Perm()&0200 == 0
+		ps.partitions = append(ps.partitions, p)
+	}
+	sort.Slice(ps.partitions, func(i, j int) bool { return ps.partitions[i].start.Before(ps.partitions[j].start) })
+
+	current := ps.periodStart(time.Now())
+	for i, p := range ps.partitions {
+		if p.sealed {
+			continue
+		}
+		if i == len(ps.partitions)-1 && !p.start.Before(current) {
+			break // still written to
+		}
+		log.Printf("Sealing partition %s", filepath.Base(p.path))
+		if err := ps.sealFile(p); err != nil {
+			return err
+		}
+		if ps.compress {
+			if err := ps.compressPartition(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n := len(ps.partitions); n == 0 || ps.partitions[n-1].sealed {
+		ps.partitions = append(ps.partitions, &partition{start: current, path: ps.partitionPath(current)})
+	}
+
+	last := ps.partitions[len(ps.partitions)-1]
+	db, err := Open(last.path, ps.readConns)
+	if err != nil {
+		return err
+	}
+	last.store = NewSQLiteStore(db)
+	return nil
+}
+
+// periodStart returns the start of the UTC day or week (starting on Monday) containing t
+func (ps *PartitionedStore) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if ps.period == "week" {
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+func (ps *PartitionedStore) partitionPath(start time.Time) string {
+	return filepath.Join(ps.dir, partitionPrefix+start.Format(partitionDateLayout)+".db")
+}
+
+// current returns the partition written to, ps.mu must be held
+func (ps *PartitionedStore) current() *partition {
+	return ps.partitions[len(ps.partitions)-1]
+}
+
+// SetupDatabase applies pending migrations to every partition. Sealed partitions are made
+// writable for the migration and sealed again, compressed ones are migrated when they are
+// decompressed.
+func (ps *PartitionedStore) SetupDatabase() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if err := ps.current().store.SetupDatabase(); err != nil {
+		return err
+	}
+	latest := ps.current().store.LatestSchemaVersion()
+
+	for _, p := range ps.partitions {
+		if !p.sealed || p.compressed() {
+			continue
+		}
+		store, err := p.open(ps)
+		if err != nil {
+			return err
+		}
+		var version int
+		if err := store.read.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+			return fmt.Errorf("error reading schema version of %s: %w", p.path, err)
+		}
+		if version >= latest {
+			continue
+		}
+
+		log.Printf("Migrating sealed partition %s", filepath.Base(p.path))
+		store.Close()
+		p.store = nil
+		if err := os.Chmod(p.path, 0644); err != nil {
+			return err
+		}
+		if err := migrateFile(p.path); err != nil {
+			return err
+		}
+		if err := os.Chmod(p.path, 0444); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateFile applies pending migrations to the database file at path and leaves it in
+// rollback journal mode, so it can be opened read-only without a -wal file
+func migrateFile(path string) error {
+	db, err := Open(path, 1)
+	if err != nil {
+		return err
+	}
+	if err := NewSQLiteStore(db).SetupDatabase(); err != nil {
+		db.Close()
+		return err
+	}
+	return closeSealed(db)
+}
+
+// closeSealed checkpoints the WAL of db into the database file, switches it back to a
+// rollback journal and closes it
+func closeSealed(db *DB) error {
+	db.Read.Close()
+	if _, err := db.Write.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		db.Write.Close()
+		return fmt.Errorf("error checkpointing %s: %w", db.Path, err)
+	}
+	if _, err := db.Write.Exec("PRAGMA journal_mode=DELETE"); err != nil {
+		db.Write.Close()
+		return fmt.Errorf("error leaving WAL mode in %s: %w", db.Path, err)
+	}
+	return db.Write.Close()
+}
+
+// sealFile makes the unsealed partition p read-only, p must not be open
+func (ps *PartitionedStore) sealFile(p *partition) error {
+	db, err := Open(p.path, 1)
+	if err != nil {
+		return err
+	}
+	if err := closeSealed(db); err != nil {
+		return err
+	}
+	if err := os.Chmod(p.path, 0444); err != nil {
+		return err
+	}
+	p.sealed = true
+	return nil
+}
+
+// compressPartition replaces the file of the sealed partition p with a compressed copy.
+// The copy is written without holding ps.mu, queries keep using the uncompressed file
+// until it is swapped in.
+func (ps *PartitionedStore) compressPartition(p *partition) error {
+	path := p.path
+	compressed, err := compressFile(path)
+	if err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	// the janitor may have deleted the partition in the meantime
+	if !slices.Contains(ps.partitions, p) {
+		return os.Remove(compressed)
+	}
+	if err := p.close(); err != nil {
+		return err
+	}
+	p.path = compressed
+	return os.Remove(path)
+}
+
+// compressFile writes a gzip compressed copy of path next to it and returns its name
+func compressFile(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	// write to a temporary name first, a partial .gz file must never look complete
+	target := path + ".gz"
+	out, err := os.OpenFile(target+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0444)
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(target + ".tmp")
+		return "", fmt.Errorf("error compressing %s: %w", path, err)
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(target + ".tmp")
+		return "", fmt.Errorf("error compressing %s: %w", path, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target + ".tmp")
+		return "", err
+	}
+	return target, os.Rename(target+".tmp", target)
+}
+
+// decompressFile writes the uncompressed contents of the gzip file path to target
+func decompressFile(path, target string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("error decompressing %s: %w", path, err)
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, zr); err != nil {
+		out.Close()
+		return fmt.Errorf("error decompressing %s: %w", path, err)
+	}
+	return out.Close()
+}
+
+// open returns the store of a partition, opening sealed partitions on first use.
+// Compressed partitions are decompressed into the temporary directory of ps.
+func (p *partition) open(ps *PartitionedStore) (*SQLStore, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.store != nil {
+		return p.store, nil
+	}
+
+	path := p.path
+	if p.compressed() {
+		p.temp = filepath.Join(ps.tempDir, strings.TrimSuffix(filepath.Base(p.path), ".gz"))
+		if err := decompressFile(p.path, p.temp); err != nil {
+			return nil, err
+		}
+		// the copy is writable, bring it up to date before it is opened read-only
+		if err := migrateFile(p.temp); err != nil {
+			return nil, err
+		}
+		path = p.temp
+	}
+
+	// immutable skips locking, nothing writes to a sealed partition
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&immutable=1", path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening partition %s: %w", p.path, err)
+	}
+	db.SetMaxOpenConns(ps.readConns)
+
+	store := &SQLStore{path: path, write: db, read: db, dialect: sqliteDialect, close: db.Close}
+	if err := store.detectNameSearch(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	p.store = store
+	return p.store, nil
+}
+
+// close closes the store of the partition and removes its decompressed copy
+func (p *partition) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	if p.store != nil {
+		err = p.store.Close()
+		p.store = nil
+	}
+	if p.temp != "" {
+		os.Remove(p.temp)
+		p.temp = ""
+	}
+	return err
+}
+
+// Close closes every partition
+func (ps *PartitionedStore) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var firstErr error
+	for _, p := range ps.partitions {
+		if err := p.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	os.RemoveAll(ps.tempDir)
+	return firstErr
+}
+
+// rotate starts a new partition once the period of the current one is over
+func (ps *PartitionedStore) rotate(now time.Time) error {
+	start := ps.periodStart(now)
+
+	ps.mu.RLock()
+	due := start.After(ps.current().start)
+	ps.mu.RUnlock()
+	if !due {
+		return nil
+	}
+
+	ps.mu.Lock()
+	next := &partition{start: start, path: ps.partitionPath(start)}
+	db, err := Open(next.path, ps.readConns)
+	if err != nil {
+		ps.mu.Unlock()
+		return err
+	}
+	next.store = NewSQLiteStore(db)
+	if err := next.store.SetupDatabase(); err != nil {
+		next.store.Close()
+		ps.mu.Unlock()
+		return err
+	}
+
+	old := ps.current()
+	ps.partitions = append(ps.partitions, next)
+	log.Printf("Started partition %s", filepath.Base(next.path))
+
+	// the old partition is already replaced, failing to seal it only costs disk space
+	if err := old.close(); err != nil {
+		log.Printf("Error closing partition %s: %v", old.path, err)
+	}
+	err = ps.sealFile(old)
+	ps.mu.Unlock()
+	if err != nil {
+		log.Printf("Error sealing partition %s: %v", old.path, err)
+		return nil
+	}
+
+	if ps.compress {
+		if err := ps.compressPartition(old); err != nil {
+			log.Printf("Error compressing partition %s: %v", old.path, err)
+		}
+	}
+	return nil
+}
+
+// InsertBatch writes a batch to the partition of the current period
+func (ps *PartitionedStore) InsertBatch(batch []swimModels.CertUpdateInfo) error {
+	if err := ps.rotate(time.Now()); err != nil {
+		return err
+	}
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.current().store.InsertBatch(batch)
+}
+
+// overlapping returns the partitions that may hold sightings in the time range of opts,
+// ps.mu must be held
+func (ps *PartitionedStore) overlapping(opts swimModels.ListOptions) []*partition {
+	var parts []*partition
+	margin := int64(partitionMargin / time.Second)
+	for i, p := range ps.partitions {
+		if opts.Until > 0 && p.start.Unix() >= opts.Until+margin {
+			continue
+		}
+		if i+1 < len(ps.partitions) && opts.Since > 0 && ps.partitions[i+1].start.Unix() <= opts.Since-margin {
+			continue
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// queryPartitions runs query on each of parts concurrently and returns the results in
+// the order of parts
+func queryPartitions[T any](ps *PartitionedStore, parts []*partition, query func(*SQLStore) (T, error)) ([]T, error) {
+	results := make([]T, len(parts))
+	errs := make([]error, len(parts))
+
+	var wg sync.WaitGroup
+	for i, p := range parts {
+		wg.Add(1)
+		go func(i int, p *partition) {
+			defer wg.Done()
+			store, err := p.open(ps)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i], errs[i] = query(store)
+		}(i, p)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// window returns the options fetching everything up to the end of the requested page
+// from each partition, the page is cut from the merged results
+func window(opts swimModels.ListOptions) swimModels.ListOptions {
+	if opts.Keyset {
+		return opts
+	}
+	opts.Size = max(opts.Page, 1) * opts.Size
+	opts.Page = 1
+	return opts
+}
+
+// page cuts the requested page out of merged results, all of them for a Size of 0. Pages
+// before the first are the first.
+func page[T any](items []T, opts swimModels.ListOptions) []T {
+	if opts.Size <= 0 {
+		return items
+	}
+	if opts.Keyset {
+		opts.Page = 1
+	}
+	offset := max(opts.Page-1, 0) * opts.Size
+	if offset >= len(items) {
+		return nil
+	}
+	return items[offset:min(offset+opts.Size, len(items))]
+}
+
+// ListApexDomains returns a page of apex domain names from all partitions
+func (ps *PartitionedStore) ListApexDomains(opts swimModels.ListOptions) ([]string, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	results, err := queryPartitions(ps, ps.overlapping(opts), func(s *SQLStore) ([]string, error) {
+		return s.ListApexDomains(window(opts))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var domains []string
+	for _, result := range results {
+		for _, domain := range result {
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	sort.Strings(domains)
+
+	return page(domains, opts), nil
+}
+
+// ListSubdomains returns the names whose parent domain is domain from all partitions
+func (ps *PartitionedStore) ListSubdomains(domain string, opts swimModels.ListOptions) (*swimModels.DomainWithSubdomains, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	if opts.Keyset && opts.Sort != "" && opts.Sort != "name" {
+		return nil, swimModels.ErrCursorUnsupported
+	}
+
+	results, err := queryPartitions(ps, ps.overlapping(opts), func(s *SQLStore) (*swimModels.DomainWithSubdomains, error) {
+		return s.ListSubdomains(domain, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lists := make([][]swimModels.Subdomain, len(results))
+	for i, result := range results {
+		lists[i] = result.Subdomains
+	}
+
+	subdomains := mergeNames(lists, opts)
+	if opts.Keyset {
+		subdomains = afterCursor(subdomains, opts)
+	}
+	return &swimModels.DomainWithSubdomains{Domain: domain, Subdomains: subdomains}, nil
+}
+
+// SearchNames returns a page of the names matching query from all partitions
+func (ps *PartitionedStore) SearchNames(query swimModels.SearchQuery, opts swimModels.ListOptions) ([]swimModels.Subdomain, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	results, err := queryPartitions(ps, ps.overlapping(opts), func(s *SQLStore) ([]swimModels.Subdomain, error) {
+		return s.SearchNames(query, window(opts))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page(mergeNames(results, opts), opts), nil
+}
+
+// mergeNames combines the sighting histories of names found in several partitions and
+// orders them like opts asks for
+func mergeNames(lists [][]swimModels.Subdomain, opts swimModels.ListOptions) []swimModels.Subdomain {
+	index := make(map[string]int)
+	var names []swimModels.Subdomain
+	for _, list := range lists {
+		for _, name := range list {
+			i, ok := index[name.Name]
+			if !ok {
+				index[name.Name] = len(names)
+				names = append(names, name)
+				continue
+			}
+			m := &names[i]
+			m.FirstSeen = min(m.FirstSeen, name.FirstSeen)
+			m.LastSeen = max(m.LastSeen, name.LastSeen)
+			m.CertCount += name.CertCount
+		}
+	}
+	for i := range names {
+		names[i].FirstSeenTime = time.Unix(names[i].FirstSeen, 0).Format(time.RFC3339)
+		names[i].LastSeenTime = time.Unix(names[i].LastSeen, 0).Format(time.RFC3339)
+	}
+
+	sort.SliceStable(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		return lessByKey(opts, a.Name, a.FirstSeen, a.LastSeen, b.Name, b.FirstSeen, b.LastSeen)
+	})
+	return names
+}
+
+// afterCursor cuts a keyset page out of merged names: at most opts.Size of the names
+// ordered after opts.After
+func afterCursor(names []swimModels.Subdomain, opts swimModels.ListOptions) []swimModels.Subdomain {
+	if a := opts.After; a != nil {
+		start := sort.Search(len(names), func(i int) bool {
+			n := names[i]
+			return lessByKey(opts, a.Name, a.Value, a.Value, n.Name, n.FirstSeen, n.LastSeen)
+		})
+		names = names[start:]
+	}
+	return names[:min(len(names), opts.Size)]
+}
+
+// lessByKey orders two names by the sort key of opts, the name breaks ties like orderBy does
+func lessByKey(opts swimModels.ListOptions, nameA string, firstA, lastA int64, nameB string, firstB, lastB int64) bool {
+	var a, b int64
+	switch opts.Sort {
+	case "first_seen":
+		a, b = firstA, firstB
+	case "last_seen":
+		a, b = lastA, lastB
+	}
+	if a == b {
+		if opts.Desc {
+			return nameA > nameB
+		}
+		return nameA < nameB
+	}
+	if opts.Desc {
+		return a > b
+	}
+	return a < b
+}
+
+// lessUpdate orders cert updates like certOrderBy
+func lessUpdate(opts swimModels.ListOptions, a, b swimModels.CertUpdateInfo) bool {
+	var keyA, keyB int64
+	switch opts.Sort {
+	case "seen":
+		keyA, keyB = a.Seen, b.Seen
+	case "not_before":
+		keyA, keyB = a.NotBefore, b.NotBefore
+	}
+	if keyA != keyB {
+		return (keyA < keyB) != opts.Desc
+	}
+
+	if a.Domain == b.Domain {
+		if a.NotBefore == b.NotBefore {
+			return a.Fingerprint < b.Fingerprint
+		}
+		return a.NotBefore < b.NotBefore
+	}
+	return lessByKey(opts, a.Domain, a.FirstSeen, a.LastSeen, b.Domain, b.FirstSeen, b.LastSeen)
+}
+
+// ListCertUpdates returns a page of name/certificate pairs from all partitions. A
+// certificate seen in several periods is returned once, with the sighting history of
+// its names combined over the partitions.
+func (ps *PartitionedStore) ListCertUpdates(opts swimModels.ListOptions) ([]swimModels.CertUpdateInfo, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	if _, err := certOrderBy(opts.Sort, opts.Desc); err != nil {
+		return nil, err
+	}
+	// the history of a name and the sightings of a certificate differ between partitions,
+	// only the name and the validity order them the same in all of them
+	if opts.Keyset && opts.Sort != "" && opts.Sort != "name" && opts.Sort != "not_before" {
+		return nil, swimModels.ErrCursorUnsupported
+	}
+
+	results, err := queryPartitions(ps, ps.overlapping(opts), func(s *SQLStore) ([]swimModels.CertUpdateInfo, error) {
+		return s.ListCertUpdates(window(opts))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type pairKey struct{ name, fingerprint string }
+	type history struct{ firstSeen, lastSeen, certCount int64 }
+	seenPair := make(map[pairKey]bool)
+	histories := make(map[string]*history)
+	var updates []swimModels.CertUpdateInfo
+	for _, result := range results {
+		counted := make(map[string]bool) // the count of a name is the same on all its rows of a partition
+		for _, update := range result {
+			h, ok := histories[update.Domain]
+			if !ok {
+				h = &history{firstSeen: update.FirstSeen, lastSeen: update.LastSeen}
+				histories[update.Domain] = h
+			}
+			h.firstSeen = min(h.firstSeen, update.FirstSeen)
+			h.lastSeen = max(h.lastSeen, update.LastSeen)
+			if !counted[update.Domain] {
+				counted[update.Domain] = true
+				h.certCount += update.CertCount
+			}
+
+			key := pairKey{update.Domain, update.Fingerprint}
+			if !seenPair[key] {
+				seenPair[key] = true
+				updates = append(updates, update)
+			}
+		}
+	}
+
+	for i := range updates {
+		h := histories[updates[i].Domain]
+		updates[i].FirstSeen, updates[i].LastSeen, updates[i].CertCount = h.firstSeen, h.lastSeen, h.certCount
+		updates[i].FirstSeenTime = time.Unix(h.firstSeen, 0).Format(time.RFC3339)
+		updates[i].LastSeenTime = time.Unix(h.lastSeen, 0).Format(time.RFC3339)
+	}
+
+	sort.SliceStable(updates, func(i, j int) bool {
+		return lessUpdate(opts, updates[i], updates[j])
+	})
+
+	return page(updates, opts), nil
+}
+
+// RawCertificate returns the DER of a certificate from the newest partition that stored it
+func (ps *PartitionedStore) RawCertificate(fingerprint string) (*swimModels.RawCertificate, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	results, err := queryPartitions(ps, ps.partitions, func(s *SQLStore) (*swimModels.RawCertificate, error) {
+		return s.RawCertificate(fingerprint)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(results) - 1; i >= 0; i-- {
+		if results[i] != nil {
+			return results[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// DomainDetail combines the sighting history of domain in all partitions, a certificate
+// stored by several of them is listed once with the names of all of them
+func (ps *PartitionedStore) DomainDetail(domain string, size int) (*swimModels.DomainDetail, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	results, err := queryPartitions(ps, ps.partitions, func(s *SQLStore) (*swimModels.DomainDetail, error) {
+		return s.DomainDetail(domain, size)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var detail *swimModels.DomainDetail
+	var certs, wildcardCerts [][]swimModels.Certificate
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		if detail == nil {
+			detail = &swimModels.DomainDetail{Domain: domain, Reversed: result.Reversed}
+		}
+		// partitions that only stored wildcard certificates have no history of the name
+		if result.CertCount > 0 && (detail.CertCount == 0 || result.FirstSeen < detail.FirstSeen) {
+			detail.FirstSeen = result.FirstSeen
+		}
+		detail.LastSeen = max(detail.LastSeen, result.LastSeen)
+		detail.CertCount += result.CertCount
+		certs = append(certs, result.Certificates)
+		wildcardCerts = append(wildcardCerts, result.WildcardCertificates)
+	}
+	if detail == nil {
+		return nil, nil
+	}
+
+	if detail.CertCount > 0 {
+		detail.FirstSeenTime = time.Unix(detail.FirstSeen, 0).Format(time.RFC3339)
+		detail.LastSeenTime = time.Unix(detail.LastSeen, 0).Format(time.RFC3339)
+	}
+	detail.Certificates = mergeCertificates(certs, size)
+	detail.WildcardCertificates = mergeCertificates(wildcardCerts, size)
+	return detail, nil
+}
+
+// Certificate returns a certificate with the names all partitions stored it with
+func (ps *PartitionedStore) Certificate(fingerprint string) (*swimModels.Certificate, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	results, err := queryPartitions(ps, ps.partitions, func(s *SQLStore) ([]swimModels.Certificate, error) {
+		cert, err := s.Certificate(fingerprint)
+		if cert == nil {
+			return nil, err
+		}
+		return []swimModels.Certificate{*cert}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	certs := mergeCertificates(results, 1)
+	if len(certs) == 0 {
+		return nil, nil
+	}
+	return &certs[0], nil
+}
+
+// LookupCertificates merges the certificates matching lookup in each partition
+func (ps *PartitionedStore) LookupCertificates(lookup swimModels.CertificateLookup, size int) ([]swimModels.Certificate, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	results, err := queryPartitions(ps, ps.partitions, func(s *SQLStore) ([]swimModels.Certificate, error) {
+		return s.LookupCertificates(lookup, size)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeCertificates(results, size), nil
+}
+
+// mergeCertificates merges the certificates of several partitions, the newest first, and
+// keeps the first size of them if size is set
+func mergeCertificates(lists [][]swimModels.Certificate, size int) []swimModels.Certificate {
+	index := make(map[string]int)
+	certs := []swimModels.Certificate{}
+	for _, list := range lists {
+		for _, cert := range list {
+			i, ok := index[cert.Fingerprint]
+			if !ok {
+				index[cert.Fingerprint] = len(certs)
+				certs = append(certs, cert)
+				continue
+			}
+			m := &certs[i]
+			m.Names = append(m.Names, cert.Names...)
+			slices.Sort(m.Names)
+			m.Names = slices.Compact(m.Names)
+			if cert.Seen < m.Seen {
+				m.Seen, m.SeenTime = cert.Seen, cert.SeenTime
+			}
+		}
+	}
+
+	sort.SliceStable(certs, func(i, j int) bool {
+		if certs[i].NotBefore != certs[j].NotBefore {
+			return certs[i].NotBefore > certs[j].NotBefore
+		}
+		return certs[i].Fingerprint < certs[j].Fingerprint
+	})
+	if size > 0 && len(certs) > size {
+		certs = certs[:size]
+	}
+	return certs
+}
+
+// ListExpiring lists the names whose last certificate in any partition expires in the
+// range expiry. A certificate expiring in one partition can be renewed in any other, so
+// every name expiring in a partition is checked against all of them.
+func (ps *PartitionedStore) ListExpiring(suffix string, expiry swimModels.TimeRange, opts swimModels.ListOptions) ([]swimModels.CertUpdateInfo, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	all := opts
+	all.Page, all.Size = 1, 0
+	results, err := queryPartitions(ps, ps.partitions, func(s *SQLStore) ([]swimModels.CertUpdateInfo, error) {
+		return s.ListExpiring(suffix, expiry, all)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make(map[string]swimModels.CertUpdateInfo)
+	for _, result := range results {
+		for _, update := range result {
+			c, ok := candidates[update.Domain]
+			if !ok || (nameExpiry{notAfter: c.NotAfter, fingerprint: c.Fingerprint}).before(update.NotAfter, update.Fingerprint) {
+				candidates[update.Domain] = update
+			}
+		}
+	}
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	latest, err := queryPartitions(ps, ps.partitions, func(s *SQLStore) (map[string]nameExpiry, error) {
+		return s.latestExpiry(names)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	updates := []swimModels.CertUpdateInfo{}
+	for _, name := range names {
+		update := candidates[name]
+		expires := nameExpiry{notAfter: update.NotAfter, fingerprint: update.Fingerprint}
+		renewed := false
+		var history *nameExpiry
+		for _, partition := range latest {
+			e, ok := partition[name]
+			if !ok {
+				continue
+			}
+			if expires.before(e.notAfter, e.fingerprint) {
+				renewed = true
+				break
+			}
+			if history == nil {
+				history = &e
+				continue
+			}
+			history.firstSeen = min(history.firstSeen, e.firstSeen)
+			history.lastSeen = max(history.lastSeen, e.lastSeen)
+			history.certCount += e.certCount
+		}
+		// the partition the candidate was found in has its name
+		if renewed || history == nil {
+			continue
+		}
+		update.FirstSeen, update.LastSeen, update.CertCount = history.firstSeen, history.lastSeen, history.certCount
+		update.FirstSeenTime = time.Unix(update.FirstSeen, 0).Format(time.RFC3339)
+		update.LastSeenTime = time.Unix(update.LastSeen, 0).Format(time.RFC3339)
+		updates = append(updates, update)
+	}
+
+	sort.SliceStable(updates, func(i, j int) bool {
+		if updates[i].NotAfter != updates[j].NotAfter {
+			return updates[i].NotAfter < updates[j].NotAfter
+		}
+		return updates[i].Domain < updates[j].Domain
+	})
+	return page(updates, opts), nil
+}
+
+// Stats adds up the counts and rollups of all partitions. Every partition keeps the
+// rollups of what it ingested, they are deleted along with it.
+func (ps *PartitionedStore) Stats(opts swimModels.StatsOptions) (*swimModels.Stats, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	// the top level domains and issuers can only be cut off once they are added up
+	all := opts
+	all.Top = 0
+	results, err := queryPartitions(ps, ps.partitions, func(s *SQLStore) (*swimModels.Stats, error) {
+		return s.Stats(all)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var stats swimModels.Stats
+	for _, result := range results {
+		stats.Names += result.Names
+		stats.ApexDomains += result.ApexDomains
+		stats.Certificates += result.Certificates
+	}
+	mergeRollups(&stats, results, opts)
+	return &stats, nil
+}
+
+// Prune enforces policy by deleting whole sealed partitions, oldest first. The partition
+// written to is never deleted, so the limits are met with the granularity of a period.
+func (ps *PartitionedStore) Prune(policy RetentionPolicy, stop chan struct{}) (PruneReport, error) {
+	var report PruneReport
+	if err := policy.Validate(); err != nil {
+		return report, err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var maxSize int64
+	if policy.MaxSize != "" {
+		maxSize, _ = parseSize(policy.MaxSize)
+	}
+	total := ps.diskUsage(ps.partitions)
+	cutoff := time.Now().Add(-policy.MaxAge)
+
+	for len(ps.partitions) > 1 && !stopped(stop) {
+		oldest, next := ps.partitions[0], ps.partitions[1]
+		expired := policy.MaxAge > 0 && !next.start.After(cutoff)
+		tooBig := maxSize > 0 && total > maxSize
+		if !expired && !tooBig {
+			break
+		}
+
+		size := ps.diskUsage(ps.partitions[:1])
+		if err := oldest.close(); err != nil {
+			return report, err
+		}
+		if err := os.Remove(oldest.path); err != nil {
+			return report, fmt.Errorf("error deleting partition %s: %w", oldest.path, err)
+		}
+		log.Printf("Deleted partition %s", filepath.Base(oldest.path))
+
+		ps.partitions = ps.partitions[1:]
+		total -= size
+		report.Partitions++
+		report.FreedBytes += size
+	}
+
+	return report, nil
+}
+
+// diskUsage returns the size of the files of parts, including the WAL
+func (ps *PartitionedStore) diskUsage(parts []*partition) int64 {
+	var total int64
+	for _, p := range parts {
+		for _, suffix := range []string{"", "-wal"} {
+			if info, err := os.Stat(p.path + suffix); err == nil {
+				total += info.Size()
+			}
+		}
+	}
+	return total
+}
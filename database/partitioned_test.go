@@ -0,0 +1,119 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+func TestOpenPartitionedRemovesIncompleteCopies(t *testing.T) {
+	dir := t.TempDir()
+	ps, err := OpenPartitioned(dir, "day", true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.SetupDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	insertCerts(t, ps, 20, 5, 20)
+	want, err := ps.ListApexDomains(swimModels.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := ps.current().path
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a past partition whose compression was interrupted before the rename
+	data, err := os.ReadFile(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := filepath.Join(dir, partitionPrefix+"20240101.db")
+	if err := os.WriteFile(past, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(past+".gz.tmp", data[:len(data)/2], 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopened without compression nothing overwrites the copy
+	ps, err = OpenPartitioned(dir, "day", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	if _, err := os.Stat(past + ".gz.tmp"); !os.IsNotExist(err) {
+		t.Errorf("incomplete copy %s was not removed", filepath.Base(past)+".gz.tmp")
+	}
+	if _, err := os.Stat(past); err != nil {
+		t.Errorf("past partition is missing: %v", err)
+	}
+	domains, err := ps.ListApexDomains(swimModels.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(domains, want) {
+		t.Errorf("listed apex domains %v, want %v", domains, want)
+	}
+}
+
+func TestPartitionedListExpiring(t *testing.T) {
+	ps, err := OpenPartitioned(t.TempDir(), "day", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if err := ps.SetupDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ps.InsertBatch([]swimModels.CertUpdateInfo{
+		expiringCert("renewed.example.com", "A1", "x509", 10),
+		expiringCert("lapsed.example.com", "B1", "x509", 20),
+		expiringCert("tie.example.com", "C1", "x509", 15),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the renewals are stored in the partition of a later day
+	if err := ps.rotate(time.Now().AddDate(0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.partitions) != 2 {
+		t.Fatalf("%d partitions, want 2", len(ps.partitions))
+	}
+	err = ps.current().store.InsertBatch([]swimModels.CertUpdateInfo{
+		expiringCert("renewed.example.com", "A2", "x509", 90),
+		expiringCert("tie.example.com", "CC", "precert", 15),
+		expiringCert("other.example.com", "D1", "x509", 90),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := swimModels.TimeRange{Since: testStart, Until: testStart + 30*86400}
+	for _, test := range []struct {
+		suffix string
+		want   []string
+	}{
+		{"", []string{"tie.example.com CC", "lapsed.example.com B1"}},
+		{"lapsed.example.com", []string{"lapsed.example.com B1"}},
+		{"example.org", nil},
+	} {
+		updates, err := ps.ListExpiring(test.suffix, expiry, swimModels.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expiringNames(updates); !slices.Equal(got, test.want) {
+			t.Errorf("ListExpiring(%q) = %v, want %v", test.suffix, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+	_ "github.com/lib/pq" // registers the postgres driver
+)
+
+// postgresMigrations lists every schema change of PostgreSQL databases in order. The first
+// one creates the schema SQLite databases reach after their first five migrations.
+var postgresMigrations = []migration{
+	{
+		version: 1,
+		name:    "create certificates and names tables",
+		up: execAll(
+			`CREATE TABLE certificates (
+                id BIGSERIAL PRIMARY KEY,
+                fingerprint TEXT NOT NULL UNIQUE,
+                not_before BIGINT,
+                not_after BIGINT,
+                serial_number TEXT,
+                key_usage TEXT,
+                extended_key_usage TEXT,
+                subject_key_id TEXT,
+                authority_key_id TEXT,
+                authority_info TEXT,
+                subject_alt_name TEXT,
+                certificate_policies TEXT,
+                seen BIGINT
+            )`,
+			`CREATE TABLE names (
+                id BIGSERIAL PRIMARY KEY,
+                name TEXT NOT NULL UNIQUE,
+                is_apex BOOLEAN NOT NULL,
+                parent_domain TEXT,
+                first_seen BIGINT,
+                last_seen BIGINT,
+                cert_count BIGINT NOT NULL DEFAULT 0
+            )`,
+			// sightings are partitioned by month of the certificate's first sighting, see partitionCache
+			`CREATE TABLE certificate_names (
+                certificate_id BIGINT NOT NULL REFERENCES certificates(id),
+                name_id BIGINT NOT NULL REFERENCES names(id),
+                wildcard BOOLEAN NOT NULL DEFAULT FALSE,
+                seen BIGINT NOT NULL,
+                PRIMARY KEY (certificate_id, name_id, seen)
+            ) PARTITION BY RANGE (seen)`,
+			`CREATE TABLE certificate_names_default PARTITION OF certificate_names DEFAULT`,
+			`CREATE INDEX idx_certificate_names_name_id ON certificate_names (name_id)`,
+			`CREATE INDEX idx_certificate_names_seen ON certificate_names (seen)`,
+			`CREATE INDEX idx_names_parent_domain ON names (parent_domain)`,
+			`CREATE INDEX idx_names_is_apex ON names (is_apex, name)`,
+			`CREATE INDEX idx_names_first_seen ON names (first_seen)`,
+			`CREATE INDEX idx_names_last_seen ON names (last_seen)`,
+		),
+		down: execAll(
+			`DROP TABLE certificate_names`,
+			`DROP TABLE names`,
+			`DROP TABLE certificates`,
+		),
+	},
+	{
+		version: 2,
+		name:    "index names for substring search",
+		// pg_trgm ships with PostgreSQL but creating it needs privileges the swim user may
+		// not have, searches scan the names table without the index
+		up: execAll(`DO $$
+            BEGIN
+                CREATE EXTENSION IF NOT EXISTS pg_trgm;
+                CREATE INDEX idx_names_name_trgm ON names USING gin (name gin_trgm_ops);
+            EXCEPTION WHEN OTHERS THEN
+                RAISE WARNING 'pg_trgm is not available, name searches will scan the names table: %', SQLERRM;
+            END
+            $$`),
+		down: execAll(`DROP INDEX IF EXISTS idx_names_name_trgm`),
+	},
+	{
+		version: 3,
+		name:    "add reversed label key to names",
+		// the C collation compares bytes, which the range scans over the key rely on
+		up: execAll(
+			`ALTER TABLE names ADD COLUMN reversed TEXT COLLATE "C"`,
+			`UPDATE names SET reversed = array_to_string(ARRAY(
+                SELECT label FROM unnest(string_to_array(name, '.')) WITH ORDINALITY AS l(label, i) ORDER BY i DESC
+            ), '.')`,
+			`CREATE INDEX idx_names_reversed ON names (reversed)`,
+		),
+		down: execAll(
+			`DROP INDEX idx_names_reversed`,
+			`ALTER TABLE names DROP COLUMN reversed`,
+		),
+	},
+	{
+		version: 4,
+		name:    "add issuer and rollup tables",
+		up:      execAll(rollupSchema(`split_part(n.reversed, '.', 1)`)...),
+		down:    execAll(dropRollups...),
+	},
+	{
+		version: 5,
+		name:    "add raw certificate tables",
+		up:      execAll(rawSchema("BYTEA")...),
+		down:    execAll(dropRaw...),
+	},
+	{
+		version: 6,
+		name:    "add entry type and certificate filter indexes",
+		up:      execAll(filterSchema...),
+		down:    execAll(dropFilter...),
+	},
+	{
+		version: 7,
+		name:    "index certificate serial numbers and key identifiers",
+		up:      execAll(lookupSchema...),
+		down:    execAll(dropLookup...),
+	},
+	{
+		version: 8,
+		name:    "add totals rollup",
+		up:      execAll(totalsSchema...),
+		down:    execAll(dropTotals...),
+	},
+}
+
+// OpenPostgres connects to the PostgreSQL database described by dsn, maxConns limits the
+// size of the connection pool (0 for no limit)
+func OpenPostgres(dsn string, maxConns int) (*SQLStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening postgres database: %w", err)
+	}
+	db.SetMaxOpenConns(maxConns)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to postgres: %w", err)
+	}
+
+	return &SQLStore{
+		write:      db,
+		read:       db,
+		dialect:    postgresDialect,
+		close:      db.Close,
+		partitions: &partitionCache{known: make(map[int64]bool)},
+	}, nil
+}
+
+// partitionCache creates the monthly certificate_names partitions on demand and remembers
+// which ones exist, so only the first batch of a month pays for the DDL
+type partitionCache struct {
+	mu    sync.Mutex
+	known map[int64]bool // keyed by the unix time the month starts
+}
+
+// monthStart returns the start of the UTC month containing the unix time ts
+func monthStart(ts int64) time.Time {
+	t := time.Unix(ts, 0).UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// ensure creates the partitions that rows of batch will be written to. A link is stored
+// with the first sighting of its certificate, which is the sighting in batch for new
+// certificates and was covered by an earlier batch for known ones.
+func (p *partitionCache) ensure(db *sql.DB, batch []swimModels.CertUpdateInfo) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, domainInfo := range batch {
+		start := monthStart(domainInfo.Seen)
+		if p.known[start.Unix()] {
+			continue
+		}
+
+		end := start.AddDate(0, 1, 0)
+		_, err := db.Exec(fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS certificate_names_y%04dm%02d PARTITION OF certificate_names FOR VALUES FROM (%d) TO (%d)`,
+			start.Year(), start.Month(), start.Unix(), end.Unix()))
+		if err != nil {
+			return fmt.Errorf("error creating partition for %s: %w", start.Format("2006-01"), err)
+		}
+		p.known[start.Unix()] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// timeColumns maps the time fields of queries to their columns
+var timeColumns = map[string]string{
+	"not_before": "c.not_before",
+	"not_after":  "c.not_after",
+	"seen":       "cn.seen",
+}
+
+// compileQuery compiles a parsed query to a condition over the names n, certificates c
+// and certificate_names cn. Only column names and operators come from the compiler,
+// every value is passed as a parameter.
+func compileQuery(expr swimModels.Expr) (string, []interface{}, error) {
+	switch e := expr.(type) {
+	case swimModels.And:
+		return compileGroup(e, " AND ")
+	case swimModels.Or:
+		return compileGroup(e, " OR ")
+	case swimModels.Not:
+		cond, args, err := compileQuery(e.Expr)
+		if err != nil {
+			return "", nil, err
+		}
+		// a condition over a missing value is unknown, NOT has to match it
+		return "NOT COALESCE((" + cond + "), FALSE)", args, nil
+	case swimModels.Term:
+		return compileTerm(e)
+	}
+	return "", nil, fmt.Errorf("unknown query expression %T", expr)
+}
+
+// compileGroup compiles expressions joined by op
+func compileGroup(exprs []swimModels.Expr, op string) (string, []interface{}, error) {
+	conds := make([]string, len(exprs))
+	var args []interface{}
+	for i, expr := range exprs {
+		cond, condArgs, err := compileQuery(expr)
+		if err != nil {
+			return "", nil, err
+		}
+		conds[i] = cond
+		args = append(args, condArgs...)
+	}
+	return "(" + strings.Join(conds, op) + ")", args, nil
+}
+
+// compileTerm compiles a term with the conditions the filters of cert updates use
+func compileTerm(t swimModels.Term) (string, []interface{}, error) {
+	if column, ok := timeColumns[t.Field]; ok {
+		switch t.Op {
+		case "<", "<=", ">", ">=":
+			return column + " " + t.Op + " ?", []interface{}{t.Time}, nil
+		}
+		return "", nil, fmt.Errorf("invalid comparison %q of %s", t.Op, t.Field)
+	}
+
+	var cond string
+	var args []interface{}
+	switch t.Field {
+	case "name":
+		cond, args = nameGlob(t.Value)
+	case "suffix":
+		cond, args = suffixRange(strings.Trim(t.Value, "."))
+	case "issuer":
+		cond, args = issuerGlob(t.Value)
+	case "wildcard":
+		cond, args = "cn.wildcard = ?", []interface{}{t.Bool}
+	case "apex":
+		cond, args = "n.is_apex = ?", []interface{}{t.Bool}
+	case "entry_type":
+		cond, args = "c.entry_type = ?", []interface{}{t.Value}
+	case "key_usage":
+		cond, args = keyUsage(t.Value)
+	default:
+		return "", nil, fmt.Errorf("unknown query field %q", t.Field)
+	}
+	return "(" + cond + ")", args, nil
+}
+
+// queryFilter returns the terms of expr every cert update it matches has to match, as a
+// filter and whether the time seen is compared. Only which fields are set counts, they
+// tell certJoin the indexes the query can be looked up with.
+func queryFilter(expr swimModels.Expr) (f swimModels.CertFilter, seen bool) {
+	var terms []swimModels.Term
+	switch e := expr.(type) {
+	case swimModels.And:
+		for _, expr := range e {
+			if t, ok := expr.(swimModels.Term); ok {
+				terms = append(terms, t)
+			}
+		}
+	case swimModels.Term:
+		terms = append(terms, e)
+	}
+
+	for _, t := range terms {
+		switch t.Field {
+		case "name":
+			f.Name = t.Value
+		case "suffix":
+			f.Suffix = t.Value
+		case "issuer":
+			if !strings.ContainsAny(t.Value, "*?") {
+				f.Issuer = t.Value
+			}
+		case "not_before":
+			f.NotBefore.Since = t.Time
+		case "not_after":
+			f.NotAfter.Since = t.Time
+		case "seen":
+			seen = true
+		}
+	}
+	return f, seen
+}
+
+// issuerGlob returns the condition matching the issuer, or a glob over it ignoring case
+func issuerGlob(glob string) (string, []interface{}) {
+	if !strings.ContainsAny(glob, "*?") {
+		return "c.issuer = ?", []interface{}{glob}
+	}
+	return `LOWER(c.issuer) LIKE ? ESCAPE '\'`, []interface{}{likeGlob(strings.ToLower(glob))}
+}
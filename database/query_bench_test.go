@@ -0,0 +1,178 @@
+package database
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// The query benchmarks run over a generated dataset of SWIM_BENCH_ROWS name/certificate
+// sightings, 200000 by default, four per certificate with about 20 per apex domain. The
+// dataset is generated once into SWIM_BENCH_DB, a file in the temporary directory by
+// default, and reused by later runs with the same number of rows. To measure the latency
+// at 100M rows generate the dataset once, which takes a while, and keep it:
+//
+//	SWIM_BENCH_ROWS=100000000 SWIM_BENCH_DB=/data/swim-bench.db go test ./database -run '^$' -bench 'List' -timeout 0
+
+var (
+	benchOnce sync.Once
+	benchPath string
+	benchErr  error
+)
+
+// benchApexes is the number of apex domains of a dataset of rows sightings
+func benchApexes(rows int) int {
+	return max(rows/20, 1)
+}
+
+// benchRows returns the number of sightings of the benchmark dataset
+func benchRows(b *testing.B) int {
+	rows := 200000
+	if value := os.Getenv("SWIM_BENCH_ROWS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 4 {
+			b.Fatalf("invalid SWIM_BENCH_ROWS %q", value)
+		}
+		rows = n
+	}
+	return rows
+}
+
+// benchStore opens the benchmark dataset, generating it on first use
+func benchStore(b *testing.B) *SQLStore {
+	rows := benchRows(b)
+	benchOnce.Do(func() {
+		benchPath = os.Getenv("SWIM_BENCH_DB")
+		if benchPath == "" {
+			benchPath = filepath.Join(os.TempDir(), "swim-bench-"+strconv.Itoa(rows)+".db")
+		}
+		if _, err := os.Stat(benchPath); err == nil {
+			return
+		}
+		benchErr = generateBenchDataset(benchPath, rows)
+	})
+	if benchErr != nil {
+		b.Fatal(benchErr)
+	}
+	return openTestStoreAt(b, benchPath)
+}
+
+// generateBenchDataset writes a dataset of rows sightings to path. It is generated next
+// to it and renamed into place when complete, so an interrupted run is not reused.
+func generateBenchDataset(path string, rows int) error {
+	log.Printf("Generating benchmark dataset of %d rows at %s", rows, path)
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	db, err := Open(tmp, 1)
+	if err != nil {
+		return err
+	}
+	s := NewSQLiteStore(db)
+	if err := s.SetupDatabase(); err != nil {
+		s.Close()
+		return err
+	}
+
+	certs, apexes := rows/4, benchApexes(rows)
+	for start := 0; start < certs; start += 2500 {
+		if err := s.InsertBatch(generateCerts(start, min(2500, certs-start), apexes)); err != nil {
+			s.Close()
+			return err
+		}
+		if start%1000000 == 0 && start > 0 {
+			log.Printf("Generated %d of %d rows", 4*start, rows)
+		}
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func BenchmarkListSubdomains(b *testing.B) {
+	s := benchStore(b)
+	apexes := benchApexes(benchRows(b))
+
+	for _, bench := range []struct {
+		name string
+		opts swimModels.ListOptions
+	}{
+		{"all", swimModels.ListOptions{Size: 1000}},
+		{"depth1", swimModels.ListOptions{Size: 1000, Depth: 1}},
+		{"last_seen", swimModels.ListOptions{Size: 1000, Sort: "last_seen", Desc: true}},
+		{"keyset", swimModels.ListOptions{Size: 100, Keyset: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.ListSubdomains(testApex(i*7919, apexes), bench.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkListApexDomains(b *testing.B) {
+	s := benchStore(b)
+	apexes := benchApexes(benchRows(b))
+	middle := testApex(apexes/2, apexes)
+
+	for _, bench := range []struct {
+		name string
+		opts swimModels.ListOptions
+	}{
+		{"first_page", swimModels.ListOptions{Page: 1, Size: 1000}},
+		{"deep_page", swimModels.ListOptions{Page: max(apexes/2000, 1), Size: 1000}},
+		{"keyset", swimModels.ListOptions{Size: 1000, Keyset: true, After: &swimModels.Cursor{Sort: "name", Name: middle}}},
+		{"since", swimModels.ListOptions{Page: 1, Size: 1000, Since: testStart + int64(apexes)*60}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.ListApexDomains(bench.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkListCertUpdates(b *testing.B) {
+	s := benchStore(b)
+	rows := benchRows(b)
+	apexes := benchApexes(rows)
+	last := testStart + int64(rows/4)*60
+
+	for _, bench := range []struct {
+		name string
+		opts func(i int) swimModels.ListOptions
+	}{
+		{"first_page", func(int) swimModels.ListOptions {
+			return swimModels.ListOptions{Page: 1, Size: 1000}
+		}},
+		{"seen_desc_keyset", func(int) swimModels.ListOptions {
+			return swimModels.ListOptions{Size: 1000, Sort: "seen", Desc: true, Keyset: true}
+		}},
+		{"last_hour", func(int) swimModels.ListOptions {
+			return swimModels.ListOptions{Page: 1, Size: 1000, Sort: "seen", Since: last - 3600}
+		}},
+		{"suffix", func(i int) swimModels.ListOptions {
+			return swimModels.ListOptions{Page: 1, Size: 1000, Filter: swimModels.CertFilter{Suffix: testApex(i*7919, apexes)}}
+		}},
+		{"issuer", func(int) swimModels.ListOptions {
+			return swimModels.ListOptions{Page: 1, Size: 1000, Sort: "not_before", Desc: true, Filter: swimModels.CertFilter{Issuer: "DigiCert Inc"}}
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.ListCertUpdates(bench.opts(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
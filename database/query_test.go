@@ -0,0 +1,70 @@
+package database
+
+import (
+	"slices"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+	swimQuery "github.com/dap-ware/swim/query"
+)
+
+func TestCompileQuery(t *testing.T) {
+	s := openTestStore(t)
+	cert := func(name, issuer, fingerprint string) swimModels.CertUpdateInfo {
+		return swimModels.CertUpdateInfo{Domain: name, Issuer: issuer, Fingerprint: fingerprint, NotBefore: testStart, NotAfter: testStart + 86400, Seen: testStart}
+	}
+	err := s.InsertBatch([]swimModels.CertUpdateInfo{
+		cert("x_y.example.com", "100% Secure CA", "A1"),
+		cert("xay.example.com", "Under_Score CA", "A2"),
+		cert("p%q.example.org", "Let's Encrypt", "A3"),
+		cert("pzq.example.org", "Let's Encrypt", "A4"),
+		cert("legacy.example.net", "Legacy CA", "A5"),
+		cert("example.com", "Let's Encrypt", "A6"),
+		cert("www.example.com", "Let's Encrypt", "A6"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// certificates stored before issuers were recorded have none
+	if _, err := s.write.Exec(`UPDATE certificates SET issuer = NULL WHERE fingerprint = 'A5'`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		// a missing issuer is not the one asked for
+		{`NOT issuer:"Let's Encrypt"`, []string{"legacy.example.net", "x_y.example.com", "xay.example.com"}},
+		{`NOT issuer:*Score*`, []string{"example.com", "legacy.example.net", "p%q.example.org", "pzq.example.org", "www.example.com", "x_y.example.com"}},
+		{`issuer:"Legacy CA"`, nil},
+		// % and _ in globs are matched literally
+		{`issuer:*%*`, []string{"x_y.example.com"}},
+		{`issuer:*_*`, []string{"xay.example.com"}},
+		{`name:x_y.*`, []string{"x_y.example.com"}},
+		{`name:p%q.*`, []string{"p%q.example.org"}},
+		{`name:x?y.example.com`, []string{"x_y.example.com", "xay.example.com"}},
+		// suffix matches the domain and the names below it
+		{`suffix:example.com`, []string{"example.com", "www.example.com", "x_y.example.com", "xay.example.com"}},
+		{`suffix:.example.org.`, []string{"p%q.example.org", "pzq.example.org"}},
+		{`suffix:www.example.com`, []string{"www.example.com"}},
+		{`NOT suffix:example.com AND NOT issuer:"Let's Encrypt"`, []string{"legacy.example.net"}},
+		{`name:x_y.* OR name:pzq.example.org OR suffix:example.net`, []string{"legacy.example.net", "pzq.example.org", "x_y.example.com"}},
+	} {
+		expr, err := swimQuery.Parse(test.query)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", test.query, err)
+		}
+		updates, err := s.ListCertUpdates(swimModels.ListOptions{Query: expr})
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		var got []string
+		for _, u := range updates {
+			got = append(got, u.Domain)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s matched %v, want %v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// The DER of certificates is stored when swim reads the full CertStream feed. Leaf
+// certificates are kept in raw_certificates, the certificates of their chains once per
+// fingerprint in raw_chain_certificates: a few intermediates sign almost every leaf. Both
+// are deflate compressed. A leaf repeats much of its issuer (names, key identifier, URLs,
+// policies), so it is compressed with the DER of the first chain certificate as preset
+// dictionary, which makes it about a quarter smaller instead of a tenth.
+
+// rawSchema returns the statements creating the raw certificate tables, blob is the
+// binary column type of the dialect
+func rawSchema(blob string) []string {
+	return []string{
+		`CREATE TABLE raw_certificates (
+            fingerprint TEXT PRIMARY KEY,
+            der ` + blob + ` NOT NULL,
+            chain TEXT NOT NULL DEFAULT ''
+        )`,
+		`CREATE TABLE raw_chain_certificates (
+            fingerprint TEXT PRIMARY KEY,
+            der ` + blob + ` NOT NULL
+        )`,
+	}
+}
+
+// dropRaw reverts rawSchema
+var dropRaw = []string{
+	`DROP TABLE raw_chain_certificates`,
+	`DROP TABLE raw_certificates`,
+}
+
+// rawRow is a compressed certificate, chain lists the fingerprints of the chain of a leaf
+type rawRow struct {
+	fingerprint string
+	der         []byte
+	chain       string
+}
+
+// rawFingerprint returns the SHA-1 fingerprint of der in the format CertStream uses,
+// upper case hex bytes separated by colons
+func rawFingerprint(der []byte) string {
+	sum := sha1.Sum(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// compressDER deflates der, with dict as preset dictionary if it is not nil
+func compressDER(der, dict []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(der); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressDER inflates what compressDER wrote with the same dictionary
+func decompressDER(data, dict []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), dict)
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// prepareRaw compresses the DER of the certificates of a batch that carry it, and of the
+// chain certificates they refer to, once per fingerprint
+func prepareRaw(certs []swimModels.CertUpdateInfo) (raw, chain []rawRow, err error) {
+	chainSeen := make(map[string]bool)
+	for _, c := range certs {
+		if len(c.RawDER) == 0 {
+			continue
+		}
+
+		fingerprints := make([]string, len(c.RawChain))
+		for i, der := range c.RawChain {
+			fingerprints[i] = rawFingerprint(der)
+			if chainSeen[fingerprints[i]] {
+				continue
+			}
+			chainSeen[fingerprints[i]] = true
+			compressed, err := compressDER(der, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			chain = append(chain, rawRow{fingerprint: fingerprints[i], der: compressed})
+		}
+
+		var dict []byte
+		if len(c.RawChain) > 0 {
+			dict = c.RawChain[0]
+		}
+		compressed, err := compressDER(c.RawDER, dict)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = append(raw, rawRow{fingerprint: c.Fingerprint, der: compressed, chain: strings.Join(fingerprints, ",")})
+	}
+	return raw, chain, nil
+}
+
+// writeRaw inserts the compressed certificates of a batch, the chain certificates first
+func writeRaw(tx *sql.Tx, d dialect, raw, chain []rawRow) error {
+	err := upsertRows(tx, d, len(chain), 2, func(i int) []interface{} {
+		return []interface{}{chain[i].fingerprint, chain[i].der}
+	}, `INSERT INTO raw_chain_certificates (fingerprint, der) VALUES %s ON CONFLICT (fingerprint) DO NOTHING`)
+	if err != nil {
+		return fmt.Errorf("error storing chain certificates: %w", err)
+	}
+
+	err = upsertRows(tx, d, len(raw), 3, func(i int) []interface{} {
+		return []interface{}{raw[i].fingerprint, raw[i].der, raw[i].chain}
+	}, `INSERT INTO raw_certificates (fingerprint, der, chain) VALUES %s ON CONFLICT (fingerprint) DO NOTHING`)
+	if err != nil {
+		return fmt.Errorf("error storing raw certificates: %w", err)
+	}
+	return nil
+}
+
+// RawCertificate returns the DER of the certificate with the given fingerprint and of its
+// chain, nil if it was not stored
+func (s *SQLStore) RawCertificate(fingerprint string) (*swimModels.RawCertificate, error) {
+	var compressed []byte
+	var chain string
+	err := s.read.QueryRow(s.dialect.rebind("SELECT der, chain FROM raw_certificates WHERE fingerprint = ?"), fingerprint).Scan(&compressed, &chain)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading raw certificate: %w", err)
+	}
+
+	cert := &swimModels.RawCertificate{Fingerprint: fingerprint}
+	if chain != "" {
+		fingerprints := strings.Split(chain, ",")
+		args := make([]interface{}, len(fingerprints))
+		for i, f := range fingerprints {
+			args[i] = f
+		}
+		rows, err := s.read.Query(s.dialect.rebind("SELECT fingerprint, der FROM raw_chain_certificates WHERE fingerprint IN ("+placeholders(len(args))+")"), args...)
+		if err != nil {
+			return nil, fmt.Errorf("error reading chain certificates: %w", err)
+		}
+		defer rows.Close()
+
+		ders := make(map[string][]byte, len(fingerprints))
+		for rows.Next() {
+			var f string
+			var data []byte
+			if err := rows.Scan(&f, &data); err != nil {
+				return nil, err
+			}
+			if ders[f], err = decompressDER(data, nil); err != nil {
+				return nil, fmt.Errorf("error decompressing chain certificate %s: %w", f, err)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, f := range fingerprints {
+			der, ok := ders[f]
+			if !ok {
+				return nil, fmt.Errorf("chain certificate %s of %s is missing", f, fingerprint)
+			}
+			cert.Chain = append(cert.Chain, der)
+		}
+	}
+
+	var dict []byte
+	if len(cert.Chain) > 0 {
+		dict = cert.Chain[0]
+	}
+	if cert.DER, err = decompressDER(compressed, dict); err != nil {
+		return nil, fmt.Errorf("error decompressing raw certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+func TestRawCertificate(t *testing.T) {
+	s := openTestStore(t)
+
+	// random DER, a leaf repeats much of its issuer so it shares bytes with it
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	issuer, root := random(600), random(500)
+	leaf := append(append([]byte{}, issuer[:400]...), random(200)...)
+	other := append(append([]byte{}, issuer[100:500]...), random(100)...)
+	unchained := random(300)
+
+	chain := [][]byte{issuer, root}
+	cert := func(name, fingerprint string, der []byte, chain [][]byte) swimModels.CertUpdateInfo {
+		return swimModels.CertUpdateInfo{Domain: name, Fingerprint: fingerprint, NotBefore: testStart, NotAfter: testStart + 86400, Seen: testStart, RawDER: der, RawChain: chain}
+	}
+	err := s.InsertBatch([]swimModels.CertUpdateInfo{
+		cert("leaf.example.com", "AA", leaf, chain),
+		cert("www.leaf.example.com", "AA", leaf, chain),
+		cert("other.example.com", "BB", other, chain),
+		cert("unchained.example.com", "CC", unchained, nil),
+		cert("unstored.example.com", "DD", nil, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		fingerprint string
+		der         []byte
+		chain       [][]byte
+	}{
+		{"AA", leaf, chain},
+		{"BB", other, chain},
+		{"CC", unchained, nil},
+	} {
+		got, err := s.RawCertificate(test.fingerprint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || !bytes.Equal(got.DER, test.der) || len(got.Chain) != len(test.chain) {
+			t.Fatalf("RawCertificate(%s) = %+v, want its DER and %d chain certificates", test.fingerprint, got, len(test.chain))
+		}
+		for i := range test.chain {
+			if !bytes.Equal(got.Chain[i], test.chain[i]) {
+				t.Errorf("RawCertificate(%s) chain certificate %d differs", test.fingerprint, i)
+			}
+		}
+	}
+
+	// chain certificates are stored once
+	var n int
+	if err := s.read.QueryRow(`SELECT COUNT(*) FROM raw_chain_certificates`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d chain certificates stored, want 2", n)
+	}
+
+	// the leaf is compressed with its issuer as dictionary, it can't be read without it
+	var stored []byte
+	if err := s.read.QueryRow(`SELECT der FROM raw_certificates WHERE fingerprint = 'AA'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if der, err := decompressDER(stored, nil); err == nil && bytes.Equal(der, leaf) {
+		t.Error("leaf was compressed without its issuer as dictionary")
+	}
+	if len(stored) >= len(leaf)-300 {
+		t.Errorf("leaf compressed to %d of %d bytes, the bytes shared with its issuer were not left out", len(stored), len(leaf))
+	}
+
+	for _, fingerprint := range []string{"DD", "EE"} {
+		if got, err := s.RawCertificate(fingerprint); got != nil || err != nil {
+			t.Errorf("RawCertificate(%s) = %+v, %v, want nil", fingerprint, got, err)
+		}
+	}
+
+	// a chain certificate gone missing is an error, not a certificate without chain
+	if _, err := s.write.Exec(`DELETE FROM raw_chain_certificates WHERE fingerprint = ?`, rawFingerprint(root)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RawCertificate("AA"); err == nil || !strings.Contains(err.Error(), "is missing") {
+		t.Errorf("RawCertificate(AA) without its root returned %v, want a missing chain certificate error", err)
+	}
+	if got, err := s.RawCertificate("CC"); err != nil || got == nil {
+		t.Errorf("RawCertificate(CC) = %+v, %v, want the certificate", got, err)
+	}
+}
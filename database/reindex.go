@@ -0,0 +1,147 @@
+package database
+
+import (
+	"fmt"
+)
+
+// ReindexProgress reports how far a reindex run has got
+type ReindexProgress struct {
+	Total   int64 // rows in the table when the run started
+	Scanned int64 // rows looked at so far
+	Updated int64 // rows whose derived columns changed
+}
+
+// Reindex recomputes the derived columns (is_apex, parent_domain, reversed) of every stored name.
+// rows are walked in id order, chunkSize at a time, and every chunk is written in its own
+// short transaction so that the insert worker can keep committing batches in between.
+// progress, if not nil, is called after every chunk.
+func (s *SQLStore) Reindex(chunkSize int, progress func(ReindexProgress)) (ReindexProgress, error) {
+	var p ReindexProgress
+	if chunkSize <= 0 {
+		return p, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	if err := s.write.QueryRow("SELECT COUNT(*) FROM names").Scan(&p.Total); err != nil {
+		return p, fmt.Errorf("error counting names: %w", err)
+	}
+
+	var lastID int64
+	for {
+		chunk, err := fetchReindexChunk(s.write, s.dialect, lastID, chunkSize)
+		if err != nil {
+			return p, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+
+		updated, err := s.reindexChunk(chunk)
+		if err != nil {
+			return p, err
+		}
+
+		lastID = chunk[len(chunk)-1].id
+		p.Scanned += int64(len(chunk))
+		p.Updated += updated
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	return p, nil
+}
+
+type reindexRow struct {
+	id     int64
+	domain string
+}
+
+// fetchReindexChunk reads the next chunk of rows after lastID
+func fetchReindexChunk(q queryer, d dialect, lastID int64, chunkSize int) ([]reindexRow, error) {
+	rows, err := q.Query(d.rebind("SELECT id, name FROM names WHERE id > ? ORDER BY id LIMIT ?"), lastID, chunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("error reading names: %w", err)
+	}
+	defer rows.Close()
+
+	var chunk []reindexRow
+	for rows.Next() {
+		var r reindexRow
+		if err := rows.Scan(&r.id, &r.domain); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		chunk = append(chunk, r)
+	}
+
+	return chunk, rows.Err()
+}
+
+// reindexChunk rewrites the derived columns of a chunk, touching only rows that are stale,
+// and moves the apex domain total along
+func (s *SQLStore) reindexChunk(chunk []reindexRow) (int64, error) {
+	tx, err := s.write.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// the apex domain total follows the names whose is_apex flips. SQLite can't return the
+	// old values of an update, they are read first; the writers never change is_apex.
+	wasApex := make(map[int64]bool, len(chunk))
+	rows, err := tx.Query(s.dialect.rebind("SELECT id, is_apex FROM names WHERE id BETWEEN ? AND ?"), chunk[0].id, chunk[len(chunk)-1].id)
+	if err != nil {
+		return 0, fmt.Errorf("error reading names: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		var isApex bool
+		if err := rows.Scan(&id, &isApex); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning row: %w", err)
+		}
+		wasApex[id] = isApex
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error reading names: %w", err)
+	}
+
+	stmt, err := tx.Prepare(s.dialect.rebind("UPDATE names SET is_apex = ?, parent_domain = ?, reversed = ? WHERE id = ? AND (is_apex IS DISTINCT FROM ? OR parent_domain IS DISTINCT FROM ? OR reversed IS DISTINCT FROM ?)"))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var updated, apexes int64
+	for _, r := range chunk {
+		isApex := isApexDomain(r.domain)
+		parentDomain := getParentDomain(r.domain)
+		reversed := reverseLabels(r.domain)
+
+		res, err := stmt.Exec(isApex, parentDomain, reversed, r.id, isApex, parentDomain, reversed)
+		if err != nil {
+			return 0, fmt.Errorf("error updating %s: %w", r.domain, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		updated += n
+		if n > 0 && isApex != wasApex[r.id] {
+			if isApex {
+				apexes++
+			} else {
+				apexes--
+			}
+		}
+	}
+	if err := addTotals(tx, s.dialect, 0, apexes, 0); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"testing"
+)
+
+// staleNames stores the names of 40 certificates and makes the derived columns of some of
+// them stale, like names of a database older than the code deriving them: apex domains 0
+// and 1 lose their is_apex flag and www of apex domain 2 gets one, the names below apex
+// domain 2 a wrong parent and reversed key. The totals count the stale flags, as a migration
+// would. It returns the names made stale.
+func staleNames(t *testing.T, s *SQLStore) []string {
+	t.Helper()
+	insertCerts(t, s, 40, 4, 40)
+
+	apexes, www := []string{testApex(0, 4), testApex(1, 4)}, "www."+testApex(2, 4)
+	stale := apexes
+	for _, stmt := range []string{
+		`UPDATE names SET is_apex = false WHERE name IN ('` + apexes[0] + `', '` + apexes[1] + `')`,
+		`UPDATE names SET is_apex = true WHERE name = '` + www + `'`,
+		`UPDATE names SET parent_domain = 'example.com', reversed = 'com.example' WHERE parent_domain = '` + testApex(2, 4) + `'`,
+		`UPDATE rollup_totals SET apex_domains = (SELECT COUNT(*) FROM names WHERE is_apex = true)`,
+	} {
+		if _, err := s.write.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := s.read.Query(`SELECT name FROM names WHERE parent_domain = 'example.com' ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		stale = append(stale, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return stale
+}
+
+func TestReindexTotals(t *testing.T) {
+	s := openTestStore(t)
+	staleNames(t, s)
+	assertTotals(t, s)
+
+	if _, err := s.Reindex(7, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertTotals(t, s)
+}
+
+func TestReindex(t *testing.T) {
+	s := openTestStore(t)
+	stale := staleNames(t, s)
+
+	var runs []ReindexProgress
+	p, err := s.Reindex(7, func(p ReindexProgress) { runs = append(runs, p) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Total != 76 || p.Scanned != p.Total || p.Updated != int64(len(stale)) {
+		t.Errorf("reindex scanned %d of %d names and updated %d, want all 76 and %d updated", p.Scanned, p.Total, p.Updated, len(stale))
+	}
+
+	// progress is reported after every chunk of 7 names
+	if len(runs) != 11 {
+		t.Fatalf("progress was reported %d times, want 11", len(runs))
+	}
+	for i, run := range runs {
+		if want := min(int64(7*(i+1)), p.Total); run.Scanned != want || run.Total != p.Total {
+			t.Errorf("progress %d: %d/%d names scanned, want %d/%d", i, run.Scanned, run.Total, want, p.Total)
+		}
+	}
+
+	for _, name := range stale {
+		var isApex bool
+		var parent, reversed string
+		if err := s.read.QueryRow(`SELECT is_apex, parent_domain, reversed FROM names WHERE name = ?`, name).Scan(&isApex, &parent, &reversed); err != nil {
+			t.Fatal(err)
+		}
+		if isApex != isApexDomain(name) || parent != getParentDomain(name) || reversed != reverseLabels(name) {
+			t.Errorf("%s was reindexed to is_apex %v, parent %q, reversed %q", name, isApex, parent, reversed)
+		}
+	}
+
+	// nothing is stale anymore
+	p, err = s.Reindex(100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Updated != 0 {
+		t.Errorf("second reindex updated %d names, want 0", p.Updated)
+	}
+}
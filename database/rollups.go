@@ -0,0 +1,472 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// The rollup tables count what was ingested per hour, in total and per top level domain
+// and issuer, so statistics over a time range don't have to scan the sightings. The
+// writer adds the counts of a batch in the transaction that stores it. They are not
+// touched by the retention janitor, and stay when the sightings they count are pruned.
+//
+// The rollup_totals row counts the names, apex domains and certificates stored, so the
+// totals of the statistics don't have to count them. Unlike the other rollups, it is
+// kept in step with the data: the writer adds to it and the janitor and archiver take
+// off what they delete, in the same transactions.
+//
+// A certificate counts in the hour it was first seen, a sighting (a certificate linked
+// to a name) in the hour of its certificate like the seen column of certificate_names,
+// and a new name in the hour of its first sighting.
+
+// rollupSchema creates the rollup tables and the certificates.issuer column. tld is the
+// SQL expression extracting the top level domain from the reversed label key of a name.
+func rollupSchema(tld string) []string {
+	hour := func(col string) string { return "(" + col + " / 3600) * 3600" }
+	return []string{
+		`ALTER TABLE certificates ADD COLUMN issuer TEXT`,
+		`CREATE TABLE rollup_hourly (
+            hour BIGINT PRIMARY KEY,
+            certificates BIGINT NOT NULL DEFAULT 0,
+            sightings BIGINT NOT NULL DEFAULT 0,
+            new_names BIGINT NOT NULL DEFAULT 0,
+            new_apexes BIGINT NOT NULL DEFAULT 0,
+            wildcards BIGINT NOT NULL DEFAULT 0
+        )`,
+		`CREATE TABLE rollup_tld (
+            hour BIGINT NOT NULL,
+            tld TEXT NOT NULL,
+            sightings BIGINT NOT NULL DEFAULT 0,
+            new_names BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (hour, tld)
+        )`,
+		`CREATE TABLE rollup_issuer (
+            hour BIGINT NOT NULL,
+            issuer TEXT NOT NULL,
+            certificates BIGINT NOT NULL DEFAULT 0,
+            sightings BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (hour, issuer)
+        )`,
+		// the issuer of stored certificates is unknown, so only the other rollups are filled in
+		`INSERT INTO rollup_hourly (hour, certificates)
+         SELECT ` + hour("seen") + `, COUNT(*) FROM certificates WHERE seen IS NOT NULL GROUP BY 1`,
+		`INSERT INTO rollup_hourly (hour, sightings, wildcards)
+         SELECT ` + hour("seen") + `, COUNT(*), SUM(CASE WHEN wildcard THEN 1 ELSE 0 END) FROM certificate_names WHERE seen IS NOT NULL GROUP BY 1
+         ON CONFLICT (hour) DO UPDATE SET sightings = excluded.sightings, wildcards = excluded.wildcards`,
+		`INSERT INTO rollup_hourly (hour, new_names, new_apexes)
+         SELECT ` + hour("first_seen") + `, COUNT(*), SUM(CASE WHEN is_apex THEN 1 ELSE 0 END) FROM names WHERE first_seen IS NOT NULL GROUP BY 1
+         ON CONFLICT (hour) DO UPDATE SET new_names = excluded.new_names, new_apexes = excluded.new_apexes`,
+		`INSERT INTO rollup_tld (hour, tld, sightings)
+         SELECT ` + hour("cn.seen") + `, ` + tld + `, COUNT(*) FROM certificate_names cn JOIN names n ON n.id = cn.name_id WHERE cn.seen IS NOT NULL GROUP BY 1, 2`,
+		`INSERT INTO rollup_tld (hour, tld, new_names)
+         SELECT ` + hour("n.first_seen") + `, ` + tld + `, COUNT(*) FROM names n WHERE n.first_seen IS NOT NULL GROUP BY 1, 2
+         ON CONFLICT (hour, tld) DO UPDATE SET new_names = excluded.new_names`,
+	}
+}
+
+// dropRollups reverts rollupSchema
+var dropRollups = []string{
+	`DROP TABLE rollup_issuer`,
+	`DROP TABLE rollup_tld`,
+	`DROP TABLE rollup_hourly`,
+	`ALTER TABLE certificates DROP COLUMN issuer`,
+}
+
+// totalsSchema creates the rollup_totals row, counting what is already stored
+var totalsSchema = []string{
+	`CREATE TABLE rollup_totals (
+        id INTEGER PRIMARY KEY CHECK (id = 1),
+        names BIGINT NOT NULL,
+        apex_domains BIGINT NOT NULL,
+        certificates BIGINT NOT NULL
+    )`,
+	`INSERT INTO rollup_totals (id, names, apex_domains, certificates)
+     SELECT 1, (SELECT COUNT(*) FROM names), (SELECT COUNT(*) FROM names WHERE is_apex = true), (SELECT COUNT(*) FROM certificates)`,
+}
+
+// dropTotals reverts totalsSchema
+var dropTotals = []string{
+	`DROP TABLE rollup_totals`,
+}
+
+// addTotals adds to the counts of the rollup_totals row, negative counts for deletions
+func addTotals(tx *sql.Tx, d dialect, names, apexes, certificates int64) error {
+	if names == 0 && apexes == 0 && certificates == 0 {
+		return nil
+	}
+	_, err := tx.Exec(d.rebind(`UPDATE rollup_totals SET names = names + ?, apex_domains = apex_domains + ?, certificates = certificates + ? WHERE id = 1`),
+		names, apexes, certificates)
+	if err != nil {
+		return fmt.Errorf("error updating totals: %w", err)
+	}
+	return nil
+}
+
+// hourOf returns the start of the hour containing the unix time ts
+func hourOf(ts int64) int64 {
+	return ts - ts%3600
+}
+
+// topLevelDomain returns the last label of name
+func topLevelDomain(name string) string {
+	return name[strings.LastIndexByte(name, '.')+1:]
+}
+
+type hourlyCounts struct{ certificates, sightings, newNames, newApexes, wildcards int64 }
+
+type tldKey struct {
+	hour int64
+	tld  string
+}
+
+type tldCounts struct{ sightings, newNames int64 }
+
+type issuerKey struct {
+	hour   int64
+	issuer string
+}
+
+type issuerCounts struct{ certificates, sightings int64 }
+
+// rollup collects the rollup counts of a batch while it is written
+type rollup struct {
+	hourly  map[int64]*hourlyCounts
+	tlds    map[tldKey]*tldCounts
+	issuers map[issuerKey]*issuerCounts
+}
+
+func newRollup() *rollup {
+	return &rollup{
+		hourly:  make(map[int64]*hourlyCounts),
+		tlds:    make(map[tldKey]*tldCounts),
+		issuers: make(map[issuerKey]*issuerCounts),
+	}
+}
+
+func (r *rollup) hour(ts int64) *hourlyCounts {
+	h := hourOf(ts)
+	c, ok := r.hourly[h]
+	if !ok {
+		c = &hourlyCounts{}
+		r.hourly[h] = c
+	}
+	return c
+}
+
+func (r *rollup) tld(ts int64, name string) *tldCounts {
+	key := tldKey{hourOf(ts), topLevelDomain(name)}
+	c, ok := r.tlds[key]
+	if !ok {
+		c = &tldCounts{}
+		r.tlds[key] = c
+	}
+	return c
+}
+
+// issuer returns the counts of issuer, nil for certificates without one
+func (r *rollup) issuer(ts int64, issuer string) *issuerCounts {
+	if issuer == "" {
+		return nil
+	}
+	key := issuerKey{hourOf(ts), issuer}
+	c, ok := r.issuers[key]
+	if !ok {
+		c = &issuerCounts{}
+		r.issuers[key] = c
+	}
+	return c
+}
+
+// certificate counts a certificate stored for the first time
+func (r *rollup) certificate(seen int64, issuer string) {
+	r.hour(seen).certificates++
+	if c := r.issuer(seen, issuer); c != nil {
+		c.certificates++
+	}
+}
+
+// name counts a name stored for the first time
+func (r *rollup) name(seen int64, name string, apex bool) {
+	h := r.hour(seen)
+	h.newNames++
+	if apex {
+		h.newApexes++
+	}
+	r.tld(seen, name).newNames++
+}
+
+// sighting counts a certificate newly linked to a name
+func (r *rollup) sighting(seen int64, name, issuer string, wildcard bool) {
+	h := r.hour(seen)
+	h.sightings++
+	if wildcard {
+		h.wildcards++
+	}
+	r.tld(seen, name).sightings++
+	if c := r.issuer(seen, issuer); c != nil {
+		c.sightings++
+	}
+}
+
+// write adds the collected counts to the rollup tables. Rows are upserted in key order,
+// and the totals row last, so concurrent writers lock them in the same order.
+func (r *rollup) write(tx *sql.Tx, d dialect) error {
+	hours := make([]int64, 0, len(r.hourly))
+	for h := range r.hourly {
+		hours = append(hours, h)
+	}
+	sort.Slice(hours, func(i, j int) bool { return hours[i] < hours[j] })
+	err := upsertRows(tx, d, len(hours), 6, func(i int) []interface{} {
+		c := r.hourly[hours[i]]
+		return []interface{}{hours[i], c.certificates, c.sightings, c.newNames, c.newApexes, c.wildcards}
+	}, `INSERT INTO rollup_hourly (hour, certificates, sightings, new_names, new_apexes, wildcards) VALUES %s
+        ON CONFLICT (hour) DO UPDATE SET certificates = rollup_hourly.certificates + excluded.certificates, sightings = rollup_hourly.sightings + excluded.sightings,
+            new_names = rollup_hourly.new_names + excluded.new_names, new_apexes = rollup_hourly.new_apexes + excluded.new_apexes, wildcards = rollup_hourly.wildcards + excluded.wildcards`)
+	if err != nil {
+		return fmt.Errorf("error updating hourly rollup: %w", err)
+	}
+
+	tlds := make([]tldKey, 0, len(r.tlds))
+	for key := range r.tlds {
+		tlds = append(tlds, key)
+	}
+	sort.Slice(tlds, func(i, j int) bool {
+		if tlds[i].hour != tlds[j].hour {
+			return tlds[i].hour < tlds[j].hour
+		}
+		return tlds[i].tld < tlds[j].tld
+	})
+	err = upsertRows(tx, d, len(tlds), 4, func(i int) []interface{} {
+		c := r.tlds[tlds[i]]
+		return []interface{}{tlds[i].hour, tlds[i].tld, c.sightings, c.newNames}
+	}, `INSERT INTO rollup_tld (hour, tld, sightings, new_names) VALUES %s
+        ON CONFLICT (hour, tld) DO UPDATE SET sightings = rollup_tld.sightings + excluded.sightings, new_names = rollup_tld.new_names + excluded.new_names`)
+	if err != nil {
+		return fmt.Errorf("error updating tld rollup: %w", err)
+	}
+
+	issuers := make([]issuerKey, 0, len(r.issuers))
+	for key := range r.issuers {
+		issuers = append(issuers, key)
+	}
+	sort.Slice(issuers, func(i, j int) bool {
+		if issuers[i].hour != issuers[j].hour {
+			return issuers[i].hour < issuers[j].hour
+		}
+		return issuers[i].issuer < issuers[j].issuer
+	})
+	err = upsertRows(tx, d, len(issuers), 4, func(i int) []interface{} {
+		c := r.issuers[issuers[i]]
+		return []interface{}{issuers[i].hour, issuers[i].issuer, c.certificates, c.sightings}
+	}, `INSERT INTO rollup_issuer (hour, issuer, certificates, sightings) VALUES %s
+        ON CONFLICT (hour, issuer) DO UPDATE SET certificates = rollup_issuer.certificates + excluded.certificates, sightings = rollup_issuer.sightings + excluded.sightings`)
+	if err != nil {
+		return fmt.Errorf("error updating issuer rollup: %w", err)
+	}
+
+	var names, apexes, certificates int64
+	for _, c := range r.hourly {
+		names += c.newNames
+		apexes += c.newApexes
+		certificates += c.certificates
+	}
+	return addTotals(tx, d, names, apexes, certificates)
+}
+
+// upsertRows runs query, whose VALUES list is left as %s, for n rows of cols columns in
+// statements of at most maxRowsPerStatement rows. row returns the values of row i.
+func upsertRows(tx *sql.Tx, d dialect, n, cols int, row func(i int) []interface{}, query string) error {
+	for start := 0; start < n; start += maxRowsPerStatement {
+		end := min(start+maxRowsPerStatement, n)
+		args := make([]interface{}, 0, (end-start)*cols)
+		for i := start; i < end; i++ {
+			args = append(args, row(i)...)
+		}
+		if _, err := tx.Exec(d.rebind(fmt.Sprintf(query, valuesList(end-start, cols))), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hourRange returns the conditions restricting rollup rows to the hours overlapping
+// [opts.Since, opts.Until)
+func hourRange(opts swimModels.StatsOptions) ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if opts.Since > 0 {
+		conds = append(conds, "hour >= ?")
+		args = append(args, hourOf(opts.Since))
+	}
+	if opts.Until > 0 {
+		conds = append(conds, "hour < ?")
+		args = append(args, opts.Until)
+	}
+	return conds, args
+}
+
+// rollupStats reads the rollups of the hours selected by opts. The top level domains and
+// issuers are ordered by their number of sightings, and limited to opts.Top if it is set.
+func (s *SQLStore) rollupStats(stats *swimModels.Stats, opts swimModels.StatsOptions) error {
+	conds, args := hourRange(opts)
+
+	rows, err := s.read.Query(s.dialect.rebind("SELECT hour, certificates, sightings, new_names, new_apexes, wildcards FROM rollup_hourly "+where(conds)+"ORDER BY hour"), args...)
+	if err != nil {
+		return fmt.Errorf("error reading hourly rollup: %w", err)
+	}
+	defer rows.Close()
+	stats.Hourly = []swimModels.HourlyStats{}
+	for rows.Next() {
+		var h swimModels.HourlyStats
+		if err := rows.Scan(&h.Hour, &h.Certificates, &h.Sightings, &h.NewNames, &h.NewApexes, &h.Wildcards); err != nil {
+			return err
+		}
+		stats.Hourly = append(stats.Hourly, h)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	limit := ""
+	if opts.Top > 0 {
+		limit = fmt.Sprintf(" LIMIT %d", opts.Top)
+	}
+
+	rows, err = s.read.Query(s.dialect.rebind("SELECT tld, SUM(sightings), SUM(new_names) FROM rollup_tld "+where(conds)+"GROUP BY tld ORDER BY 2 DESC, tld"+limit), args...)
+	if err != nil {
+		return fmt.Errorf("error reading tld rollup: %w", err)
+	}
+	defer rows.Close()
+	stats.TLDs = []swimModels.TLDStats{}
+	for rows.Next() {
+		var t swimModels.TLDStats
+		if err := rows.Scan(&t.TLD, &t.Sightings, &t.NewNames); err != nil {
+			return err
+		}
+		stats.TLDs = append(stats.TLDs, t)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = s.read.Query(s.dialect.rebind("SELECT issuer, SUM(certificates), SUM(sightings) FROM rollup_issuer "+where(conds)+"GROUP BY issuer ORDER BY 3 DESC, issuer"+limit), args...)
+	if err != nil {
+		return fmt.Errorf("error reading issuer rollup: %w", err)
+	}
+	defer rows.Close()
+	stats.Issuers = []swimModels.IssuerStats{}
+	for rows.Next() {
+		var i swimModels.IssuerStats
+		if err := rows.Scan(&i.Issuer, &i.Certificates, &i.Sightings); err != nil {
+			return err
+		}
+		stats.Issuers = append(stats.Issuers, i)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	finishStats(stats, opts)
+	return nil
+}
+
+// mergeRollups adds the rollups of several stores into stats, then orders and limits them
+// like rollupStats does
+func mergeRollups(stats *swimModels.Stats, results []*swimModels.Stats, opts swimModels.StatsOptions) {
+	hourly := make(map[int64]*swimModels.HourlyStats)
+	tlds := make(map[string]*swimModels.TLDStats)
+	issuers := make(map[string]*swimModels.IssuerStats)
+	for _, result := range results {
+		for _, h := range result.Hourly {
+			m, ok := hourly[h.Hour]
+			if !ok {
+				m = &swimModels.HourlyStats{Hour: h.Hour}
+				hourly[h.Hour] = m
+			}
+			m.Certificates += h.Certificates
+			m.Sightings += h.Sightings
+			m.NewNames += h.NewNames
+			m.NewApexes += h.NewApexes
+			m.Wildcards += h.Wildcards
+		}
+		for _, t := range result.TLDs {
+			m, ok := tlds[t.TLD]
+			if !ok {
+				m = &swimModels.TLDStats{TLD: t.TLD}
+				tlds[t.TLD] = m
+			}
+			m.Sightings += t.Sightings
+			m.NewNames += t.NewNames
+		}
+		for _, i := range result.Issuers {
+			m, ok := issuers[i.Issuer]
+			if !ok {
+				m = &swimModels.IssuerStats{Issuer: i.Issuer}
+				issuers[i.Issuer] = m
+			}
+			m.Certificates += i.Certificates
+			m.Sightings += i.Sightings
+		}
+	}
+
+	stats.Hourly = make([]swimModels.HourlyStats, 0, len(hourly))
+	for _, h := range hourly {
+		stats.Hourly = append(stats.Hourly, *h)
+	}
+	sort.Slice(stats.Hourly, func(i, j int) bool { return stats.Hourly[i].Hour < stats.Hourly[j].Hour })
+
+	stats.TLDs = make([]swimModels.TLDStats, 0, len(tlds))
+	for _, t := range tlds {
+		stats.TLDs = append(stats.TLDs, *t)
+	}
+	sort.Slice(stats.TLDs, func(i, j int) bool {
+		a, b := stats.TLDs[i], stats.TLDs[j]
+		if a.Sightings != b.Sightings {
+			return a.Sightings > b.Sightings
+		}
+		return a.TLD < b.TLD
+	})
+
+	stats.Issuers = make([]swimModels.IssuerStats, 0, len(issuers))
+	for _, i := range issuers {
+		stats.Issuers = append(stats.Issuers, *i)
+	}
+	sort.Slice(stats.Issuers, func(i, j int) bool {
+		a, b := stats.Issuers[i], stats.Issuers[j]
+		if a.Sightings != b.Sightings {
+			return a.Sightings > b.Sightings
+		}
+		return a.Issuer < b.Issuer
+	})
+
+	if opts.Top > 0 {
+		stats.TLDs = stats.TLDs[:min(opts.Top, len(stats.TLDs))]
+		stats.Issuers = stats.Issuers[:min(opts.Top, len(stats.Issuers))]
+	}
+
+	finishStats(stats, opts)
+}
+
+// finishStats adds up the totals of the hourly rollup and formats the times of stats
+func finishStats(stats *swimModels.Stats, opts swimModels.StatsOptions) {
+	stats.Totals = swimModels.HourlyStats{}
+	for i, h := range stats.Hourly {
+		stats.Hourly[i].HourTime = time.Unix(h.Hour, 0).UTC().Format(time.RFC3339)
+		stats.Totals.Certificates += h.Certificates
+		stats.Totals.Sightings += h.Sightings
+		stats.Totals.NewNames += h.NewNames
+		stats.Totals.NewApexes += h.NewApexes
+		stats.Totals.Wildcards += h.Wildcards
+	}
+	if opts.Since > 0 {
+		stats.Since = time.Unix(hourOf(opts.Since), 0).UTC().Format(time.RFC3339)
+	}
+	if opts.Until > 0 {
+		stats.Until = time.Unix(opts.Until, 0).UTC().Format(time.RFC3339)
+	}
+}
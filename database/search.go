@@ -0,0 +1,196 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// searchIndexChunk is the number of names added to a new search index per transaction
+const searchIndexChunk = 50000
+
+// The name search index of SQLite databases is a contentless FTS5 table with the trigram
+// tokenizer, keyed by the id of the name. FTS5 is only compiled into go-sqlite3 with the
+// sqlite_fts5 build tag, so the index is not part of the migrations: it is created when
+// a binary that supports it opens the database, and searches fall back to scanning the
+// names table without it. Names added by a binary without FTS5 are indexed on the next
+// start of one with it, deleted names are filtered out by joining the names table.
+
+// ftsAvailable reports whether the SQLite library supports FTS5
+func (s *SQLStore) ftsAvailable() (bool, error) {
+	var enabled bool
+	if err := s.read.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled); err != nil {
+		return false, fmt.Errorf("error checking for FTS5 support: %w", err)
+	}
+	return enabled, nil
+}
+
+// detectNameSearch enables the search index if the library supports it and it exists
+func (s *SQLStore) detectNameSearch() error {
+	if s.dialect != sqliteDialect {
+		return nil
+	}
+
+	available, err := s.ftsAvailable()
+	if err != nil || !available {
+		s.nameSearch = false
+		return err
+	}
+	s.nameSearch, err = tableExists(s.read, "names_fts")
+	return err
+}
+
+// ensureSearchIndex creates the name search index of a SQLite database if FTS5 is
+// available and adds the names it is missing
+func (s *SQLStore) ensureSearchIndex() error {
+	if s.dialect != sqliteDialect {
+		return nil
+	}
+
+	available, err := s.ftsAvailable()
+	if err != nil {
+		return err
+	}
+	if !available {
+		log.Println("SQLite was built without FTS5, name searches will scan the names table (build with -tags sqlite_fts5 to index them)")
+		s.nameSearch = false
+		return nil
+	}
+
+	_, err = s.write.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS names_fts USING fts5(name, content='', contentless_delete=1, tokenize='trigram')`)
+	if err != nil {
+		return fmt.Errorf("error creating name search index: %w", err)
+	}
+
+	// names are only ever added with increasing ids, so the ones missing are above the
+	// highest indexed id
+	var lastID, maxID int64
+	if err := s.write.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM names_fts").Scan(&lastID); err != nil {
+		return err
+	}
+	if err := s.write.QueryRow("SELECT COALESCE(MAX(id), 0) FROM names").Scan(&maxID); err != nil {
+		return err
+	}
+	if lastID < maxID {
+		log.Printf("Indexing names %d to %d for search", lastID+1, maxID)
+	}
+	for lastID < maxID {
+		if _, err := s.write.Exec("INSERT INTO names_fts (rowid, name) SELECT id, name FROM names WHERE id > ? AND id <= ?", lastID, lastID+searchIndexChunk); err != nil {
+			return fmt.Errorf("error indexing names: %w", err)
+		}
+		lastID += searchIndexChunk
+	}
+
+	s.nameSearch = true
+	return nil
+}
+
+// likeEscape escapes the wildcards of LIKE patterns in term, for use with ESCAPE '\'
+func likeEscape(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+}
+
+// prefixEnd returns the smallest string greater than every string starting with prefix,
+// so a prefix search can use the index on names.name
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0x7f {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return "\x7f"
+}
+
+// searchConditions builds the condition selecting the names matching query
+func (s *SQLStore) searchConditions(query swimModels.SearchQuery) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	var phrases []string // terms found through the search index
+
+	for _, term := range query.Terms {
+		switch query.Mode {
+		case "prefix":
+			// a range over the unique index of names.name, which compares bytes in SQLite
+			// but follows the collation in PostgreSQL, where the trigram index serves LIKE
+			if s.dialect == postgresDialect {
+				conds = append(conds, `n.name LIKE ? ESCAPE '\'`)
+				args = append(args, likeEscape(term)+"%")
+			} else {
+				conds = append(conds, "(n.name >= ? AND n.name < ?)")
+				args = append(args, term, prefixEnd(term))
+			}
+			continue
+		case "label":
+			// whole labels only: surround the name with dots and look for .term.
+			pattern := "%." + likeEscape(term) + ".%"
+			if s.nameSearch && len(term) >= 3 {
+				conds = append(conds, `(n.id IN (SELECT rowid FROM names_fts WHERE names_fts MATCH ?) AND ('.' || n.name || '.') LIKE ? ESCAPE '\')`)
+				args = append(args, ftsPhrase(term), pattern)
+			} else {
+				conds = append(conds, `('.' || n.name || '.') LIKE ? ESCAPE '\'`)
+				args = append(args, pattern)
+			}
+			continue
+		}
+
+		// the trigram index needs at least three characters
+		if s.nameSearch && len(term) >= 3 {
+			phrases = append(phrases, ftsPhrase(term))
+			continue
+		}
+		conds = append(conds, `n.name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscape(term)+"%")
+	}
+
+	if len(phrases) > 0 {
+		conds = append(conds, "n.id IN (SELECT rowid FROM names_fts WHERE names_fts MATCH ?)")
+		args = append(args, strings.Join(phrases, " OR "))
+	}
+
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// ftsPhrase quotes term as an FTS5 phrase, which the trigram tokenizer matches as substring
+func ftsPhrase(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
+
+// SearchNames returns a page of the names matching query
+func (s *SQLStore) SearchNames(query swimModels.SearchQuery, opts swimModels.ListOptions) ([]swimModels.Subdomain, error) {
+	if len(query.Terms) == 0 {
+		return nil, nil
+	}
+	order, err := orderBy(opts.Sort, opts.Desc)
+	if err != nil {
+		return nil, err
+	}
+
+	cond, args := s.searchConditions(query)
+	conds, rangeArgs := seenRange(opts, "n.first_seen", "n.last_seen")
+	conds = append([]string{cond}, conds...)
+	args = append(args, rangeArgs...)
+
+	rows, err := s.read.Query(s.dialect.rebind("SELECT n.name, COALESCE(n.first_seen, 0), COALESCE(n.last_seen, 0), n.cert_count FROM names n "+where(conds)+order+" "+limit(opts)), append(args, limitArgs(opts)...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []swimModels.Subdomain
+	for rows.Next() {
+		var name swimModels.Subdomain
+		if err := rows.Scan(&name.Name, &name.FirstSeen, &name.LastSeen, &name.CertCount); err != nil {
+			return nil, err
+		}
+		name.FirstSeenTime = time.Unix(name.FirstSeen, 0).Format(time.RFC3339)
+		name.LastSeenTime = time.Unix(name.LastSeen, 0).Format(time.RFC3339)
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
@@ -0,0 +1,221 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+const (
+	snapshotPrefix = "swim-"
+	// snapshotTimeLayout names snapshots, the milliseconds tell apart the snapshots taken in
+	// the same second. Snapshots of older versions were named without them, parsing with
+	// snapshotParseLayout accepts both.
+	snapshotTimeLayout  = "20060102T150405.000Z"
+	snapshotParseLayout = "20060102T150405Z"
+)
+
+// snapshotMu serializes snapshots, two at once would only compete for the disk
+var snapshotMu sync.Mutex
+
+// Snapshot writes a consistent copy of the database to dir with VACUUM INTO, which reads
+// through the read pool and leaves ingestion running. If keep is above 0 only the newest
+// keep snapshots in dir are kept.
+func (s *SQLStore) Snapshot(dir string, keep int) (*swimModels.Snapshot, error) {
+	if s.dialect == postgresDialect {
+		return nil, fmt.Errorf("snapshots of postgres databases are not supported, use pg_dump")
+	}
+
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating snapshot directory: %w", err)
+	}
+
+	created, path := snapshotPath(dir, ".db")
+	if err := vacuumInto(s.read, path); err != nil {
+		return nil, err
+	}
+
+	return finishSnapshot(dir, path, created, keep)
+}
+
+// Snapshot writes a consistent copy of every partition to a directory in dir. The partition
+// being written is copied with VACUUM INTO, sealed partitions never change and are hard
+// linked when dir is on the same file system. If keep is above 0 only the newest keep
+// snapshots in dir are kept.
+func (ps *PartitionedStore) Snapshot(dir string, keep int) (*swimModels.Snapshot, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	// no partition is sealed or deleted while the snapshot is taken
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	created, path := snapshotPath(dir, "")
+	tmp := path + ".tmp"
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, fmt.Errorf("error creating snapshot directory: %w", err)
+	}
+
+	for _, p := range ps.partitions {
+		target := filepath.Join(tmp, filepath.Base(p.path))
+		var err error
+		if p.sealed {
+			err = linkOrCopy(p.path, target)
+		} else {
+			err = vacuumInto(p.store.read, target)
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	return finishSnapshot(dir, path, created, keep)
+}
+
+// snapshotPath returns the time of a snapshot taken now and its path in dir, with the
+// extension ext. A snapshot already taken at that time moves the new one a millisecond
+// later, so no snapshot replaces another. snapshotMu must be held.
+func snapshotPath(dir, ext string) (time.Time, string) {
+	created := time.Now().UTC()
+	for {
+		path := filepath.Join(dir, snapshotPrefix+created.Format(snapshotTimeLayout)+ext)
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return created, path
+		}
+		created = created.Add(time.Millisecond)
+	}
+}
+
+// vacuumInto writes a compacted copy of the database behind db to path. The copy is made
+// under a temporary name, so a snapshot that exists is always complete.
+func vacuumInto(db *sql.DB, path string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if _, err := db.Exec("VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// linkOrCopy hard links src to dst, or copies it if linking is not possible
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error copying %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// finishSnapshot describes the snapshot at path and removes the snapshots beyond keep
+func finishSnapshot(dir, path string, created time.Time, keep int) (*swimModels.Snapshot, error) {
+	size, err := diskSize(path)
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := pruneSnapshots(dir, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Wrote snapshot %s (%d bytes)", path, size)
+	return &swimModels.Snapshot{
+		Path:    path,
+		Size:    size,
+		Created: created.Format(time.RFC3339),
+		Removed: removed,
+	}, nil
+}
+
+// diskSize returns the size of a file, or of all files below a directory
+func diskSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// pruneSnapshots deletes all but the newest keep snapshots in dir and returns their paths
+func pruneSnapshots(dir string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the timestamp in the name sorts snapshots from oldest to newest
+	type snapshot struct {
+		name    string
+		created time.Time
+	}
+	var snapshots []snapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		created, err := time.Parse(snapshotParseLayout, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), ".db"))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{name, created})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].created.Before(snapshots[j].created) })
+
+	var removed []string
+	for len(snapshots) > keep {
+		path := filepath.Join(dir, snapshots[0].name)
+		if err := os.RemoveAll(path); err != nil {
+			return removed, fmt.Errorf("error removing snapshot %s: %w", path, err)
+		}
+		removed = append(removed, path)
+		snapshots = snapshots[1:]
+	}
+	return removed, nil
+}
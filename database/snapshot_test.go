@@ -0,0 +1,104 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// snapshotNames returns the names of the files and directories in dir
+func snapshotNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// takeSnapshots takes three snapshots in a row keeping two of them, and checks that each
+// has its own name and that the oldest ones are removed
+func takeSnapshots(t *testing.T, s swimModels.Snapshotter, dir string) []*swimModels.Snapshot {
+	t.Helper()
+
+	// a snapshot named by an older version, and files that are no snapshots
+	old := filepath.Join(dir, snapshotPrefix+"20240101T000000Z.db")
+	for _, name := range []string{old, filepath.Join(dir, "swim-latest.db"), filepath.Join(dir, "notes.txt")} {
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var snapshots []*swimModels.Snapshot
+	for i := 0; i < 3; i++ {
+		snapshot, err := s.Snapshot(dir, 2)
+		if err != nil {
+			t.Fatalf("snapshot %d: %v", i, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	for i, want := range [][]string{{old}, {snapshots[0].Path}} {
+		if got := snapshots[i+1].Removed; !slices.Equal(got, want) {
+			t.Errorf("snapshot %d removed %v, want %v", i+1, got, want)
+		}
+	}
+	if snapshots[0].Removed != nil {
+		t.Errorf("snapshot 0 removed %v, want none", snapshots[0].Removed)
+	}
+
+	want := []string{"notes.txt", filepath.Base(snapshots[1].Path), filepath.Base(snapshots[2].Path), "swim-latest.db"}
+	slices.Sort(want)
+	if got := snapshotNames(t, dir); !slices.Equal(got, want) {
+		t.Errorf("snapshot directory holds %v, want %v", got, want)
+	}
+	return snapshots
+}
+
+func TestSnapshot(t *testing.T) {
+	s := openTestStore(t)
+	insertCerts(t, s, 20, 5, 20)
+	want, err := s.Stats(swimModels.StatsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots := takeSnapshots(t, s, t.TempDir())
+	for _, snapshot := range snapshots[1:] {
+		copied := openTestStoreAt(t, snapshot.Path)
+		got, err := copied.Stats(swimModels.StatsOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Names != want.Names || got.Certificates != want.Certificates {
+			t.Errorf("snapshot %s holds %d names and %d certificates, want %d and %d", snapshot.Path, got.Names, got.Certificates, want.Names, want.Certificates)
+		}
+	}
+}
+
+func TestPartitionedSnapshot(t *testing.T) {
+	ps, err := OpenPartitioned(t.TempDir(), "day", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if err := ps.SetupDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	insertCerts(t, ps, 20, 5, 20)
+
+	snapshots := takeSnapshots(t, ps, t.TempDir())
+	partition := filepath.Base(ps.current().path)
+	for _, snapshot := range snapshots[1:] {
+		if got := snapshotNames(t, snapshot.Path); !slices.Equal(got, []string{partition}) {
+			t.Errorf("snapshot %s holds %v, want %v", snapshot.Path, got, []string{partition})
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// SQLStore implements swimModels.Store on top of database/sql. It backs both the SQLite
+// and the PostgreSQL storage, queries are shared and rebound for the dialect.
+type SQLStore struct {
+	path    string // database file, sqlite only
+	write   *sql.DB
+	read    *sql.DB
+	dialect dialect
+	close   func() error
+
+	// partitions remembers the certificate_names partitions known to exist (postgres only)
+	partitions *partitionCache
+
+	// nameSearch is set when the names_fts search index is available (sqlite only)
+	nameSearch bool
+
+	// writers is the number of transactions batches are written with in parallel (postgres only)
+	writers int
+
+	// archive holds the sightings moved out of the database, nil unless archive search is enabled
+	archive *Archive
+}
+
+// NewSQLiteStore returns a store backed by the given SQLite database
+func NewSQLiteStore(db *DB) *SQLStore {
+	return &SQLStore{path: db.Path, write: db.Write, read: db.Read, dialect: sqliteDialect, close: db.Close}
+}
+
+// Close closes the underlying database
+func (s *SQLStore) Close() error {
+	return s.close()
+}
+
+// InsertBatch stores a batch of certificate updates in a single transaction, or in one
+// transaction per shard with parallel writers
+func (s *SQLStore) InsertBatch(batch []swimModels.CertUpdateInfo) error {
+	if s.partitions != nil {
+		if err := s.partitions.ensure(s.write, batch); err != nil {
+			return err
+		}
+	}
+
+	p, err := prepareBatch(batch)
+	if err != nil {
+		return fmt.Errorf("error compressing certificates: %w", err)
+	}
+	if s.writers > 1 {
+		return s.writeShards(p.shard(s.writers))
+	}
+	return s.writeTx(p)
+}
+
+// sortColumns maps the sort keys accepted by the API to the columns they order by. Names
+// stored before sightings were tracked have no first and last sighting, they are ordered
+// and paged through with cursors as seen at 0, the time they are listed with.
+var sortColumns = map[string]string{
+	"name":       "n.name",
+	"first_seen": "COALESCE(n.first_seen, 0)",
+	"last_seen":  "COALESCE(n.last_seen, 0)",
+}
+
+// orderBy builds an ORDER BY clause for one of the sortColumns, the name is always used as tie breaker
+func orderBy(sort string, desc bool) (string, error) {
+	if sort == "" {
+		sort = "name"
+	}
+	column, ok := sortColumns[sort]
+	if !ok {
+		return "", fmt.Errorf("unknown sort key %q", sort)
+	}
+
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+	if column == "n.name" {
+		return fmt.Sprintf("ORDER BY n.name %s", direction), nil
+	}
+	return fmt.Sprintf("ORDER BY %s %s, n.name %s", column, direction, direction), nil
+}
+
+// certSortColumns maps the sort keys only cert updates accept to the columns they order by,
+// sightings stored before their time was recorded count as seen at 0 like in sortColumns
+var certSortColumns = map[string]string{
+	"seen":       "COALESCE(cn.seen, 0)",
+	"not_before": "c.not_before",
+}
+
+// certOrderBy builds the ORDER BY clause of cert updates, which are ordered like names or
+// by one of the certSortColumns and the name. A name is listed once per certificate,
+// ordered by not_before and the fingerprint.
+func certOrderBy(sort string, desc bool) (string, error) {
+	column, ok := certSortColumns[sort]
+	if !ok {
+		order, err := orderBy(sort, desc)
+		if err != nil {
+			return "", err
+		}
+		return order + ", c.not_before, c.fingerprint ", nil
+	}
+
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("ORDER BY %s %s, n.name %s, c.not_before, c.fingerprint ", column, direction, direction), nil
+}
+
+// keysetColumn is a column of the order of a listing, value is the one of the last row of
+// the previous page
+type keysetColumn struct {
+	expr  string
+	desc  bool
+	value interface{}
+}
+
+// keyset returns the condition selecting the rows ordered after the last row of the
+// previous page, for an order by cols whose values are unique together. It is nested as
+// a >= ? AND (a > ? OR (b >= ? AND (b > ? OR c > ?))), so the leading column bounds an
+// index range scan.
+func keyset(cols []keysetColumn) (string, []interface{}) {
+	compare := func(c keysetColumn, inclusive bool) string {
+		op := ">"
+		if c.desc {
+			op = "<"
+		}
+		if inclusive {
+			op += "="
+		}
+		return c.expr + " " + op + " ?"
+	}
+
+	c := cols[0]
+	if len(cols) == 1 {
+		return compare(c, false), []interface{}{c.value}
+	}
+	rest, args := keyset(cols[1:])
+	return compare(c, true) + " AND (" + compare(c, false) + " OR (" + rest + "))", append([]interface{}{c.value, c.value}, args...)
+}
+
+// nameKeyset returns the keyset columns of listings of names ordered by orderBy, prefix is
+// the alias of the names table
+func nameKeyset(opts swimModels.ListOptions, prefix string) []keysetColumn {
+	var cols []keysetColumn
+	if opts.Sort == "first_seen" || opts.Sort == "last_seen" {
+		cols = append(cols, keysetColumn{"COALESCE(" + prefix + opts.Sort + ", 0)", opts.Desc, opts.After.Value})
+	}
+	return append(cols, keysetColumn{prefix + "name", opts.Desc, opts.After.Name})
+}
+
+// certKeyset returns the keyset columns of cert updates ordered by certOrderBy
+func certKeyset(opts swimModels.ListOptions) []keysetColumn {
+	var cols []keysetColumn
+	if column, ok := certSortColumns[opts.Sort]; ok {
+		cols = append(cols, keysetColumn{column, opts.Desc, opts.After.Value})
+	}
+	return append(append(cols, nameKeyset(opts, "n.")...),
+		keysetColumn{"c.not_before", false, opts.After.NotBefore},
+		keysetColumn{"c.fingerprint", false, opts.After.Fingerprint})
+}
+
+// seenRange returns the conditions restricting rows to the sightings between opts.Since
+// and opts.Until. firstCol and lastCol hold the first and last sighting of a row.
+func seenRange(opts swimModels.ListOptions, firstCol, lastCol string) ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if opts.Since > 0 {
+		conds = append(conds, lastCol+" >= ?")
+		args = append(args, opts.Since)
+	}
+	if opts.Until > 0 {
+		conds = append(conds, firstCol+" < ?")
+		args = append(args, opts.Until)
+	}
+	return conds, args
+}
+
+// where joins conds into a WHERE clause, empty if there are none
+func where(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conds, " AND ") + " "
+}
+
+// limit returns the LIMIT clause of a page of opts, keyset pages start after their cursor
+// instead of at an offset. A size of 0 lists everything, pages before the first are the
+// first.
+func limit(opts swimModels.ListOptions) string {
+	switch {
+	case opts.Keyset:
+		return "LIMIT ?"
+	case opts.Size <= 0:
+		return ""
+	}
+	return "LIMIT ? OFFSET ?"
+}
+
+// limitArgs returns the arguments of limit
+func limitArgs(opts swimModels.ListOptions) []interface{} {
+	switch {
+	case opts.Keyset:
+		return []interface{}{opts.Size}
+	case opts.Size <= 0:
+		return nil
+	}
+	return []interface{}{opts.Size, max(opts.Page-1, 0) * opts.Size}
+}
+
+// certUpdateColumns are the columns of names n, certificates c and certificate_names cn
+// read by scanCertUpdate
+const certUpdateColumns = `c.id, n.name, n.is_apex, n.parent_domain, c.not_before, c.not_after, c.serial_number, COALESCE(c.issuer, ''), c.fingerprint, c.key_usage, c.extended_key_usage, c.subject_key_id, c.authority_key_id, c.authority_info, c.subject_alt_name, c.certificate_policies, COALESCE(c.entry_type, ''), cn.wildcard, COALESCE(cn.seen, 0), COALESCE(n.first_seen, 0), COALESCE(n.last_seen, 0), n.cert_count`
+
+// scanCertUpdate reads a row of certUpdateColumns
+func scanCertUpdate(rows *sql.Rows) (swimModels.CertUpdateInfo, error) {
+	var domain swimModels.CertUpdateInfo
+	if err := rows.Scan(
+		&domain.ID,
+		&domain.Domain,
+		&domain.IsApex,
+		&domain.ParentDomain,
+		&domain.NotBefore,
+		&domain.NotAfter,
+		&domain.SerialNumber,
+		&domain.Issuer,
+		&domain.Fingerprint,
+		&domain.KeyUsage,
+		&domain.ExtendedKeyUsage,
+		&domain.SubjectKeyID,
+		&domain.AuthorityKeyID,
+		&domain.AuthorityInfo,
+		&domain.SubjectAltName,
+		&domain.CertificatePolicies,
+		&domain.EntryType,
+		&domain.Wildcard,
+		&domain.Seen,
+		&domain.FirstSeen,
+		&domain.LastSeen,
+		&domain.CertCount,
+	); err != nil {
+		return domain, err
+	}
+
+	// convert Unix timestamp to human-readable time, if needed
+	domain.NotBeforeTime = time.Unix(domain.NotBefore, 0).Format(time.RFC3339)
+	domain.NotAfterTime = time.Unix(domain.NotAfter, 0).Format(time.RFC3339)
+	domain.SeenTime = time.Unix(domain.Seen, 0).Format(time.RFC3339)
+	domain.FirstSeenTime = time.Unix(domain.FirstSeen, 0).Format(time.RFC3339)
+	domain.LastSeenTime = time.Unix(domain.LastSeen, 0).Format(time.RFC3339)
+	return domain, nil
+}
+
+// ListCertUpdates returns a page of name/certificate pairs
+func (s *SQLStore) ListCertUpdates(opts swimModels.ListOptions) ([]swimModels.CertUpdateInfo, error) {
+	var domains []swimModels.CertUpdateInfo
+	err := s.StreamCertUpdates(opts, func(domain swimModels.CertUpdateInfo) error {
+		domains = append(domains, domain)
+		return nil
+	})
+	return domains, err
+}
+
+// StreamCertUpdates calls fn with each name/certificate pair of a page as it is read, an
+// error returned by fn ends the query
+func (s *SQLStore) StreamCertUpdates(opts swimModels.ListOptions, fn func(swimModels.CertUpdateInfo) error) error {
+	order, err := certOrderBy(opts.Sort, opts.Desc)
+	if err != nil {
+		return err
+	}
+
+	conds, args := seenRange(opts, "cn.seen", "cn.seen")
+	filterConds, filterArgs := certFilter(opts.Filter)
+	conds, args = append(conds, filterConds...), append(args, filterArgs...)
+	if opts.Query != nil {
+		cond, condArgs, err := compileQuery(opts.Query)
+		if err != nil {
+			return err
+		}
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+	if opts.After != nil {
+		cond, condArgs := keyset(certKeyset(opts))
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	from, joinConds := certJoin(opts)
+	conds = append(conds, joinConds...)
+
+	query := `SELECT ` + certUpdateColumns + `
+    ` + from + `
+    ` + where(conds) + order + limit(opts)
+
+	rows, err := s.read.Query(s.dialect.rebind(query), append(args, limitArgs(opts)...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		domain, err := scanCertUpdate(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(domain); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// certJoin returns the FROM clause of a cert update listing and its join conditions. The
+// join starts at the table whose index finds the rows of the page soonest, sqlite keeps
+// the join order of a CROSS JOIN: the names matched by a name filter, the certificates
+// in validity order or matched by a filter on them, the sightings of a time range or in
+// the order they were seen, or else the names in order from the cursor of a keyset page.
+// A query counts with the terms all the rows it matches have to match.
+func certJoin(opts swimModels.ListOptions) (string, []string) {
+	var query swimModels.CertFilter
+	var seen bool
+	if opts.Query != nil {
+		query, seen = queryFilter(opts.Query)
+	}
+
+	switch {
+	case byName(opts.Filter) || byName(query):
+	case opts.Sort == "not_before" || byCertificate(opts.Filter) || byCertificate(query):
+		return `FROM certificates c
+    CROSS JOIN certificate_names cn
+    CROSS JOIN names n`, []string{"cn.certificate_id = c.id", "n.id = cn.name_id"}
+	case opts.Sort == "seen" || opts.Since > 0 || opts.Until > 0 || seen || !opts.Keyset:
+		return `FROM certificate_names cn
+    JOIN names n ON n.id = cn.name_id
+    JOIN certificates c ON c.id = cn.certificate_id`, nil
+	}
+	return `FROM names n
+    CROSS JOIN certificate_names cn
+    CROSS JOIN certificates c`, []string{"cn.name_id = n.id", "c.id = cn.certificate_id"}
+}
+
+// ListSubdomains returns the names below domain at any depth, or at most opts.Depth labels
+// below it. They are found with a range scan over the reversed label key.
+func (s *SQLStore) ListSubdomains(domain string, opts swimModels.ListOptions) (*swimModels.DomainWithSubdomains, error) {
+	// archived names only have a combined history, which the database can't seek in
+	archive := opts.Archive && s.archive != nil
+	if archive && opts.Keyset && opts.Sort != "" && opts.Sort != "name" {
+		return nil, swimModels.ErrCursorUnsupported
+	}
+
+	var subdomains []swimModels.Subdomain
+	err := s.streamSubdomains(domain, opts, func(subdomain swimModels.Subdomain) error {
+		subdomains = append(subdomains, subdomain)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// names with archived sightings are combined like the names of several partitions
+	if archive {
+		archived, err := s.archivedSubdomains(domain, opts)
+		if err != nil {
+			return nil, err
+		}
+		subdomains = mergeNames([][]swimModels.Subdomain{subdomains, archived}, opts)
+		if opts.Keyset {
+			subdomains = afterCursor(subdomains, opts)
+		}
+	}
+
+	return &swimModels.DomainWithSubdomains{
+		Domain:     domain,
+		Subdomains: subdomains,
+	}, nil
+}
+
+// StreamSubdomains calls fn with each name below domain as it is read, an error
+// returned by fn ends the query. Names merged with the archive are read first.
+func (s *SQLStore) StreamSubdomains(domain string, opts swimModels.ListOptions, fn func(swimModels.Subdomain) error) error {
+	if !opts.Archive || s.archive == nil {
+		return s.streamSubdomains(domain, opts, fn)
+	}
+
+	subs, err := s.ListSubdomains(domain, opts)
+	if err != nil {
+		return err
+	}
+	for _, subdomain := range subs.Subdomains {
+		if err := fn(subdomain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamSubdomains calls fn with each stored name listed by ListSubdomains
+func (s *SQLStore) streamSubdomains(domain string, opts swimModels.ListOptions, fn func(swimModels.Subdomain) error) error {
+	order, err := orderBy(opts.Sort, opts.Desc)
+	if err != nil {
+		return err
+	}
+
+	cond, args := belowRange(domain)
+	conds := []string{cond}
+	if opts.Depth > 0 {
+		conds = append(conds, "LENGTH(n.reversed) - LENGTH(REPLACE(n.reversed, '.', '')) <= ?")
+		args = append(args, strings.Count(domain, ".")+opts.Depth)
+	}
+
+	rangeConds, rangeArgs := seenRange(opts, "n.first_seen", "n.last_seen")
+	conds = append(conds, rangeConds...)
+	args = append(args, rangeArgs...)
+
+	if opts.Keyset {
+		if opts.After != nil {
+			cond, condArgs := keyset(nameKeyset(opts, "n."))
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		}
+		order += " LIMIT ?"
+		args = append(args, opts.Size)
+	}
+
+	// query for the subdomains
+	rows, err := s.read.Query(s.dialect.rebind("SELECT n.name, COALESCE(n.first_seen, 0), COALESCE(n.last_seen, 0), n.cert_count FROM names n "+where(conds)+order), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var subdomain swimModels.Subdomain
+		if err := rows.Scan(&subdomain.Name, &subdomain.FirstSeen, &subdomain.LastSeen, &subdomain.CertCount); err != nil {
+			return err
+		}
+		subdomain.FirstSeenTime = time.Unix(subdomain.FirstSeen, 0).Format(time.RFC3339)
+		subdomain.LastSeenTime = time.Unix(subdomain.LastSeen, 0).Format(time.RFC3339)
+		if err := fn(subdomain); err != nil {
+			return err
+		}
+	}
+
+	// check for errors from iterating over rows
+	return rows.Err()
+}
+
+// ListApexDomains returns a page of apex domain names
+func (s *SQLStore) ListApexDomains(opts swimModels.ListOptions) ([]string, error) {
+	var domains []string
+	err := s.StreamApexDomains(opts, func(domain string) error {
+		domains = append(domains, domain)
+		return nil
+	})
+	return domains, err
+}
+
+// StreamApexDomains calls fn with each apex domain name of a page as it is read, an error
+// returned by fn ends the query
+func (s *SQLStore) StreamApexDomains(opts swimModels.ListOptions, fn func(string) error) error {
+	conds, args := seenRange(opts, "first_seen", "last_seen")
+	if opts.After != nil {
+		conds = append(conds, "name > ?")
+		args = append(args, opts.After.Name)
+	}
+
+	// define the SQL query with LIMIT and OFFSET clauses
+	// select only domains that are marked as apex and do not start with 'www.'
+	conds = append([]string{"is_apex = true", "name NOT LIKE 'www.%'"}, conds...)
+	query := "SELECT name FROM names " + where(conds) + "ORDER BY name " + limit(opts)
+
+	rows, err := s.read.Query(s.dialect.rebind(query), append(args, limitArgs(opts)...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return err
+		}
+		if err := fn(domain); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Stats reads the totals of the stored names, apex domains and certificates, and the
+// rollups of the hours selected by opts
+func (s *SQLStore) Stats(opts swimModels.StatsOptions) (*swimModels.Stats, error) {
+	var stats swimModels.Stats
+	err := s.read.QueryRow(`SELECT names, apex_domains, certificates FROM rollup_totals WHERE id = 1`).
+		Scan(&stats.Names, &stats.ApexDomains, &stats.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rollupStats(&stats, opts); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
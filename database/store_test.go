@@ -0,0 +1,239 @@
+package database
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+func TestListSubdomains(t *testing.T) {
+	s := openTestStore(t)
+	insertCerts(t, s, 100, 10, 100)
+	apex := testApex(0, 10)
+
+	for _, test := range []struct {
+		domain string
+		opts   swimModels.ListOptions
+		want   []string
+	}{
+		{apex, swimModels.ListOptions{}, []string{
+			"a0.b." + apex, "a1.b." + apex, "a2.b." + apex, "a3.b." + apex, "a4.b." + apex, "a5.b." + apex, "a6.b." + apex,
+			"h0." + apex, "h1." + apex, "h2." + apex, "h3." + apex, "h4." + apex, "h5." + apex, "h6." + apex, "h7." + apex, "h8." + apex, "h9." + apex,
+			"www." + apex,
+		}},
+		{apex, swimModels.ListOptions{Depth: 1, Size: 3, Keyset: true}, []string{"h0." + apex, "h1." + apex, "h2." + apex}},
+		{"www." + apex, swimModels.ListOptions{}, nil},
+		{"b." + apex, swimModels.ListOptions{Depth: 1, Size: 2, Keyset: true, After: &swimModels.Cursor{Sort: "name", Name: "a4.b." + apex}}, []string{"a5.b." + apex, "a6.b." + apex}},
+	} {
+		subs, err := s.ListSubdomains(test.domain, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, sub := range subs.Subdomains {
+			got = append(got, sub.Name)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("ListSubdomains(%q, %+v) = %v, want %v", test.domain, test.opts, got, test.want)
+		}
+	}
+
+	// the suffix filter matches the domain itself as well
+	updates, err := s.ListCertUpdates(swimModels.ListOptions{Filter: swimModels.CertFilter{Suffix: "www." + apex}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 10 {
+		t.Errorf("suffix filter matched %d cert updates, want the 10 of www.%s", len(updates), apex)
+	}
+}
+
+// assertTotals checks the totals of Stats against counting the stored rows
+func assertTotals(t *testing.T, s *SQLStore) {
+	t.Helper()
+	stats, err := s.Stats(swimModels.StatsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, apexes, certs int64
+	err = s.read.QueryRow(`SELECT
+        (SELECT COUNT(*) FROM names),
+        (SELECT COUNT(*) FROM names WHERE is_apex = true),
+        (SELECT COUNT(*) FROM certificates)`).Scan(&names, &apexes, &certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Names != names || stats.ApexDomains != apexes || stats.Certificates != certs {
+		t.Errorf("totals are %d names, %d apex domains, %d certificates, stored are %d, %d, %d",
+			stats.Names, stats.ApexDomains, stats.Certificates, names, apexes, certs)
+	}
+}
+
+func TestStatsTotals(t *testing.T) {
+	s := openTestStore(t)
+	insertCerts(t, s, 300, 20, 70)
+	assertTotals(t, s)
+
+	// the same certificates again add nothing
+	insertCerts(t, s, 300, 20, 100)
+	assertTotals(t, s)
+
+	// prune the sightings of the first 100 certificates
+	cutoff := time.Unix(testStart+100*60, 0)
+	report, err := s.Prune(RetentionPolicy{MaxAge: time.Since(cutoff), ChunkSize: 30}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Certificates == 0 || report.Names == 0 {
+		t.Fatalf("pruning removed %s, want certificates and names", report)
+	}
+	assertTotals(t, s)
+}
+
+func TestInsertBatchFreshNames(t *testing.T) {
+	s := openTestStore(t)
+	batch := generateCerts(0, 10, 10)
+	if err := s.InsertBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	before, err := s.Stats(swimModels.StatsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stored name without certificates is not new when it is seen again
+	if _, err := s.write.Exec(`UPDATE names SET cert_count = 0`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	after, err := s.Stats(swimModels.StatsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Names != before.Names || after.ApexDomains != before.ApexDomains {
+		t.Errorf("stats went from %d names and %d apex domains to %d and %d", before.Names, before.ApexDomains, after.Names, after.ApexDomains)
+	}
+	var newNames int64
+	if err := s.read.QueryRow(`SELECT SUM(new_names) FROM rollup_hourly`).Scan(&newNames); err != nil {
+		t.Fatal(err)
+	}
+	if newNames != before.Names {
+		t.Errorf("hourly rollup counts %d new names, want %d", newNames, before.Names)
+	}
+	if s.nameSearch {
+		var indexed int64
+		if err := s.read.QueryRow(`SELECT COUNT(*) FROM names_fts`).Scan(&indexed); err != nil {
+			t.Fatal(err)
+		}
+		if indexed != before.Names {
+			t.Errorf("search index has %d names, want %d", indexed, before.Names)
+		}
+	}
+}
+
+func TestKeysetWithoutSightingTimes(t *testing.T) {
+	s := openTestStore(t)
+	insertCerts(t, s, 40, 4, 40)
+	apex := testApex(0, 4)
+
+	// names and sightings stored before their times were recorded
+	if _, err := s.write.Exec(`UPDATE names SET first_seen = NULL, last_seen = NULL WHERE id % 3 = 0`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.write.Exec(`UPDATE certificate_names SET seen = NULL WHERE name_id % 2 = 0`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sort := range []string{"first_seen", "last_seen"} {
+		for _, desc := range []bool{false, true} {
+			opts := swimModels.ListOptions{Sort: sort, Desc: desc}
+			all, err := s.ListSubdomains(apex, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var paged []swimModels.Subdomain
+			opts.Keyset, opts.Size = true, 3
+			for {
+				subs, err := s.ListSubdomains(apex, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				paged = append(paged, subs.Subdomains...)
+				if len(subs.Subdomains) < opts.Size {
+					break
+				}
+				last := subs.Subdomains[len(subs.Subdomains)-1]
+				opts.After = &swimModels.Cursor{Sort: sort, Desc: desc, Name: last.Name, Value: last.FirstSeen}
+				if sort == "last_seen" {
+					opts.After.Value = last.LastSeen
+				}
+			}
+			if !slices.Equal(paged, all.Subdomains) {
+				t.Errorf("paging subdomains by %s (desc %v) listed %d names, want the %d of the full listing", sort, desc, len(paged), len(all.Subdomains))
+			}
+		}
+	}
+
+	opts := swimModels.ListOptions{Sort: "seen", Filter: swimModels.CertFilter{Suffix: apex}}
+	all, err := s.ListCertUpdates(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paged []swimModels.CertUpdateInfo
+	opts.Keyset, opts.Size = true, 4
+	for {
+		updates, err := s.ListCertUpdates(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged = append(paged, updates...)
+		if len(updates) < opts.Size {
+			break
+		}
+		last := updates[len(updates)-1]
+		opts.After = &swimModels.Cursor{Sort: "seen", Name: last.Domain, Value: last.Seen, NotBefore: last.NotBefore, Fingerprint: last.Fingerprint}
+	}
+	if len(paged) != len(all) {
+		t.Errorf("paging cert updates by seen listed %d, want the %d of the full listing", len(paged), len(all))
+	}
+}
+
+func TestPagesBeforeTheFirst(t *testing.T) {
+	s := openTestStore(t)
+	insertCerts(t, s, 20, 10, 20)
+
+	first, err := s.ListApexDomains(swimModels.ListOptions{Page: 1, Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, -1} {
+		got, err := s.ListApexDomains(swimModels.ListOptions{Page: n, Size: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, first) {
+			t.Errorf("page %d listed %v, want the first page %v", n, got, first)
+		}
+		if got := page(first, swimModels.ListOptions{Page: n, Size: 2}); !slices.Equal(got, first[:2]) {
+			t.Errorf("page(%d) cut %v, want %v", n, got, first[:2])
+		}
+	}
+
+	// a size of 0 finds all names
+	names, err := s.SearchNames(swimModels.SearchQuery{Terms: []string{"site"}}, swimModels.ListOptions{Page: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := s.Stats(swimModels.StatsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(names)) != stats.Names {
+		t.Errorf("searching with a size of 0 found %d names, want all %d", len(names), stats.Names)
+	}
+}
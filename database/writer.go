@@ -0,0 +1,429 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// maxRowsPerStatement keeps multi-row statements well below the parameter limits of
+// SQLite (32766) and PostgreSQL (65535)
+const maxRowsPerStatement = 1000
+
+// Batches are written with one multi-row statement per table and maxRowsPerStatement
+// rows, which saves a round trip (or a statement step in SQLite) per row. Everything that
+// can be worked out without the database, such as the derived columns of names and the
+// merging of repeated rows, is done by prepareBatch before the transaction starts, so the
+// write lock is held only for the statements themselves.
+
+// preparedBatch is a batch reduced to the rows it adds to each table. Names and links keep
+// the order they arrived in, which writes the names of a certificate next to each other
+// and touches fewer index pages than sorting them; certificates are the only rows shared
+// by the shards of a batch and are sorted by fingerprint, so concurrent writers lock them
+// in the same order.
+type preparedBatch struct {
+	certs []swimModels.CertUpdateInfo // first entry of every certificate, by fingerprint
+	names []nameRow
+	links []linkRow
+
+	// compressed DER of the certificates and chain certificates that carry it
+	raw   []rawRow
+	chain []rawRow
+}
+
+// nameRow is a name with its derived columns and the sightings of the batch merged
+type nameRow struct {
+	name      string
+	isApex    bool
+	parent    string
+	reversed  string
+	firstSeen int64
+	lastSeen  int64
+}
+
+// linkRow is a certificate/name pair, wildcard is set if any entry of the pair had it
+type linkRow struct {
+	fingerprint string
+	name        string
+	wildcard    bool
+}
+
+// storedCert is the id and first sighting of a certificate row
+type storedCert struct {
+	id     int64
+	seen   int64
+	issuer string
+}
+
+// prepareBatch merges the entries of batch into the rows of each table
+func prepareBatch(batch []swimModels.CertUpdateInfo) (*preparedBatch, error) {
+	p := &preparedBatch{}
+	certs := make(map[string]bool)
+	names := make(map[string]int) // index into p.names
+	links := make(map[linkRow]int)
+
+	for _, domainInfo := range batch {
+		if !certs[domainInfo.Fingerprint] {
+			certs[domainInfo.Fingerprint] = true
+			p.certs = append(p.certs, domainInfo)
+		}
+
+		if i, ok := names[domainInfo.Domain]; ok {
+			n := &p.names[i]
+			n.firstSeen = min(n.firstSeen, domainInfo.Seen)
+			n.lastSeen = max(n.lastSeen, domainInfo.Seen)
+		} else {
+			names[domainInfo.Domain] = len(p.names)
+			p.names = append(p.names, nameRow{
+				name:      domainInfo.Domain,
+				isApex:    isApexDomain(domainInfo.Domain),
+				parent:    getParentDomain(domainInfo.Domain),
+				reversed:  reverseLabels(domainInfo.Domain),
+				firstSeen: domainInfo.Seen,
+				lastSeen:  domainInfo.Seen,
+			})
+		}
+
+		key := linkRow{fingerprint: domainInfo.Fingerprint, name: domainInfo.Domain}
+		if i, ok := links[key]; ok {
+			p.links[i].wildcard = p.links[i].wildcard || domainInfo.Wildcard
+		} else {
+			links[key] = len(p.links)
+			key.wildcard = domainInfo.Wildcard
+			p.links = append(p.links, key)
+		}
+	}
+
+	sort.Slice(p.certs, func(i, j int) bool { return p.certs[i].Fingerprint < p.certs[j].Fingerprint })
+
+	var err error
+	p.raw, p.chain, err = prepareRaw(p.certs)
+	return p, err
+}
+
+// shard splits the batch into n batches by the hash of the name, each certificate goes
+// to every shard with one of its names
+func (p *preparedBatch) shard(n int) []*preparedBatch {
+	shards := make([]*preparedBatch, n)
+	for i := range shards {
+		shards[i] = &preparedBatch{}
+	}
+	shardOf := func(name string) int {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		return int(h.Sum32() % uint32(n))
+	}
+
+	for _, name := range p.names {
+		s := shards[shardOf(name.name)]
+		s.names = append(s.names, name)
+	}
+	certShards := make(map[string]map[int]bool)
+	for _, link := range p.links {
+		i := shardOf(link.name)
+		shards[i].links = append(shards[i].links, link)
+		if certShards[link.fingerprint] == nil {
+			certShards[link.fingerprint] = make(map[int]bool)
+		}
+		certShards[link.fingerprint][i] = true
+	}
+	for _, cert := range p.certs {
+		for i := range certShards[cert.Fingerprint] {
+			shards[i].certs = append(shards[i].certs, cert)
+		}
+	}
+
+	// the rows of the shards kept the order of p, empty ones are dropped
+	var nonEmpty []*preparedBatch
+	for _, s := range shards {
+		if len(s.names) > 0 {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+
+	// raw certificates are written by one shard, none of the others waits for its rows
+	if len(nonEmpty) > 0 {
+		nonEmpty[0].raw, nonEmpty[0].chain = p.raw, p.chain
+	}
+	return nonEmpty
+}
+
+// valuesList returns the placeholders of a multi-row VALUES clause
+func valuesList(rows, cols int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", cols), ", ") + ")"
+	return strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ")
+}
+
+// chunks calls f with the bounds of consecutive chunks of at most maxRowsPerStatement of n rows
+func chunks(n int, f func(start, end int) error) error {
+	for start := 0; start < n; start += maxRowsPerStatement {
+		if err := f(start, min(start+maxRowsPerStatement, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatch writes a prepared batch and adds it to the rollups. New names are added to the
+// search index if indexNames is set.
+func writeBatch(tx *sql.Tx, d dialect, p *preparedBatch, indexNames bool) error {
+	counts := newRollup()
+
+	// certificates, the ones returned were inserted by this statement
+	inserted := make(map[string]bool)
+	err := chunks(len(p.certs), func(start, end int) error {
+		args := make([]interface{}, 0, (end-start)*14)
+		for _, c := range p.certs[start:end] {
+			args = append(args, c.Fingerprint, c.NotBefore, c.NotAfter, c.SerialNumber, c.Issuer, c.KeyUsage, c.ExtendedKeyUsage, c.SubjectKeyID, c.AuthorityKeyID, c.AuthorityInfo, c.SubjectAltName, c.CertificatePolicies, c.Seen, c.EntryType)
+		}
+		rows, err := tx.Query(d.rebind(`INSERT INTO certificates (fingerprint, not_before, not_after, serial_number, issuer, key_usage, extended_key_usage, subject_key_id, authority_key_id, authority_info, subject_alt_name, certificate_policies, seen, entry_type)
+            VALUES `+valuesList(end-start, 14)+` ON CONFLICT (fingerprint) DO NOTHING
+            RETURNING fingerprint, seen, issuer`), args...)
+		if err != nil {
+			return fmt.Errorf("error inserting certificates: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var fingerprint, issuer string
+			var seen int64
+			if err := rows.Scan(&fingerprint, &seen, &issuer); err != nil {
+				return err
+			}
+			inserted[fingerprint] = true
+			counts.certificate(seen, issuer)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	certs := make(map[string]storedCert, len(p.certs))
+	err = chunks(len(p.certs), func(start, end int) error {
+		args := make([]interface{}, 0, end-start)
+		for _, c := range p.certs[start:end] {
+			args = append(args, c.Fingerprint)
+		}
+		rows, err := tx.Query(d.rebind("SELECT id, fingerprint, COALESCE(seen, 0), COALESCE(issuer, '') FROM certificates WHERE fingerprint IN ("+placeholders(end-start)+")"), args...)
+		if err != nil {
+			return fmt.Errorf("error reading certificate ids: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var fingerprint string
+			var cert storedCert
+			if err := rows.Scan(&cert.id, &fingerprint, &cert.seen, &cert.issuer); err != nil {
+				return err
+			}
+			certs[fingerprint] = cert
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	// the links of a certificate inserted above are new, so they are counted by the names
+	// upsert itself; links of stored certificates are counted once they are inserted
+	added := make(map[string]int64, len(p.names))
+	for _, l := range p.links {
+		if inserted[l.fingerprint] {
+			added[l.name]++
+		}
+	}
+
+	// names, the upsert tells the names it inserted from the ones it updated. SQLite can
+	// only tell them by their ids, which are above the largest one before the upsert.
+	var lastID int64
+	if d != postgresDialect {
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM names`).Scan(&lastID); err != nil {
+			return fmt.Errorf("error reading last name id: %w", err)
+		}
+	}
+	nameIDs := make(map[string]int64, len(p.names))
+	var newNames []nameRow
+	err = chunks(len(p.names), func(start, end int) error {
+		args := make([]interface{}, 0, (end-start)*7)
+		for _, n := range p.names[start:end] {
+			args = append(args, n.name, n.isApex, n.parent, n.reversed, n.firstSeen, n.lastSeen, added[n.name])
+		}
+		rows, err := tx.Query(d.rebind(`INSERT INTO names (name, is_apex, parent_domain, reversed, first_seen, last_seen, cert_count) VALUES `+valuesList(end-start, 7)+`
+            ON CONFLICT (name) DO UPDATE SET
+                first_seen = `+d.least("COALESCE(names.first_seen, excluded.first_seen)", "excluded.first_seen")+`,
+                last_seen = `+d.greatest("COALESCE(names.last_seen, excluded.last_seen)", "excluded.last_seen")+`,
+                cert_count = names.cert_count + excluded.cert_count
+            RETURNING id, name, `+d.inserted(lastID)), args...)
+		if err != nil {
+			return fmt.Errorf("error upserting names: %w", err)
+		}
+		defer rows.Close()
+		fresh := make(map[string]bool)
+		for rows.Next() {
+			var id int64
+			var name string
+			var inserted bool
+			if err := rows.Scan(&id, &name, &inserted); err != nil {
+				return err
+			}
+			nameIDs[name] = id
+			fresh[name] = inserted
+		}
+		for _, n := range p.names[start:end] {
+			if fresh[n.name] {
+				newNames = append(newNames, n)
+				counts.name(n.firstSeen, n.name, n.isApex)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	if indexNames {
+		err = chunks(len(newNames), func(start, end int) error {
+			args := make([]interface{}, 0, (end-start)*2)
+			for _, n := range newNames[start:end] {
+				args = append(args, nameIDs[n.name], n.name)
+			}
+			_, err := tx.Exec(`INSERT INTO names_fts (rowid, name) VALUES `+valuesList(end-start, 2), args...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error indexing names: %w", err)
+		}
+	}
+
+	// links, the link carries the time its certificate was first seen: a name seen again on
+	// the same certificate (it is logged to several CT logs) is not a new sighting
+	linked := make(map[int64]int64) // certificates per name id not counted yet
+	byID := make(map[int64]storedCert, len(certs))
+	fingerprints := make(map[int64]string, len(certs))
+	for fingerprint, cert := range certs {
+		byID[cert.id] = cert
+		fingerprints[cert.id] = fingerprint
+	}
+	err = chunks(len(p.links), func(start, end int) error {
+		args := make([]interface{}, 0, (end-start)*4)
+		for _, l := range p.links[start:end] {
+			cert := certs[l.fingerprint]
+			args = append(args, cert.id, nameIDs[l.name], l.wildcard, cert.seen)
+		}
+		rows, err := tx.Query(d.rebind(`INSERT INTO certificate_names (certificate_id, name_id, wildcard, seen) VALUES `+valuesList(end-start, 4)+`
+            ON CONFLICT DO NOTHING RETURNING certificate_id, name_id, wildcard`), args...)
+		if err != nil {
+			return fmt.Errorf("error linking certificates to names: %w", err)
+		}
+		defer rows.Close()
+		type link struct {
+			certID, nameID int64
+			wildcard       bool
+		}
+		var links []link
+		for rows.Next() {
+			var l link
+			if err := rows.Scan(&l.certID, &l.nameID, &l.wildcard); err != nil {
+				return err
+			}
+			links = append(links, l)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		names := make(map[int64]string, len(inserted))
+		for _, l := range p.links[start:end] {
+			names[nameIDs[l.name]] = l.name
+		}
+		for _, l := range links {
+			cert := byID[l.certID]
+			counts.sighting(cert.seen, names[l.nameID], cert.issuer, l.wildcard)
+			if !inserted[fingerprints[l.certID]] {
+				linked[l.nameID]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a stored certificate that wasn't linked to the name yet adds to its count
+	ids := make([]int64, 0, len(linked))
+	for id := range linked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	err = upsertRows(tx, d, len(ids), 2, func(i int) []interface{} {
+		return []interface{}{ids[i], linked[ids[i]]}
+	}, `WITH linked (id, n) AS (VALUES %s)
+        UPDATE names SET cert_count = cert_count + CAST(linked.n AS BIGINT)
+        FROM linked WHERE names.id = CAST(linked.id AS BIGINT)`)
+	if err != nil {
+		return fmt.Errorf("error counting certificates: %w", err)
+	}
+
+	if err := writeRaw(tx, d, p.raw, p.chain); err != nil {
+		return err
+	}
+
+	return counts.write(tx, d)
+}
+
+// SetWriters sets the number of transactions a batch is written with in parallel, sharded
+// by the hash of the names. Only PostgreSQL can run concurrent write transactions.
+func (s *SQLStore) SetWriters(n int) error {
+	if n > 1 && s.dialect != postgresDialect {
+		return fmt.Errorf("parallel writers are only supported for postgres databases")
+	}
+	s.writers = max(n, 1)
+	return nil
+}
+
+// writeShards writes the shards of a batch in parallel, each in its own transaction. A
+// failed shard doesn't roll back the others, writing the batch again only adds what is
+// missing.
+func (s *SQLStore) writeShards(shards []*preparedBatch) error {
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard *preparedBatch) {
+			defer wg.Done()
+			errs[i] = s.writeTx(shard)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTx writes a prepared batch in a transaction of its own
+func (s *SQLStore) writeTx(p *preparedBatch) error {
+	tx, err := s.write.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	if err := writeBatch(tx, s.dialect, p, s.nameSearch); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
@@ -13,14 +13,11 @@ import (
 	"syscall"
 	"time"
 
-	"database/sql"
-
 	swimStream "github.com/dap-ware/swim/certstream"
 	swimConfig "github.com/dap-ware/swim/config"
 	swimDb "github.com/dap-ware/swim/database"
 	swimModels "github.com/dap-ware/swim/models"
 	swimServer "github.com/dap-ware/swim/server"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
@@ -78,6 +75,28 @@ func main() {
 		}
 	}
 
+	// archive segments are kept next to the database file unless configured otherwise
+	if swimCfg.Archive.Dir == "" {
+		swimCfg.Archive.Dir = filepath.Join(filepath.Dir(swimCfg.Database.FilePath), "archive")
+	} else if !filepath.IsAbs(swimCfg.Archive.Dir) {
+		swimCfg.Archive.Dir = filepath.Join(dataDir, swimCfg.Archive.Dir)
+	}
+
+	// snapshots are written next to the database file as well
+	if swimCfg.Backup.Dir == "" {
+		swimCfg.Backup.Dir = filepath.Join(filepath.Dir(swimCfg.Database.FilePath), "backups")
+	} else if !filepath.IsAbs(swimCfg.Backup.Dir) {
+		swimCfg.Backup.Dir = filepath.Join(dataDir, swimCfg.Backup.Dir)
+	}
+
+	// run a maintenance command instead of the server if one was given
+	if len(os.Args) > 1 {
+		if err := runCommand(swimCfg, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	// Define the directory and paths for SSL/TLS certificates
 	certDir := filepath.Join(baseDir, "cert")
 	certFile := filepath.Join(certDir, "cert.pem")
@@ -100,37 +119,15 @@ func main() {
 	}
 
 	// Database setup
-	dbPath := swimCfg.Database.FilePath
-
-	var db *sql.DB
-
-	// check if the database file exists
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		// create a new file
-		file, err := os.Create(swimCfg.Database.FilePath)
-		if err != nil {
-			log.Fatalf("Failed to create database file: %v", err)
-		}
-		file.Close()
-
-		// open the newly created database
-		db, err = sql.Open("sqlite3", swimCfg.Database.FilePath)
-		if err != nil {
-			log.Fatalf("Error opening new database: %v", err)
-		}
-		defer db.Close()
+	store, err := openBackend(swimCfg)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
 
-		// initialize the database
-		if err := swimDb.SetupDatabase(db); err != nil {
-			log.Fatalf("Failed to setup database: %v", err)
-		}
-	} else {
-		// open the existing database
-		db, err = sql.Open("sqlite3", swimCfg.Database.FilePath)
-		if err != nil {
-			log.Fatalf("Error opening database: %v", err)
-		}
-		defer db.Close()
+	// apply pending schema migrations, this also upgrades databases created by older versions
+	if err := store.SetupDatabase(); err != nil {
+		log.Fatalf("Failed to setup database: %v", err)
 	}
 
 	domains := make(chan []swimModels.CertUpdateInfo, 100) // buffered channel for domain info
@@ -139,20 +136,68 @@ func main() {
 
 	var wg sync.WaitGroup
 
+	// put the dedup cache in front of the store if it is enabled
+	var inserter swimDb.BatchInserter = store
+	var pruner swimDb.Pruner = store
+	dedup, err := dedupStore(swimCfg, store)
+	if err != nil {
+		log.Fatalf("Failed to set up the dedup cache: %v", err)
+	}
+	if dedup != nil {
+		inserter, pruner = dedup, dedup
+	}
+
 	// start the database insert worker
 	wg.Add(1)
-	go swimDb.DbInsertWorker(db, domains, &wg)
+	go swimDb.DbInsertWorker(inserter, domains, &wg)
 
 	// start the message processing worker
 	wg.Add(1)
 	go swimStream.MessageProcessor(rawMessages, domains, stopProcessing, &wg, swimCfg.Database.BatchSize)
 
+	// start the retention janitor if the database is limited in size or age
+	policy := retentionPolicy(swimCfg)
+	if err := policy.Validate(); err != nil {
+		log.Fatalf("Invalid retention settings: %v", err)
+	}
+	if policy.Enabled() {
+		wg.Add(1)
+		go swimDb.RetentionWorker(pruner, policy, stopProcessing, &wg)
+	}
+
+	// start the archiver and let the API read the archive if they are enabled
+	archiving := archivePolicy(swimCfg)
+	if err := archiving.Validate(); err != nil {
+		log.Fatalf("Invalid archive settings: %v", err)
+	}
+	if archiving.Enabled() || swimCfg.Archive.Search {
+		sqlStore, archive, err := openArchive(swimCfg, store)
+		if err != nil {
+			log.Fatalf("Failed to open the archive: %v", err)
+		}
+		if swimCfg.Archive.Search {
+			sqlStore.SetArchive(archive)
+		}
+		if archiving.Enabled() {
+			var archiver swimDb.Archiver = sqlStore
+			if dedup != nil {
+				archiver = dedup
+			}
+			wg.Add(1)
+			go swimDb.ArchiveWorker(archiver, archive, archiving, stopProcessing, &wg)
+		}
+	}
+
 	// goroutine for CertStream connection
 	wg.Add(1)
-	go swimStream.ListenForEvents(rawMessages, stopProcessing, &wg)
+	streamURL := swimStream.StreamURL
+	if swimCfg.Database.RawCertificates {
+		streamURL = swimStream.FullStreamURL
+	}
+	go swimStream.ListenForEvents(streamURL, rawMessages, stopProcessing, &wg)
 
 	// server gets started in go routine in swimServer.StartServer
-	srv, started := swimServer.StartServer(db, &wg, swimCfg, baseDir) // start the Gin server (with a rate limiter of 100 requests per hour. See config/config.yaml for the
+	srv, started := swimServer.StartServer(store, &wg, swimCfg, baseDir) // start the Gin server (with a rate limiter of 100 requests per hour. See config/config.yaml for the
 	// wait for the server to start
 	go func() {
 		<-started // send a message to the channel when the server is started
@@ -182,6 +227,113 @@ func main() {
 	fmt.Println("CertStream data processing completed.")
 }
 
+// retentionPolicy returns the retention limits set in the configuration
+func retentionPolicy(swimCfg *swimConfig.Config) swimDb.RetentionPolicy {
+	return swimDb.RetentionPolicy{
+		MaxSize:   swimCfg.Retention.MaxSize,
+		MaxAge:    swimCfg.Retention.MaxAge,
+		Interval:  swimCfg.Retention.Interval,
+		ChunkSize: swimCfg.Retention.ChunkSize,
+	}
+}
+
+// archivePolicy returns the archive settings of the configuration
+func archivePolicy(swimCfg *swimConfig.Config) swimDb.ArchivePolicy {
+	return swimDb.ArchivePolicy{
+		After:     swimCfg.Archive.After,
+		Interval:  swimCfg.Archive.Interval,
+		ChunkSize: swimCfg.Archive.ChunkSize,
+	}
+}
+
+// openArchive opens the configured archive of store
+func openArchive(swimCfg *swimConfig.Config, store backend) (*swimDb.SQLStore, *swimDb.Archive, error) {
+	// partitions of past periods are already read-only files that can be compressed
+	sqlStore, ok := store.(*swimDb.SQLStore)
+	if !ok {
+		return nil, nil, fmt.Errorf("archiving is not supported for partitioned databases")
+	}
+	archive, err := swimDb.OpenArchive(swimCfg.Archive.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sqlStore, archive, nil
+}
+
+// dedupStore returns the dedup cache configured for store, nil if it is disabled
+func dedupStore(swimCfg *swimConfig.Config, store backend) (*swimDb.DedupStore, error) {
+	if swimCfg.Database.DedupCache <= 0 {
+		return nil, nil
+	}
+	// re-sightings of certificates from past periods have to be stored in the current partition
+	sqlStore, ok := store.(*swimDb.SQLStore)
+	if !ok {
+		log.Println("The dedup cache is not supported for partitioned databases, it is disabled")
+		return nil, nil
+	}
+
+	dedup, err := swimDb.NewDedupStore(sqlStore, swimDb.DedupOptions{
+		CacheSize: swimCfg.Database.DedupCache,
+		BloomSize: swimCfg.Database.DedupBloom,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dedup, dedup.Warm()
+}
+
+// backend is what the server needs from a storage backend
+type backend interface {
+	swimModels.Store
+	swimModels.Snapshotter
+	swimDb.Pruner
+	SetupDatabase() error
+}
+
+// openBackend opens the storage backend selected in the configuration for serving,
+// partitioned sqlite databases included
+func openBackend(swimCfg *swimConfig.Config) (backend, error) {
+	if swimCfg.Database.Partition != "" {
+		if swimCfg.Database.Driver != "" && swimCfg.Database.Driver != "sqlite" {
+			return nil, fmt.Errorf("partitioning is only supported for sqlite databases")
+		}
+		if swimCfg.Database.Writers > 1 {
+			return nil, fmt.Errorf("parallel writers are only supported for postgres databases")
+		}
+		dir := filepath.Join(filepath.Dir(swimCfg.Database.FilePath), "partitions")
+		return swimDb.OpenPartitioned(dir, swimCfg.Database.Partition, swimCfg.Database.CompressPartitions, swimCfg.Database.ReadConns)
+	}
+	return openStore(swimCfg, swimCfg.Database.ReadConns)
+}
+
+// openStore opens the storage backend selected in the configuration. connections sizes the
+// read pool of sqlite and the whole pool of postgres.
+func openStore(swimCfg *swimConfig.Config, connections int) (*swimDb.SQLStore, error) {
+	switch swimCfg.Database.Driver {
+	case "", "sqlite":
+		if swimCfg.Database.Writers > 1 {
+			return nil, fmt.Errorf("parallel writers are only supported for postgres databases")
+		}
+		db, err := swimDb.Open(swimCfg.Database.FilePath, connections)
+		if err != nil {
+			return nil, err
+		}
+		return swimDb.NewSQLiteStore(db), nil
+	case "postgres":
+		store, err := swimDb.OpenPostgres(swimCfg.Database.DSN, connections)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.SetWriters(swimCfg.Database.Writers); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, expected sqlite or postgres", swimCfg.Database.Driver)
+	}
+}
+
 // printInstructions provides instructions for generating SSL/TLS certificates
 func printInstructions(baseDir string) {
 	certDir := filepath.Join(baseDir, "cert")
@@ -1,11 +1,315 @@
 package models
 
 import (
-	"database/sql"
+	"errors"
+	"slices"
+	"strings"
 )
 
 type Server struct {
-	Db *sql.DB
+	Store Store
+}
+
+// Store is implemented by the storage backends swim writes certificate updates to and
+// serves the API from.
+type Store interface {
+	// InsertBatch stores a batch of certificate updates in a single transaction
+	InsertBatch(batch []CertUpdateInfo) error
+	// ListApexDomains returns a page of apex domain names
+	ListApexDomains(opts ListOptions) ([]string, error)
+	// ListSubdomains returns the names below domain, only limited to opts.Size when paged
+	// with a cursor
+	ListSubdomains(domain string, opts ListOptions) (*DomainWithSubdomains, error)
+	// ListCertUpdates returns a page of name/certificate pairs
+	ListCertUpdates(opts ListOptions) ([]CertUpdateInfo, error)
+	// SearchNames returns a page of the names matching query
+	SearchNames(query SearchQuery, opts ListOptions) ([]Subdomain, error)
+	// Stats counts what is stored, and what was ingested in the hours selected by opts
+	Stats(opts StatsOptions) (*Stats, error)
+	Close() error
+}
+
+// RowStreamer is implemented by stores that can hand out the rows of listings as they are
+// read instead of collecting them first. An error returned by fn ends the listing and is
+// returned.
+type RowStreamer interface {
+	StreamApexDomains(opts ListOptions, fn func(string) error) error
+	StreamCertUpdates(opts ListOptions, fn func(CertUpdateInfo) error) error
+	StreamSubdomains(domain string, opts ListOptions, fn func(Subdomain) error) error
+}
+
+// Snapshotter is implemented by stores that can write a consistent copy of themselves
+// while they are in use
+type Snapshotter interface {
+	// Snapshot writes a timestamped copy to dir and keeps only the newest keep copies
+	// there, all of them if keep is 0
+	Snapshot(dir string, keep int) (*Snapshot, error)
+}
+
+// Snapshot describes a copy of the database written by a Snapshotter
+type Snapshot struct {
+	Path    string   `json:"path"`
+	Size    int64    `json:"size"`
+	Created string   `json:"created"`
+	Removed []string `json:"removed,omitempty"` // older snapshots deleted to keep the configured number
+}
+
+// ArchiveSearcher is implemented by stores that can look up the sightings they moved to
+// their archive
+type ArchiveSearcher interface {
+	// SearchArchive returns a page of the archived sightings of domain, and of the names
+	// below it if subdomains is set
+	SearchArchive(domain string, subdomains bool, opts ListOptions) ([]CertUpdateInfo, error)
+}
+
+// RawCertificateStore is implemented by stores that can keep the DER of the certificates
+// they store
+type RawCertificateStore interface {
+	// RawCertificate returns the certificate with the given fingerprint, nil if its DER
+	// was not stored
+	RawCertificate(fingerprint string) (*RawCertificate, error)
+}
+
+// CertificateStore is implemented by stores that can look up certificates together with
+// the names they cover
+type CertificateStore interface {
+	// DomainDetail returns the sighting history of domain with at most size (0 for all)
+	// of the certificates covering it and of the wildcard certificates matching it, the
+	// newest first. It returns nil if neither were stored.
+	DomainDetail(domain string, size int) (*DomainDetail, error)
+
+	// Certificate returns the certificate with the given fingerprint, nil if it was not stored
+	Certificate(fingerprint string) (*Certificate, error)
+
+	// LookupCertificates returns at most size (0 for all) of the certificates matching
+	// every identifier set in lookup, the newest first
+	LookupCertificates(lookup CertificateLookup, size int) ([]Certificate, error)
+}
+
+// ExpiryStore is implemented by stores that can list the certificates about to expire
+type ExpiryStore interface {
+	// ListExpiring returns a page of the names at or below suffix, all names if it is
+	// empty, whose certificate expiring last expires in the range expiry. Each name is
+	// returned with that certificate, ordered by when it expires.
+	ListExpiring(suffix string, expiry TimeRange, opts ListOptions) ([]CertUpdateInfo, error)
+}
+
+// CertificateLookup selects certificates by their identifiers, given as hex digits without
+// separators
+type CertificateLookup struct {
+	Serial         string
+	SubjectKeyID   string
+	AuthorityKeyID string
+}
+
+// RawCertificate is the DER of a certificate and of its chain, issuer first
+type RawCertificate struct {
+	Fingerprint string
+	DER         []byte
+	Chain       [][]byte
+}
+
+// SortKeys lists the keys cert updates and subdomains can be sorted by
+var SortKeys = []string{"name", "first_seen", "last_seen"}
+
+// CertSortKeys lists the keys cert updates can be sorted by, the time a certificate was
+// seen with a name and its not_before time besides the SortKeys
+var CertSortKeys = append(slices.Clone(SortKeys), "seen", "not_before")
+
+// EntryTypes lists the kinds of CT log entries a certificate can be seen in: the issued
+// certificate or the precertificate logged before it was issued
+var EntryTypes = []string{"x509", "precert"}
+
+// SearchModes lists how search terms can match names: anywhere in the name, at its
+// start, or as one or more whole labels
+var SearchModes = []string{"substring", "prefix", "label"}
+
+// SearchQuery selects names matching any of Terms
+type SearchQuery struct {
+	Terms []string
+	Mode  string // one of SearchModes, substring if empty
+}
+
+// ListOptions controls paging and ordering of list queries
+type ListOptions struct {
+	Page int
+	Size int    // 0 lists everything
+	Sort string // one of SortKeys, the name is used if empty
+	Desc bool
+
+	// Depth limits subdomain listings to names at most Depth labels below the domain,
+	// 0 lists all of them
+	Depth int
+
+	// Since and Until restrict results to what was seen in [Since, Until), as unix
+	// times. 0 leaves the range open on that side.
+	Since int64
+	Until int64
+
+	// Archive adds the sightings moved to the archive to subdomain listings
+	Archive bool
+
+	// Filter and Query restrict cert update listings, Query is nil without one
+	Filter CertFilter
+	Query  Expr
+
+	// Keyset pages through a listing with cursors instead of page numbers: Page is ignored
+	// and at most Size rows ordered after After are returned, from the start without After.
+	// Subdomain listings are only limited to Size in this mode.
+	Keyset bool
+	After  *Cursor
+}
+
+// CertFilter selects cert updates, all of its set fields have to match
+type CertFilter struct {
+	Name      string // glob over the name, * matches any characters and ? a single one
+	Suffix    string // the name or one of its parent domains
+	Issuer    string
+	Wildcard  *bool
+	Apex      *bool
+	EntryType string // one of EntryTypes
+	KeyUsage  string // one of the key usages of the certificate, e.g. "Digital Signature"
+
+	// NotBefore and NotAfter restrict the validity of the certificate to [Since, Until),
+	// as unix times. 0 leaves the range open on that side.
+	NotBefore TimeRange
+	NotAfter  TimeRange
+}
+
+// TimeRange is a range [Since, Until) of unix times, 0 leaves it open on that side
+type TimeRange struct {
+	Since int64
+	Until int64
+}
+
+// QueryFields lists the fields of cert updates a query can match, in the order they are
+// documented
+var QueryFields = []string{"name", "suffix", "issuer", "wildcard", "apex", "entry_type", "key_usage", "not_before", "not_after", "seen"}
+
+// Expr is a node of a parsed cert update query: an And, Or, Not or Term
+type Expr interface {
+	// String formats the expression in the query language, with parentheses around
+	// every group so the precedence it was parsed with shows
+	String() string
+}
+
+// And matches the cert updates all of its expressions match
+type And []Expr
+
+// Or matches the cert updates any of its expressions match
+type Or []Expr
+
+// Not matches the cert updates Expr doesn't match
+type Not struct {
+	Expr Expr
+}
+
+// Term matches a field of cert updates, one of QueryFields, against a value. Op is ":"
+// to match the value and <, <=, > or >= to compare times. Bool and Time hold the parsed
+// value of boolean and time fields.
+type Term struct {
+	Field string
+	Op    string
+	Value string
+	Bool  bool
+	Time  int64
+}
+
+func (e And) String() string { return joinExprs(e, " AND ") }
+
+func (e Or) String() string { return joinExprs(e, " OR ") }
+
+func (e Not) String() string { return "NOT " + e.Expr.String() }
+
+func (t Term) String() string {
+	if t.Value == "" || strings.ContainsAny(t.Value, " \t\"()\\") {
+		return t.Field + t.Op + `"` + quoteEscaper.Replace(t.Value) + `"`
+	}
+	return t.Field + t.Op + t.Value
+}
+
+// quoteEscaper escapes the characters of quoted query values
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// joinExprs formats a group of expressions joined by op
+func joinExprs(exprs []Expr, op string) string {
+	parts := make([]string, len(exprs))
+	for i, e := range exprs {
+		parts[i] = e.String()
+	}
+	return "(" + strings.Join(parts, op) + ")"
+}
+
+// Cursor is the position of the last row of a page in the order of a listing, the next
+// page starts after it. It is handed to clients encoded as an opaque string.
+type Cursor struct {
+	Sort        string `json:"s"`
+	Desc        bool   `json:"d,omitempty"`
+	Value       int64  `json:"v,omitempty"` // the value of the row's sort key if not sorted by name
+	Name        string `json:"n"`
+	NotBefore   int64  `json:"b,omitempty"` // cert updates only
+	Fingerprint string `json:"f,omitempty"` // cert updates only
+}
+
+// ErrCursorUnsupported is returned for cursor pagination of listings whose order can't be
+// resumed from a cursor, e.g. names sorted by their combined history over partitions
+var ErrCursorUnsupported = errors.New("cursor pagination is only supported sorted by name here, use page instead")
+
+// Page is a page of a listing requested with a cursor, Next continues after its last
+// item and is empty on the last page
+type Page[T any] struct {
+	Items []T    `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+// StatsOptions selects the hours ingestion statistics are reported for
+type StatsOptions struct {
+	// Since and Until restrict the statistics to the hours overlapping [Since, Until), as
+	// unix times. 0 leaves the range open on that side.
+	Since int64
+	Until int64
+
+	// Top limits the top level domains and issuers to the most seen ones, 0 reports all
+	Top int
+}
+
+// Stats summarizes the contents of a store and what was ingested during a time range
+type Stats struct {
+	Names        int64 `json:"names"`
+	ApexDomains  int64 `json:"apex_domains"`
+	Certificates int64 `json:"certificates"`
+
+	Since   string        `json:"since,omitempty"`
+	Until   string        `json:"until,omitempty"`
+	Totals  HourlyStats   `json:"totals"`
+	Hourly  []HourlyStats `json:"hourly"`
+	TLDs    []TLDStats    `json:"tlds"`
+	Issuers []IssuerStats `json:"issuers"`
+}
+
+// HourlyStats counts what was ingested during an hour, or during all hours of a range
+type HourlyStats struct {
+	Hour         int64  `json:"-"`
+	HourTime     string `json:"hour,omitempty"`
+	Certificates int64  `json:"certificates"` // certificates seen for the first time
+	Sightings    int64  `json:"sightings"`    // certificates linked to a name
+	NewNames     int64  `json:"new_names"`
+	NewApexes    int64  `json:"new_apexes"`
+	Wildcards    int64  `json:"wildcards"` // sightings of names the certificate also covers with a wildcard
+}
+
+// TLDStats counts the sightings and new names of a top level domain
+type TLDStats struct {
+	TLD       string `json:"tld"`
+	Sightings int64  `json:"sightings"`
+	NewNames  int64  `json:"new_names"`
+}
+
+// IssuerStats counts the certificates of an issuer and their sightings
+type IssuerStats struct {
+	Issuer       string `json:"issuer"`
+	Certificates int64  `json:"certificates"`
+	Sightings    int64  `json:"sightings"`
 }
 
 type Domain struct {
@@ -13,8 +317,66 @@ type Domain struct {
 }
 
 type DomainWithSubdomains struct {
-	Domain     string   `json:"domain"`
-	Subdomains []string `json:"subdomains"`
+	Domain     string      `json:"domain"`
+	Subdomains []Subdomain `json:"subdomains"`
+	Next       string      `json:"next,omitempty"` // cursor of the next page, if requested with one
+}
+
+// Subdomain is a name below a domain together with its sighting history
+type Subdomain struct {
+	Name          string `json:"domain"`
+	FirstSeen     int64  `json:"-"`
+	FirstSeenTime string `json:"first_seen"`
+	LastSeen      int64  `json:"-"`
+	LastSeenTime  string `json:"last_seen"`
+	CertCount     int64  `json:"cert_count"`
+}
+
+// DomainDetail is everything known about a name. Domain is its ASCII form, the one names
+// are stored in, Unicode the form internationalized names are displayed in. Apex is the
+// registered domain the name belongs to, one label below its public suffix, ICANN tells
+// whether the suffix is managed by ICANN rather than by a private registry.
+type DomainDetail struct {
+	Domain        string `json:"domain"`
+	Unicode       string `json:"unicode"`
+	Reversed      string `json:"reversed"`
+	Apex          string `json:"apex"`
+	IsApex        bool   `json:"is_apex"`
+	PublicSuffix  string `json:"public_suffix"`
+	ICANN         bool   `json:"icann"`
+	FirstSeen     int64  `json:"-"`
+	FirstSeenTime string `json:"first_seen,omitempty"`
+	LastSeen      int64  `json:"-"`
+	LastSeenTime  string `json:"last_seen,omitempty"`
+	CertCount     int64  `json:"cert_count"`
+
+	// Certificates lists the certificates naming the domain, WildcardCertificates those
+	// covering it with a wildcard for its parent domain
+	Certificates         []Certificate `json:"certificates"`
+	WildcardCertificates []Certificate `json:"wildcard_certificates"`
+}
+
+// Certificate is a stored certificate with the names it covers, its SAN entries. Names
+// covered by a wildcard are listed with it, as *.example.com.
+type Certificate struct {
+	Fingerprint         string   `json:"fingerprint"`
+	SerialNumber        string   `json:"serial_number"`
+	Issuer              string   `json:"issuer"`
+	EntryType           string   `json:"entry_type"`
+	NotBefore           int64    `json:"-"`
+	NotBeforeTime       string   `json:"not_before"`
+	NotAfter            int64    `json:"-"`
+	NotAfterTime        string   `json:"not_after"`
+	KeyUsage            string   `json:"key_usage"`
+	ExtendedKeyUsage    string   `json:"extended_key_usage"`
+	SubjectKeyID        string   `json:"subject_key_id"`
+	AuthorityKeyID      string   `json:"authority_key_id"`
+	AuthorityInfo       string   `json:"authority_info"`
+	SubjectAltName      string   `json:"subject_alt_name"`
+	CertificatePolicies string   `json:"certificate_policies"`
+	Seen                int64    `json:"-"` // when the certificate was first seen in the stream
+	SeenTime            string   `json:"seen"`
+	Names               []string `json:"names"`
 }
 
 // DomainInfo represents the relevant data we want to extract from the stream
@@ -25,10 +387,12 @@ type CertUpdateInfo struct {
 	ParentDomain        string `json:"parent_domain"`
 	NotBefore           int64  `json:"-"`
 	NotBeforeTime       string `json:"not_before"`
-	NotAfter            int64  `json:"-"` // not returned in JSON
-	NotAfterTime        string `json:"-"` // not returned in JSON
+	NotAfter            int64  `json:"-"`
+	NotAfterTime        string `json:"not_after"`
 	SerialNumber        string `json:"serial_number"`
+	Issuer              string `json:"issuer"`
 	Fingerprint         string `json:"fingerprint"`
+	EntryType           string `json:"entry_type"` // one of EntryTypes, empty if it wasn't recorded
 	KeyUsage            string `json:"key_usage"`
 	ExtendedKeyUsage    string `json:"extended_key_usage"`
 	SubjectKeyID        string `json:"subject_key_id"`
@@ -37,4 +401,16 @@ type CertUpdateInfo struct {
 	SubjectAltName      string `json:"subject_alt_name"`
 	CertificatePolicies string `json:"certificate_policies"`
 	Wildcard            bool   `json:"wildcard"`
+	Seen                int64  `json:"-"` // when the certificate was seen in the stream
+	SeenTime            string `json:"seen"`
+	FirstSeen           int64  `json:"-"`
+	FirstSeenTime       string `json:"first_seen"`
+	LastSeen            int64  `json:"-"`
+	LastSeenTime        string `json:"last_seen"`
+	CertCount           int64  `json:"cert_count"`
+
+	// RawDER and RawChain hold the DER of the certificate and of its chain, issuer first,
+	// when swim reads the full stream
+	RawDER   []byte   `json:"-"`
+	RawChain [][]byte `json:"-"`
 }
@@ -0,0 +1,370 @@
+// Package query parses the query language of cert updates, e.g.
+//
+//	issuer:"Let's Encrypt" AND wildcard:true AND name:*.bank.*
+//
+// A query is made of terms, field:value to match a value or a comparison like
+// not_after<2024-03-01 for times, combined with AND, OR, NOT and parentheses. AND binds
+// tighter than OR. The parsed expression only holds the fields and values, the database
+// compiles it to SQL with the values as parameters.
+package query
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// limits of a query, so a single request can't build a statement of any size
+const (
+	MaxLength = 2048
+	maxTerms  = 50
+	maxDepth  = 20
+)
+
+// kind is the type of the values of a field
+type kind int
+
+const (
+	text kind = iota
+	boolean
+	timestamp
+	entryType
+)
+
+// kinds maps the fields of swimModels.QueryFields to the type of their values
+var kinds = map[string]kind{
+	"name":       text,
+	"suffix":     text,
+	"issuer":     text,
+	"wildcard":   boolean,
+	"apex":       boolean,
+	"entry_type": entryType,
+	"key_usage":  text,
+	"not_before": timestamp,
+	"not_after":  timestamp,
+	"seen":       timestamp,
+}
+
+// Error is a syntax error of a query, Column counts the characters from 1
+type Error struct {
+	Column int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at column %d", e.Msg, e.Column)
+}
+
+// Pointer returns the query with a caret under the column of the error below it
+func (e *Error) Pointer(query string) string {
+	return query + "\n" + strings.Repeat(" ", e.Column-1) + "^"
+}
+
+// parser is a recursive descent parser, pos is the byte offset of the next character
+type parser struct {
+	query string
+	pos   int
+	depth int
+	terms int
+}
+
+// Parse parses a query, errors are returned as *Error
+func Parse(query string) (swimModels.Expr, error) {
+	p := &parser{query: query}
+	if len(query) > MaxLength {
+		return nil, &Error{Column: 1, Msg: fmt.Sprintf("query is too long, at most %d bytes are allowed", MaxLength)}
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil, p.errorf("empty query, expected a term like issuer:\"Let's Encrypt\"")
+	}
+
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.query) {
+		if p.query[p.pos] == ')' {
+			return nil, p.errorf("unexpected ), there is no ( it closes")
+		}
+		return nil, p.errorf("unexpected %q, expected AND, OR or the end of the query (quote values with spaces)", p.word())
+	}
+	return expr, nil
+}
+
+// or parses terms joined by OR
+func (p *parser) or() (swimModels.Expr, error) {
+	var exprs swimModels.Or
+	for {
+		expr, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.keyword("OR") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+// and parses terms joined by AND
+func (p *parser) and() (swimModels.Expr, error) {
+	var exprs swimModels.And
+	for {
+		expr, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.keyword("AND") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+// not parses a term or group, negated if NOT comes before it
+func (p *parser) not() (swimModels.Expr, error) {
+	if !p.keyword("NOT") {
+		return p.primary()
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	expr, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	return swimModels.Not{Expr: expr}, nil
+}
+
+// primary parses a term or a group in parentheses
+func (p *parser) primary() (swimModels.Expr, error) {
+	p.skipSpace()
+	if p.pos == len(p.query) {
+		return nil, p.errorf("unexpected end of the query, expected a term like issuer:\"Let's Encrypt\"")
+	}
+
+	switch p.query[p.pos] {
+	case '(':
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		open := p.pos
+		p.pos++
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos == len(p.query) || p.query[p.pos] != ')' {
+			p.pos = open
+			return nil, p.errorf("missing ) to close this (")
+		}
+		p.pos++
+		return expr, nil
+	case ')':
+		return nil, p.errorf("unexpected ), expected a term like issuer:\"Let's Encrypt\"")
+	}
+	return p.term()
+}
+
+// term parses field:value or a comparison of a time field
+func (p *parser) term() (swimModels.Expr, error) {
+	start := p.pos
+	for p.pos < len(p.query) && (isLetter(p.query[p.pos]) || p.query[p.pos] == '_') {
+		p.pos++
+	}
+	field := strings.ToLower(p.query[start:p.pos])
+	if field == "" || p.pos == len(p.query) || !strings.ContainsRune(":<>", rune(p.query[p.pos])) {
+		p.pos = start
+		if field == "and" || field == "or" {
+			return nil, p.errorf("unexpected %s, expected a term before it", strings.ToUpper(field))
+		}
+		return nil, p.errorf("expected a term like issuer:\"Let's Encrypt\", got %q", p.word())
+	}
+	k, ok := kinds[field]
+	if !ok {
+		p.pos = start
+		return nil, p.errorf("unknown field %q, expected one of %s", field, strings.Join(swimModels.QueryFields, ", "))
+	}
+
+	p.terms++
+	if p.terms > maxTerms {
+		p.pos = start
+		return nil, p.errorf("too many terms, at most %d are allowed", maxTerms)
+	}
+
+	// time fields are compared, field:>=value is accepted as well
+	opStart := p.pos
+	if p.query[p.pos] == ':' {
+		p.pos++
+	}
+	op := ":"
+	for _, cmp := range []string{"<=", ">=", "<", ">"} {
+		if strings.HasPrefix(p.query[p.pos:], cmp) {
+			op = cmp
+			p.pos += len(cmp)
+			break
+		}
+	}
+	if k == timestamp && op == ":" {
+		p.pos = opStart
+		return nil, p.errorf("%s is compared with <, <=, > or >=, e.g. %s>=2024-01-31", field, field)
+	}
+	if k != timestamp && op != ":" {
+		p.pos = opStart
+		return nil, p.errorf("%s can't be compared, match it with %s:value", field, field)
+	}
+
+	valueStart := p.pos
+	value, err := p.value(field + op)
+	if err != nil {
+		return nil, err
+	}
+
+	t := swimModels.Term{Field: field, Op: op, Value: value}
+	invalid := func(expected string) error {
+		p.pos = valueStart
+		return p.errorf("invalid %s %q, expected %s", field, value, expected)
+	}
+	switch k {
+	case boolean:
+		if t.Bool, err = strconv.ParseBool(value); err != nil {
+			return nil, invalid("true or false")
+		}
+	case timestamp:
+		if t.Time, err = parseTime(value); err != nil {
+			return nil, invalid("a date (2024-01-31), an RFC 3339 time or a unix timestamp")
+		}
+	case entryType:
+		if !slices.Contains(swimModels.EntryTypes, value) {
+			return nil, invalid("one of " + strings.Join(swimModels.EntryTypes, ", "))
+		}
+	}
+	return t, nil
+}
+
+// value parses the value of a term, quoted or up to the next space or parenthesis. term
+// is what came before it, for the error of a missing value.
+func (p *parser) value(term string) (string, error) {
+	if p.pos == len(p.query) || p.query[p.pos] != '"' {
+		start := p.pos
+		for p.pos < len(p.query) && !isSpace(p.query[p.pos]) && p.query[p.pos] != '(' && p.query[p.pos] != ')' {
+			p.pos++
+		}
+		if p.pos == start {
+			return "", p.errorf("missing value after %s", term)
+		}
+		return p.query[start:p.pos], nil
+	}
+
+	open := p.pos
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.query); p.pos++ {
+		switch c := p.query[p.pos]; c {
+		case '"':
+			p.pos++
+			if b.Len() == 0 {
+				p.pos = open
+				return "", p.errorf("empty value after %s", term)
+			}
+			return b.String(), nil
+		case '\\':
+			if p.pos+1 < len(p.query) {
+				p.pos++
+			}
+			b.WriteByte(p.query[p.pos])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	p.pos = open
+	return "", p.errorf("missing \" to close this quoted value")
+}
+
+// keyword consumes the operator kw if it comes next, in any case, followed by a space, a
+// parenthesis or the end of the query
+func (p *parser) keyword(kw string) bool {
+	p.skipSpace()
+	end := p.pos + len(kw)
+	if end > len(p.query) || !strings.EqualFold(p.query[p.pos:end], kw) {
+		return false
+	}
+	if end < len(p.query) && !isSpace(p.query[end]) && p.query[end] != '(' && p.query[end] != ')' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+// enter counts a level of nesting, leave leaves it
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxDepth {
+		return p.errorf("query is nested too deeply, at most %d levels are allowed", maxDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// skipSpace skips the spaces before the next token
+func (p *parser) skipSpace() {
+	for p.pos < len(p.query) && isSpace(p.query[p.pos]) {
+		p.pos++
+	}
+}
+
+// word returns the text from the current position up to the next space, for errors
+func (p *parser) word() string {
+	end := p.pos
+	for end < len(p.query) && !isSpace(p.query[end]) {
+		end++
+	}
+	return p.query[p.pos:end]
+}
+
+// errorf returns an error at the current position
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &Error{Column: utf8.RuneCountInString(p.query[:p.pos]) + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// parseTime parses a date, an RFC 3339 time or a unix timestamp into a unix time
+func parseTime(value string) (int64, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
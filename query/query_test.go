@@ -0,0 +1,167 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  string // the parsed expression formatted with every group in parentheses
+	}{
+		// AND binds tighter than OR, parentheses override it
+		{`name:a OR name:b AND name:c`, `(name:a OR (name:b AND name:c))`},
+		{`name:a AND name:b OR name:c`, `((name:a AND name:b) OR name:c)`},
+		{`(name:a OR name:b) AND name:c`, `((name:a OR name:b) AND name:c)`},
+		{`name:a and name:b or name:c`, `((name:a AND name:b) OR name:c)`},
+		{`((name:a))`, `name:a`},
+		// NOT binds tightest and nests
+		{`NOT name:a AND name:b`, `(NOT name:a AND name:b)`},
+		{`NOT NOT name:a`, `NOT NOT name:a`},
+		{`NOT (name:a OR NOT name:b)`, `NOT (name:a OR NOT name:b)`},
+		{`not(name:a)`, `NOT name:a`},
+		// a field starting with not is a term, not the NOT keyword
+		{`not_before>=2024-01-31`, `not_before>=2024-01-31`},
+		{`NOT not_after<2024-01-31`, `NOT not_after<2024-01-31`},
+		{`not_before:>=1706659200`, `not_before>=1706659200`},
+		// quoted and escaped values
+		{`issuer:"Let's Encrypt"`, `issuer:"Let's Encrypt"`},
+		{`issuer:"say \"hi\" \\ (now)"`, `issuer:"say \"hi\" \\ (now)"`},
+		{`name:*.bank.*`, `name:*.bank.*`},
+		{`(name:a)OR(name:b)`, `(name:a OR name:b)`},
+		{`wildcard:TRUE AND entry_type:precert`, `(wildcard:TRUE AND entry_type:precert)`},
+	} {
+		expr, err := Parse(test.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.query, err)
+			continue
+		}
+		if got := expr.String(); got != test.want {
+			t.Errorf("Parse(%q) = %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  swimModels.Expr
+	}{
+		{`issuer:"say \"hi\" \\"`, swimModels.Term{Field: "issuer", Op: ":", Value: `say "hi" \`}},
+		{`Wildcard:true`, swimModels.Term{Field: "wildcard", Op: ":", Value: "true", Bool: true}},
+		{`not_before>=2024-01-31`, swimModels.Term{Field: "not_before", Op: ">=", Value: "2024-01-31", Time: 1706659200}},
+		{`seen<2024-01-31T01:00:00Z`, swimModels.Term{Field: "seen", Op: "<", Value: "2024-01-31T01:00:00Z", Time: 1706662800}},
+		{`NOT not_after<=1706659200`, swimModels.Not{Expr: swimModels.Term{Field: "not_after", Op: "<=", Value: "1706659200", Time: 1706659200}}},
+	} {
+		expr, err := Parse(test.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(expr, test.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", test.query, expr, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		query  string
+		column int
+		msg    string // part of the message
+	}{
+		{``, 1, "empty query"},
+		{`   `, 1, "empty query"},
+		{strings.Repeat("x", MaxLength+1), 1, "too long"},
+		{`name:a)`, 7, "unexpected ), there is no ("},
+		{`name:a name:b`, 8, `unexpected "name:b"`},
+		{`(name:a`, 1, "missing ) to close this ("},
+		{`name:a AND (name:b OR name:c`, 12, "missing ) to close this ("},
+		{`)`, 1, "unexpected ), expected a term"},
+		{`name:a AND`, 11, "unexpected end of the query"},
+		{`NOT`, 4, "unexpected end of the query"},
+		{`AND name:a`, 1, "unexpected AND, expected a term before it"},
+		{`name:a OR OR name:b`, 11, "unexpected OR"},
+		{`foo:bar`, 1, `unknown field "foo"`},
+		{`ORDER:x`, 1, `unknown field "order"`},
+		{`bank`, 1, `expected a term like issuer:"Let's Encrypt", got "bank"`},
+		{`not_after:2024-01-31`, 10, "not_after is compared with <"},
+		{`name<a`, 5, "name can't be compared"},
+		{`name:`, 6, "missing value after name:"},
+		{`name: AND name:b`, 6, "missing value after name:"},
+		{`issuer:""`, 8, "empty value after issuer:"},
+		{`issuer:"Let's`, 8, `missing " to close this quoted value`},
+		{`wildcard:maybe`, 10, `invalid wildcard "maybe", expected true or false`},
+		{`not_before>=yesterday`, 13, `invalid not_before "yesterday"`},
+		{`entry_type:crl`, 12, `invalid entry_type "crl"`},
+		// columns count characters, not bytes
+		{`name:é name:b`, 8, `unexpected "name:b"`},
+	} {
+		_, err := Parse(test.query)
+		var syntaxErr *Error
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) returned %v, want a syntax error", test.query, err)
+			continue
+		}
+		if syntaxErr.Column != test.column || !strings.Contains(syntaxErr.Msg, test.msg) {
+			t.Errorf("Parse(%q) failed with %q at column %d, want %q at column %d", test.query, syntaxErr.Msg, syntaxErr.Column, test.msg, test.column)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("(", depth) + "name:a" + strings.Repeat(")", depth)
+	}
+	negated := func(depth int) string {
+		return strings.Repeat("NOT ", depth) + "name:a"
+	}
+	terms := func(n int) string {
+		return strings.TrimSuffix(strings.Repeat("name:a OR ", n), " OR ")
+	}
+
+	for _, query := range []string{nested(maxDepth), negated(maxDepth), terms(maxTerms)} {
+		if _, err := Parse(query); err != nil {
+			t.Errorf("Parse(%.40q...): %v", query, err)
+		}
+	}
+
+	for _, test := range []struct {
+		query  string
+		column int
+		msg    string
+	}{
+		// the error points at the group, NOT or term beyond the limit
+		{nested(maxDepth + 1), maxDepth + 1, "nested too deeply"},
+		{negated(maxDepth + 1), 4*maxDepth + 4, "nested too deeply"},
+		{"NOT " + nested(maxDepth), maxDepth + 4, "nested too deeply"},
+		{terms(maxTerms + 1), 10*maxTerms + 1, "too many terms"},
+	} {
+		_, err := Parse(test.query)
+		var syntaxErr *Error
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%.40q...) returned %v, want a syntax error", test.query, err)
+			continue
+		}
+		if syntaxErr.Column != test.column || !strings.Contains(syntaxErr.Msg, test.msg) {
+			t.Errorf("Parse(%.40q...) failed with %q at column %d, want %q at column %d", test.query, syntaxErr.Msg, syntaxErr.Column, test.msg, test.column)
+		}
+	}
+}
+
+func TestErrorPointer(t *testing.T) {
+	query := `name:a name:b`
+	_, err := Parse(query)
+	var syntaxErr *Error
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Parse(%q) returned %v, want a syntax error", query, err)
+	}
+	if got, want := syntaxErr.Pointer(query), "name:a name:b\n       ^"; got != want {
+		t.Errorf("pointer\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	swimModels "github.com/dap-ware/swim/models"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// domainProfile maps names the way they are looked up. Certificates do carry names that
+// are not valid host names, like _dmarc.example.com, so the STD3 rules are not enforced.
+var domainProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true), idna.StrictDomainName(false))
+
+// parseDomain parses a domain given in Unicode or ASCII into its ASCII form, the form
+// names are stored in
+func parseDomain(value string) (string, error) {
+	domain, err := domainProfile.ToASCII(strings.TrimSuffix(value, "."))
+	if err != nil || domain == "" {
+		return "", fmt.Errorf("invalid domain %q", value)
+	}
+	return domain, nil
+}
+
+// describeDomain fills in the forms of the domain of detail and where it is registered
+func describeDomain(detail *swimModels.DomainDetail) {
+	detail.Unicode = detail.Domain
+	if unicode, err := domainProfile.ToUnicode(detail.Domain); err == nil {
+		detail.Unicode = unicode
+	}
+
+	detail.PublicSuffix, detail.ICANN = publicsuffix.PublicSuffix(detail.Domain)
+	// a public suffix itself has no apex
+	if apex, err := publicsuffix.EffectiveTLDPlusOne(detail.Domain); err == nil {
+		detail.Apex = apex
+		detail.IsApex = apex == detail.Domain
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	swimModels "github.com/dap-ware/swim/models"
+)
+
+// fakeStore is a swimModels.Store keeping names and cert updates in maps, for testing the
+// handlers without a database. Every method fails with err when it is set.
+type fakeStore struct {
+	mu      sync.Mutex
+	names   map[string]*swimModels.Subdomain
+	apexes  map[string]bool
+	certs   map[string]bool
+	updates map[string]swimModels.CertUpdateInfo // by name and fingerprint
+	err     error
+	opts    swimModels.ListOptions // of the last listing
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		names:   make(map[string]*swimModels.Subdomain),
+		apexes:  make(map[string]bool),
+		certs:   make(map[string]bool),
+		updates: make(map[string]swimModels.CertUpdateInfo),
+	}
+}
+
+func (s *fakeStore) InsertBatch(batch []swimModels.CertUpdateInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	for _, u := range batch {
+		key := u.Domain + " " + u.Fingerprint
+		if _, ok := s.updates[key]; ok {
+			continue
+		}
+		s.updates[key] = u
+		s.certs[u.Fingerprint] = true
+		if u.IsApex {
+			s.apexes[u.Domain] = true
+		}
+
+		name, ok := s.names[u.Domain]
+		if !ok {
+			name = &swimModels.Subdomain{Name: u.Domain, FirstSeen: u.Seen, LastSeen: u.Seen}
+			s.names[u.Domain] = name
+		}
+		name.FirstSeen = min(name.FirstSeen, u.Seen)
+		name.LastSeen = max(name.LastSeen, u.Seen)
+		name.CertCount++
+		name.FirstSeenTime = time.Unix(name.FirstSeen, 0).Format(time.RFC3339)
+		name.LastSeenTime = time.Unix(name.LastSeen, 0).Format(time.RFC3339)
+	}
+	return nil
+}
+
+func (s *fakeStore) ListApexDomains(opts swimModels.ListOptions) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = opts
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var apexes []string
+	for apex := range s.apexes {
+		if opts.After == nil || apex > opts.After.Name {
+			apexes = append(apexes, apex)
+		}
+	}
+	slices.Sort(apexes)
+	return fakePage(apexes, opts), nil
+}
+
+func (s *fakeStore) ListSubdomains(domain string, opts swimModels.ListOptions) (*swimModels.DomainWithSubdomains, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	subs := []swimModels.Subdomain{}
+	for name, sub := range s.names {
+		below, ok := strings.CutSuffix(name, "."+domain)
+		if !ok || (opts.Depth > 0 && strings.Count(below, ".") >= opts.Depth) {
+			continue
+		}
+		if opts.After == nil || name > opts.After.Name {
+			subs = append(subs, *sub)
+		}
+	}
+	slices.SortFunc(subs, func(a, b swimModels.Subdomain) int { return strings.Compare(a.Name, b.Name) })
+	if opts.Keyset {
+		subs = fakePage(subs, opts)
+	}
+	return &swimModels.DomainWithSubdomains{Domain: domain, Subdomains: subs}, nil
+}
+
+func (s *fakeStore) ListCertUpdates(opts swimModels.ListOptions) ([]swimModels.CertUpdateInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = opts
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var updates []swimModels.CertUpdateInfo
+	for _, u := range s.updates {
+		if opts.Filter.Suffix != "" && u.Domain != opts.Filter.Suffix && !strings.HasSuffix(u.Domain, "."+opts.Filter.Suffix) {
+			continue
+		}
+		if opts.After != nil && (u.Domain < opts.After.Name || u.Domain == opts.After.Name && u.Fingerprint <= opts.After.Fingerprint) {
+			continue
+		}
+		name := s.names[u.Domain]
+		u.FirstSeen, u.LastSeen, u.CertCount = name.FirstSeen, name.LastSeen, name.CertCount
+		u.FirstSeenTime, u.LastSeenTime = name.FirstSeenTime, name.LastSeenTime
+		u.SeenTime = time.Unix(u.Seen, 0).Format(time.RFC3339)
+		updates = append(updates, u)
+	}
+	slices.SortFunc(updates, func(a, b swimModels.CertUpdateInfo) int {
+		if c := strings.Compare(a.Domain, b.Domain); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Fingerprint, b.Fingerprint)
+	})
+	return fakePage(updates, opts), nil
+}
+
+func (s *fakeStore) SearchNames(query swimModels.SearchQuery, opts swimModels.ListOptions) ([]swimModels.Subdomain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = opts
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var names []swimModels.Subdomain
+	for name, sub := range s.names {
+		if slices.ContainsFunc(query.Terms, func(term string) bool { return strings.Contains(name, term) }) {
+			names = append(names, *sub)
+		}
+	}
+	slices.SortFunc(names, func(a, b swimModels.Subdomain) int { return strings.Compare(a.Name, b.Name) })
+	return fakePage(names, opts), nil
+}
+
+func (s *fakeStore) Stats(opts swimModels.StatsOptions) (*swimModels.Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &swimModels.Stats{
+		Names:        int64(len(s.names)),
+		ApexDomains:  int64(len(s.apexes)),
+		Certificates: int64(len(s.certs)),
+		Hourly:       []swimModels.HourlyStats{},
+		TLDs:         []swimModels.TLDStats{},
+		Issuers:      []swimModels.IssuerStats{},
+	}, nil
+}
+
+func (s *fakeStore) Close() error {
+	return nil
+}
+
+// fakePage returns the page of items opts asks for, like the database: the first Size
+// items in keyset mode, else page Page of Size items, or all of them for a Size of 0
+func fakePage[T any](items []T, opts swimModels.ListOptions) []T {
+	if opts.Keyset {
+		return items[:min(opts.Size, len(items))]
+	}
+	if opts.Size <= 0 {
+		return items
+	}
+	start := min(max(opts.Page-1, 0)*opts.Size, len(items))
+	return items[start:min(start+opts.Size, len(items))]
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	swimModels "github.com/dap-ware/swim/models"
+	"github.com/gin-gonic/gin"
+)
+
+// formats lists the response formats of listings in the order they are documented
+var formats = []string{"json", "ndjson", "csv", "tsv", "text"}
+
+// contentTypes maps the response formats to their content types
+var contentTypes = map[string]string{
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv; charset=utf-8",
+	"tsv":    "text/tab-separated-values; charset=utf-8",
+	"text":   "text/plain; charset=utf-8",
+}
+
+// flushRows is the number of rows written between two flushes of a streamed response
+const flushRows = 100
+
+// negotiateFormat returns the response format asked for with the format query parameter,
+// or else the one the Accept header prefers: the highest q-value wins, then the type
+// listed first. */* stands for JSON, which is the default.
+func negotiateFormat(c *gin.Context) (string, error) {
+	if format := c.Query("format"); format != "" {
+		if _, ok := contentTypes[format]; !ok {
+			return "", fmt.Errorf("invalid format %q, expected one of %s", format, strings.Join(formats, ", "))
+		}
+		return format, nil
+	}
+
+	best, bestQ := "json", 0.0
+	for _, accept := range strings.Split(c.GetHeader("Accept"), ",") {
+		q := quality(accept)
+		if q <= bestQ {
+			continue
+		}
+		if mediaType(accept) == "*/*" {
+			best, bestQ = "json", q
+			continue
+		}
+		for _, format := range formats {
+			if mediaType(accept) == mediaType(contentTypes[format]) {
+				best, bestQ = format, q
+				break
+			}
+		}
+	}
+	return best, nil
+}
+
+// quality returns the q parameter of a media range of an Accept header, 1 without it. A
+// range with a malformed q-value is not acceptable.
+func quality(mediaRange string) float64 {
+	_, params, _ := strings.Cut(mediaRange, ";")
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.ToLower(strings.TrimSpace(name)) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+// mediaType strips the parameters from a content type
+func mediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// field is a column of the rows of a listing, named like its JSON key. Listings of plain
+// names have the single field domain.
+type field struct {
+	name  string
+	index []int
+}
+
+// value returns the field of row
+func (f field) value(row any) any {
+	if f.index == nil {
+		return row
+	}
+	return reflect.ValueOf(row).FieldByIndex(f.index).Interface()
+}
+
+// fieldsOf returns the fields of the rows of type T that are returned in JSON
+func fieldsOf[T any]() []field {
+	t := reflect.TypeOf(*new(T))
+	if t.Kind() != reflect.Struct {
+		return []field{{name: "domain"}}
+	}
+
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields = append(fields, field{name: name, index: t.Field(i).Index})
+		}
+	}
+	return fields
+}
+
+// parseFields parses the fields query parameter, a comma separated list of the fields of
+// T to return. Without it CSV and TSV return all fields, text only the domain and JSON
+// the rows as they are, which is returned as nil.
+func parseFields[T any](c *gin.Context, format string) ([]field, error) {
+	all := fieldsOf[T]()
+	value := c.Query("fields")
+	if value == "" {
+		switch format {
+		case "csv", "tsv":
+			return all, nil
+		case "text":
+			return all[:1], nil
+		}
+		return nil, nil
+	}
+
+	var fields []field
+	for _, name := range strings.Split(value, ",") {
+		i := slices.IndexFunc(all, func(f field) bool { return f.name == strings.TrimSpace(name) })
+		if i < 0 {
+			names := make([]string, len(all))
+			for i, f := range all {
+				names[i] = f.name
+			}
+			return nil, fmt.Errorf("invalid field %q, expected some of %s", name, strings.Join(names, ", "))
+		}
+		fields = append(fields, all[i])
+	}
+	return fields, nil
+}
+
+// rowWriter streams the rows of a listing in a response format. JSON rows form an array,
+// enclosed in open and close, NDJSON has a JSON document per line, CSV and TSV a header
+// line followed by a line per row, and text only the values of each row. The status and
+// headers are only sent with the first row, so an error before it can still be answered.
+type rowWriter[T any] struct {
+	c           *gin.Context
+	format      string
+	fields      []field
+	open, close string
+
+	enc     *json.Encoder
+	csv     *csv.Writer
+	started bool
+	rows    int
+}
+
+// newRowWriter returns a rowWriter in the format and with the fields the request asks
+// for, writing a plain JSON array of rows
+func newRowWriter[T any](c *gin.Context) (*rowWriter[T], error) {
+	format, err := negotiateFormat(c)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := parseFields[T](c, format)
+	if err != nil {
+		return nil, err
+	}
+	return &rowWriter[T]{c: c, format: format, fields: fields, open: "[", close: "]\n"}, nil
+}
+
+// start sends the status and headers, and what comes before the first row
+func (w *rowWriter[T]) start() error {
+	w.started = true
+	w.c.Header("Content-Type", contentTypes[w.format])
+	w.c.Status(http.StatusOK)
+	w.enc = json.NewEncoder(w.c.Writer)
+
+	switch w.format {
+	case "json":
+		_, err := io.WriteString(w.c.Writer, w.open)
+		return err
+	case "csv":
+		w.csv = csv.NewWriter(w.c.Writer)
+		return w.csv.Write(w.names())
+	case "tsv":
+		_, err := io.WriteString(w.c.Writer, strings.Join(w.names(), "\t")+"\n")
+		return err
+	}
+	return nil
+}
+
+// names returns the names of the fields written
+func (w *rowWriter[T]) names() []string {
+	names := make([]string, len(w.fields))
+	for i, f := range w.fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// write sends a row, an error means the client went away
+func (w *rowWriter[T]) write(row T) error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch w.format {
+	case "json", "ndjson":
+		if w.format == "json" && w.rows > 0 {
+			if _, err := io.WriteString(w.c.Writer, ","); err != nil {
+				return err
+			}
+		}
+		err = w.writeJSON(row)
+	case "csv":
+		values := w.values(row)
+		for i, v := range values {
+			values[i] = neutralizeFormula(v)
+		}
+		err = w.csv.Write(values)
+	default:
+		// TSV is opened by spreadsheets like CSV, text is for scripts and kept verbatim
+		values := w.values(row)
+		for i, v := range values {
+			if w.format == "tsv" {
+				v = neutralizeFormula(v)
+			}
+			values[i] = escapeTSV(v)
+		}
+		_, err = io.WriteString(w.c.Writer, strings.Join(values, "\t")+"\n")
+	}
+	if err != nil {
+		return err
+	}
+
+	w.rows++
+	if w.rows%flushRows == 0 {
+		w.flush()
+	}
+	return nil
+}
+
+// writeJSON encodes a row, as it is or as an object of the projected fields in their order
+func (w *rowWriter[T]) writeJSON(row T) error {
+	if w.fields == nil || w.fields[0].index == nil {
+		return w.enc.Encode(row)
+	}
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i, f := range w.fields {
+		value, err := json.Marshal(f.value(row))
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%q:%s", f.name, value)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w.c.Writer, b.String())
+	return err
+}
+
+// values formats the fields of a row as text
+func (w *rowWriter[T]) values(row T) []string {
+	values := make([]string, len(w.fields))
+	for i, f := range w.fields {
+		switch v := f.value(row).(type) {
+		case string:
+			values[i] = v
+		case bool:
+			values[i] = strconv.FormatBool(v)
+		case int64:
+			values[i] = strconv.FormatInt(v, 10)
+		default:
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	return values
+}
+
+// flush sends what was written so far to the client
+func (w *rowWriter[T]) flush() {
+	if w.csv != nil {
+		w.csv.Flush()
+	}
+	w.c.Writer.Flush()
+}
+
+// finish ends the response after the listing ended with err. Once rows were sent they
+// can't be taken back: a JSON array is left unterminated and NDJSON ends with an error
+// line, so clients can tell the response is incomplete. The other formats just end.
+func (w *rowWriter[T]) finish(err error, what string) {
+	if err != nil && !w.started {
+		respondError(w.c, err, what)
+		return
+	}
+	if err != nil {
+		log.Printf("Error streaming %s: %v", what, err)
+		if w.format == "ndjson" {
+			w.enc.Encode(gin.H{"error": "failed to fetch " + what})
+		}
+		w.flush()
+		return
+	}
+
+	if !w.started {
+		if err := w.start(); err != nil {
+			return
+		}
+	}
+	if w.format == "json" {
+		io.WriteString(w.c.Writer, w.close)
+	}
+	w.flush()
+}
+
+// writePage sends a page fetched with a cursor. JSON wraps the rows into an object with
+// the next cursor, all formats send it in the X-Next-Cursor header.
+func writePage[T any](w *rowWriter[T], page swimModels.Page[T], what string) {
+	if page.Next != "" {
+		w.c.Header("X-Next-Cursor", page.Next)
+	}
+	w.open, w.close = `{"items":[`, "]"+jsonMember("next", page.Next)+"}\n"
+	w.finish(each(page.Items, nil, w.write), what)
+}
+
+// jsonMember returns ,"name":"value" to append to a JSON object, nothing if value is empty
+func jsonMember(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	quoted, _ := json.Marshal(value)
+	return fmt.Sprintf(",%q:%s", name, quoted)
+}
+
+// neutralizeFormula prefixes CSV and TSV values that spreadsheets would run as a formula
+// with a quote. Certificates are written by anyone, their fields can't be trusted.
+func neutralizeFormula(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// tsvEscaper escapes the characters that can't appear in a TSV value
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// escapeTSV escapes tabs, line breaks and backslashes in a TSV or text value
+func escapeTSV(value string) string {
+	return tsvEscaper.Replace(value)
+}
+
+// respondError answers a request whose listing failed before anything was sent
+func respondError(c *gin.Context, err error, what string) {
+	if errors.Is(err, swimModels.ErrCursorUnsupported) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Error fetching %s from database: %v", what, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch " + what})
+}
+
+// each calls fn with the items of a listing that returned err
+func each[T any](items []T, err error, fn func(T) error) error {
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamApexDomains calls fn with the apex domains of a page as the store reads them, or
+// after reading all of them if it can't stream
+func streamApexDomains(store swimModels.Store, opts swimModels.ListOptions, fn func(string) error) error {
+	if streamer, ok := store.(swimModels.RowStreamer); ok {
+		return streamer.StreamApexDomains(opts, fn)
+	}
+	domains, err := store.ListApexDomains(opts)
+	return each(domains, err, fn)
+}
+
+// streamCertUpdates calls fn with the cert updates of a page like streamApexDomains
+func streamCertUpdates(store swimModels.Store, opts swimModels.ListOptions, fn func(swimModels.CertUpdateInfo) error) error {
+	if streamer, ok := store.(swimModels.RowStreamer); ok {
+		return streamer.StreamCertUpdates(opts, fn)
+	}
+	updates, err := store.ListCertUpdates(opts)
+	return each(updates, err, fn)
+}
+
+// streamSubdomains calls fn with the subdomains of domain like streamApexDomains
+func streamSubdomains(store swimModels.Store, domain string, opts swimModels.ListOptions, fn func(swimModels.Subdomain) error) error {
+	if streamer, ok := store.(swimModels.RowStreamer); ok {
+		return streamer.StreamSubdomains(domain, opts, fn)
+	}
+	subs, err := store.ListSubdomains(domain, opts)
+	if err != nil {
+		return err
+	}
+	return each(subs.Subdomains, nil, fn)
+}
@@ -1,20 +1,27 @@
 package server
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
-	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	swimConfig "github.com/dap-ware/swim/config"
-	swimDb "github.com/dap-ware/swim/database"
 	swimModels "github.com/dap-ware/swim/models"
+	swimQuery "github.com/dap-ware/swim/query"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -72,7 +79,35 @@ func (rl *RateLimiter) RateLimit() gin.HandlerFunc {
 }
 
 // StartServer starts the Gin server in a separate goroutine.
-func StartServer(db *sql.DB, wg *sync.WaitGroup, swimCfg *swimConfig.Config, baseDir string) (*http.Server, chan struct{}) {
+func StartServer(store swimModels.Store, wg *sync.WaitGroup, swimCfg *swimConfig.Config, baseDir string) (*http.Server, chan struct{}) {
+	srv := &http.Server{
+		Addr:    "localhost:8080",
+		Handler: NewRouter(store, swimCfg),
+		// TLS configuration
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	certFile := filepath.Join(baseDir, "cert", "cert.pem")
+	keyFile := filepath.Join(baseDir, "cert", "key.pem")
+
+	started := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Use the full paths for the certificate and key
+		if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("listen: %s\n", err)
+		}
+		close(started)
+	}()
+
+	return srv, started
+}
+
+// NewRouter returns the Gin engine serving the API from store.
+func NewRouter(store swimModels.Store, swimCfg *swimConfig.Config) *gin.Engine {
 	// get new rate limiter
 	rateLimiter := NewRateLimiter(swimCfg.Rate.Limit, swimCfg.Rate.ResetTime)
 
@@ -93,7 +128,7 @@ func StartServer(db *sql.DB, wg *sync.WaitGroup, swimCfg *swimConfig.Config, bas
 		c.Status(http.StatusOK)
 	})
 
-	server := &swimModels.Server{Db: db}
+	server := &swimModels.Server{Store: store}
 
 	// handler for fetching all domain names
 	r.GET("/v1/domains", func(c *gin.Context) {
@@ -103,122 +138,845 @@ func StartServer(db *sql.DB, wg *sync.WaitGroup, swimCfg *swimConfig.Config, bas
 			return
 		}
 
-		GetDomainNamesHandler(server, c, page, size)
+		since, until, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		keyset, after, err := parseCursor(c, "name", false, size)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		GetDomainNamesHandler(server, c, swimModels.ListOptions{Page: page, Size: size, Since: since, Until: until, Keyset: keyset, After: after})
+	})
+
+	// handler for fetching everything known about a name
+	r.GET("/v1/domains/:domain", func(c *gin.Context) {
+		domain, err := parseDomain(c.Param("domain"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		size, err := strconv.Atoi(c.DefaultQuery("size", "1000"))
+		if err != nil || size < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid size %q, expected a number of certificates or 0 for all", c.Query("size"))})
+			return
+		}
+
+		GetDomainDetailHandler(server, c, domain, size)
 	})
 
 	// handler for fetching certificate updates
 	r.GET("/v1/cert-updates", func(c *gin.Context) {
-		page, size, err := parseQueryParams(c)
+		opts, err := parseCertUpdateParams(c)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		GetCertUpdatesHandler(server, c, page, size)
+		GetCertUpdatesHandler(server, c, opts)
+	})
+
+	// handler for querying certificate updates with the query language
+	r.GET("/v1/query", func(c *gin.Context) {
+		q := c.Query("q")
+		if q == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing query, set q"})
+			return
+		}
+		query, err := swimQuery.Parse(q)
+		if err != nil {
+			response := gin.H{"error": "invalid query: " + err.Error()}
+			var syntaxErr *swimQuery.Error
+			if errors.As(err, &syntaxErr) {
+				response["column"] = syntaxErr.Column
+			}
+			c.JSON(http.StatusBadRequest, response)
+			return
+		}
+
+		opts, err := parseCertUpdateParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		opts.Query = query
+		GetCertUpdatesHandler(server, c, opts)
 	})
 
 	// handler for fetching subdomains
 	r.GET("/v1/subdomains/:domain", func(c *gin.Context) {
-		domain := c.Param("domain")
-		GetSubdomainsHandler(server, c, domain)
+		sort, desc, err := parseSortParams(c, swimModels.SortKeys)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		since, until, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		depth, err := strconv.Atoi(c.DefaultQuery("depth", "0"))
+		if err != nil || depth < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid depth %q, expected a number of labels or 0 for all", c.Query("depth"))})
+			return
+		}
+
+		archive, err := parseArchiveParam(c, "archive", swimCfg.Archive.Search)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// subdomains are only paged with a cursor, size defaults to the page size of the other listings
+		_, size, err := parseQueryParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		keyset, after, err := parseCursor(c, sort, desc, size)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		domain := strings.TrimSuffix(strings.ToLower(c.Param("domain")), ".")
+		GetSubdomainsHandler(server, c, domain, swimModels.ListOptions{Size: size, Sort: sort, Desc: desc, Depth: depth, Since: since, Until: until, Archive: archive, Keyset: keyset, After: after})
 	})
 
-	srv := &http.Server{
-		Addr:    "localhost:8080",
-		Handler: r,
-		// TLS configuration
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
-	}
+	// handler for looking up the sightings moved to the archive
+	r.GET("/v1/archive/:domain", func(c *gin.Context) {
+		page, size, err := parseQueryParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	certFile := filepath.Join(baseDir, "cert", "cert.pem")
-	keyFile := filepath.Join(baseDir, "cert", "key.pem")
+		since, until, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	started := make(chan struct{})
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		// Use the full paths for the certificate and key
-		if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+		subdomains, err := strconv.ParseBool(c.DefaultQuery("subdomains", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid subdomains %q, expected true or false", c.Query("subdomains"))})
+			return
 		}
-		close(started)
-	}()
 
-	return srv, started
-}
+		domain := strings.TrimSuffix(strings.ToLower(c.Param("domain")), ".")
+		SearchArchiveHandler(server, c, domain, subdomains, swimModels.ListOptions{Page: page, Size: size, Since: since, Until: until}, swimCfg.Archive.Search)
+	})
 
-func StreamResponse[T interface{}](c *gin.Context, dataChan chan []T, encodeFunc func(*json.Encoder, []T) error) {
-	c.Writer.Header().Set("Content-Type", "application/json")
-	c.Writer.WriteHeader(http.StatusOK)
-	encoder := json.NewEncoder(c.Writer)
+	// handler for listing names whose certificates are about to expire without a renewal
+	r.GET("/v1/expiring", func(c *gin.Context) {
+		within, err := time.ParseDuration(c.DefaultQuery("within", "72h"))
+		if err != nil || within <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid within %q, expected a duration like 72h", c.Query("within"))})
+			return
+		}
 
-	for chunk := range dataChan {
-		if err := encodeFunc(encoder, chunk); err != nil {
-			log.Printf("Error encoding response: %v", err)
+		var suffix string
+		if value := c.Query("suffix"); value != "" {
+			if suffix, err = parseDomain(value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		page, size, err := parseQueryParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-	}
-}
 
-func GetDomainNamesHandler(s *swimModels.Server, c *gin.Context, page int, size int) {
-	domainNames := make(chan []string)
-	go func() {
-		defer close(domainNames)
-		if err := swimDb.FetchDomainNamesFromDatabase(s.Db, domainNames, page, size); err != nil {
-			log.Printf("Error fetching domain names from database: %v", err)
+		now := time.Now()
+		expiry := swimModels.TimeRange{Since: now.Unix(), Until: now.Add(within).Unix()}
+		ListExpiringHandler(server, c, suffix, expiry, swimModels.ListOptions{Page: page, Size: size})
+	})
+
+	// handler for searching names
+	r.GET("/v1/search", func(c *gin.Context) {
+		query, err := parseSearchParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		page, size, err := parseQueryParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sort, desc, err := parseSortParams(c, swimModels.SortKeys)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-	}()
 
-	StreamResponse(c, domainNames, func(enc *json.Encoder, chunk []string) error {
-		return enc.Encode(chunk)
+		since, until, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		SearchNamesHandler(server, c, query, swimModels.ListOptions{Page: page, Size: size, Sort: sort, Desc: desc, Since: since, Until: until})
 	})
-}
 
-func GetCertUpdatesHandler(s *swimModels.Server, c *gin.Context, page int, size int) {
-	certUpdatesChan := make(chan []swimModels.CertUpdateInfo)
-	go func() {
-		defer close(certUpdatesChan)
-		updates, err := swimDb.FetchCertUpdatesFromDatabase(s.Db, page, size)
+	// handler for looking up certificates by serial number or key identifier
+	r.GET("/v1/certificates", func(c *gin.Context) {
+		lookup, err := parseCertificateLookup(c)
 		if err != nil {
-			log.Printf("Error fetching certificate updates from database: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		size, err := strconv.Atoi(c.DefaultQuery("size", "1000"))
+		if err != nil || size < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid size %q, expected a number of certificates or 0 for all", c.Query("size"))})
 			return
 		}
-		certUpdatesChan <- updates
-	}()
 
-	StreamResponse(c, certUpdatesChan, func(enc *json.Encoder, chunk []swimModels.CertUpdateInfo) error {
-		return enc.Encode(chunk)
+		LookupCertificatesHandler(server, c, lookup, size)
 	})
-}
 
-func GetSubdomainsHandler(s *swimModels.Server, c *gin.Context, domain string) {
-	subdomains := make(chan []swimModels.DomainWithSubdomains)
-	go func() {
-		defer close(subdomains)
-		subs, err := swimDb.FetchSubdomainsFromDatabase(s.Db, domain)
+	// handler for fetching stored certificates, as JSON or downloaded with .pem or .der
+	r.GET("/v1/certificates/:fingerprint", func(c *gin.Context) {
+		param := c.Param("fingerprint")
+		format := strings.TrimPrefix(filepath.Ext(param), ".")
+		if format != "" && format != "pem" && format != "der" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "expected a fingerprint, optionally ending in .pem or .der"})
+			return
+		}
+
+		fingerprint, err := parseFingerprint(strings.TrimSuffix(param, "."+format))
 		if err != nil {
-			log.Printf("Error fetching subdomains from database: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		subdomains <- []swimModels.DomainWithSubdomains{*subs}
-	}()
 
-	StreamResponse(c, subdomains, func(enc *json.Encoder, chunk []swimModels.DomainWithSubdomains) error {
-		return enc.Encode(chunk)
+		if format == "" {
+			GetCertificateHandler(server, c, fingerprint)
+			return
+		}
+		GetRawCertificateHandler(server, c, fingerprint, format)
+	})
+
+	// handler for fetching storage and ingestion statistics
+	r.GET("/v1/stats", func(c *gin.Context) {
+		since, until, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		top, err := strconv.Atoi(c.DefaultQuery("top", "20"))
+		if err != nil || top < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid top %q, expected a number of entries or 0 for all", c.Query("top"))})
+			return
+		}
+
+		GetStatsHandler(server, c, swimModels.StatsOptions{Since: since, Until: until, Top: top})
+	})
+
+	// admin endpoints, only reachable with the configured token
+	admin := r.Group("/v1/admin", requireToken(swimCfg.Admin.Token))
+	admin.POST("/snapshot", func(c *gin.Context) {
+		CreateSnapshotHandler(server, c, swimCfg.Backup.Dir, swimCfg.Backup.Keep)
 	})
+
+	return r
+}
+
+func GetDomainNamesHandler(s *swimModels.Server, c *gin.Context, opts swimModels.ListOptions) {
+	w, err := newRowWriter[string](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if opts.Keyset {
+		page, ok := keysetPage(c, opts, s.Store.ListApexDomains, func(name string) swimModels.Cursor {
+			return swimModels.Cursor{Sort: "name", Name: name}
+		})
+		if ok {
+			writePage(w, page, "domain names")
+		}
+		return
+	}
+
+	w.finish(streamApexDomains(s.Store, opts, w.write), "domain names")
 }
 
-// parseQueryParams parses and validates query parameters.
+func GetCertUpdatesHandler(s *swimModels.Server, c *gin.Context, opts swimModels.ListOptions) {
+	w, err := newRowWriter[swimModels.CertUpdateInfo](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if opts.Keyset {
+		page, ok := keysetPage(c, opts, s.Store.ListCertUpdates, func(u swimModels.CertUpdateInfo) swimModels.Cursor {
+			cursor := nameCursor(opts, u.Domain, u.FirstSeen, u.LastSeen)
+			cursor.NotBefore, cursor.Fingerprint = u.NotBefore, u.Fingerprint
+			switch opts.Sort {
+			case "seen":
+				cursor.Value = u.Seen
+			case "not_before":
+				cursor.Value = u.NotBefore
+			}
+			return cursor
+		})
+		if ok {
+			writePage(w, page, "certificate updates")
+		}
+		return
+	}
+
+	w.finish(streamCertUpdates(s.Store, opts, w.write), "certificate updates")
+}
+
+func GetSubdomainsHandler(s *swimModels.Server, c *gin.Context, domain string, opts swimModels.ListOptions) {
+	w, err := newRowWriter[swimModels.Subdomain](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the JSON response is a list holding the domain with its subdomains
+	quoted, _ := json.Marshal(domain)
+	w.open, w.close = `[{"domain":`+string(quoted)+`,"subdomains":[`, "]}]\n"
+
+	if opts.Keyset {
+		list := func(opts swimModels.ListOptions) ([]swimModels.Subdomain, error) {
+			subs, err := s.Store.ListSubdomains(domain, opts)
+			if err != nil {
+				return nil, err
+			}
+			return subs.Subdomains, nil
+		}
+		page, ok := keysetPage(c, opts, list, func(n swimModels.Subdomain) swimModels.Cursor {
+			return nameCursor(opts, n.Name, n.FirstSeen, n.LastSeen)
+		})
+		if !ok {
+			return
+		}
+		if page.Next != "" {
+			c.Header("X-Next-Cursor", page.Next)
+		}
+		w.close = "]" + jsonMember("next", page.Next) + "}]\n"
+		w.finish(each(page.Items, nil, w.write), "subdomains")
+		return
+	}
+
+	w.finish(streamSubdomains(s.Store, domain, opts, w.write), "subdomains")
+}
+
+// keysetPage fetches a page of a listing requested with a cursor, cursor returns the
+// position of a row. One row more than asked for is fetched to tell whether another page
+// follows. Errors are answered, ok is false then.
+func keysetPage[T any](c *gin.Context, opts swimModels.ListOptions, list func(swimModels.ListOptions) ([]T, error), cursor func(T) swimModels.Cursor) (page swimModels.Page[T], ok bool) {
+	size := opts.Size
+	opts.Size++
+	items, err := list(opts)
+	if err != nil {
+		respondError(c, err, "page")
+		return page, false
+	}
+
+	page.Items = items
+	if len(items) > size {
+		page.Items = items[:size]
+		page.Next = encodeCursor(cursor(items[size-1]))
+	}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	return page, true
+}
+
+// nameCursor returns the cursor after a name of a listing ordered like opts
+func nameCursor(opts swimModels.ListOptions, name string, firstSeen, lastSeen int64) swimModels.Cursor {
+	cursor := swimModels.Cursor{Sort: opts.Sort, Desc: opts.Desc, Name: name}
+	switch opts.Sort {
+	case "first_seen":
+		cursor.Value = firstSeen
+	case "last_seen":
+		cursor.Value = lastSeen
+	}
+	return cursor
+}
+
+func SearchNamesHandler(s *swimModels.Server, c *gin.Context, query swimModels.SearchQuery, opts swimModels.ListOptions) {
+	w, err := newRowWriter[swimModels.Subdomain](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	names, err := s.Store.SearchNames(query, opts)
+	w.finish(each(names, err, w.write), "names")
+}
+
+func SearchArchiveHandler(s *swimModels.Server, c *gin.Context, domain string, subdomains bool, opts swimModels.ListOptions, enabled bool) {
+	searcher, ok := s.Store.(swimModels.ArchiveSearcher)
+	if !ok || !enabled {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "archive search is not enabled, set archive.search in the config"})
+		return
+	}
+
+	w, err := newRowWriter[swimModels.CertUpdateInfo](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates, err := searcher.SearchArchive(domain, subdomains, opts)
+	w.finish(each(updates, err, w.write), "archived sightings")
+}
+
+func ListExpiringHandler(s *swimModels.Server, c *gin.Context, suffix string, expiry swimModels.TimeRange, opts swimModels.ListOptions) {
+	expiryStore, ok := s.Store.(swimModels.ExpiryStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "expiring certificates are not available for this database"})
+		return
+	}
+
+	w, err := newRowWriter[swimModels.CertUpdateInfo](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates, err := expiryStore.ListExpiring(suffix, expiry, opts)
+	w.finish(each(updates, err, w.write), "expiring certificates")
+}
+
+func GetDomainDetailHandler(s *swimModels.Server, c *gin.Context, domain string, size int) {
+	certStore, ok := s.Store.(swimModels.CertificateStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "certificate lookups are not available for this database"})
+		return
+	}
+
+	detail, err := certStore.DomainDetail(domain, size)
+	if err != nil {
+		log.Printf("Error fetching domain from database: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch domain"})
+		return
+	}
+	if detail == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "domain not found"})
+		return
+	}
+
+	describeDomain(detail)
+	c.JSON(http.StatusOK, detail)
+}
+
+func GetCertificateHandler(s *swimModels.Server, c *gin.Context, fingerprint string) {
+	certStore, ok := s.Store.(swimModels.CertificateStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "certificate lookups are not available for this database"})
+		return
+	}
+
+	cert, err := certStore.Certificate(fingerprint)
+	if err != nil {
+		log.Printf("Error fetching certificate from database: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch certificate"})
+		return
+	}
+	if cert == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "certificate not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cert)
+}
+
+func LookupCertificatesHandler(s *swimModels.Server, c *gin.Context, lookup swimModels.CertificateLookup, size int) {
+	certStore, ok := s.Store.(swimModels.CertificateStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "certificate lookups are not available for this database"})
+		return
+	}
+
+	certs, err := certStore.LookupCertificates(lookup, size)
+	if err != nil {
+		log.Printf("Error looking up certificates in database: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to look up certificates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, certs)
+}
+
+func GetRawCertificateHandler(s *swimModels.Server, c *gin.Context, fingerprint, format string) {
+	rawStore, ok := s.Store.(swimModels.RawCertificateStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "certificates are not stored by this database"})
+		return
+	}
+
+	cert, err := rawStore.RawCertificate(fingerprint)
+	if err != nil {
+		log.Printf("Error fetching certificate from database: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch certificate"})
+		return
+	}
+	if cert == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "certificate not stored, swim keeps certificates with database.rawcertificates set"})
+		return
+	}
+
+	name := strings.ReplaceAll(fingerprint, ":", "") + "." + format
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if format == "der" {
+		c.Data(http.StatusOK, "application/pkix-cert", cert.DER)
+		return
+	}
+
+	// the PEM file holds the certificate followed by its chain
+	var out []byte
+	for _, der := range append([][]byte{cert.DER}, cert.Chain...) {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	c.Data(http.StatusOK, "application/x-pem-file", out)
+}
+
+func GetStatsHandler(s *swimModels.Server, c *gin.Context, opts swimModels.StatsOptions) {
+	stats, err := s.Store.Stats(opts)
+	if err != nil {
+		log.Printf("Error fetching stats from database: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+func CreateSnapshotHandler(s *swimModels.Server, c *gin.Context, dir string, keep int) {
+	snapshotter, ok := s.Store.(swimModels.Snapshotter)
+	if !ok || dir == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "snapshots are not available for this database"})
+		return
+	}
+
+	snapshot, err := snapshotter.Snapshot(dir, keep)
+	if err != nil {
+		log.Printf("Error writing snapshot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to write snapshot"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, snapshot)
+}
+
+// requireToken rejects requests that don't carry token as bearer token. Without a token
+// every request is rejected.
+func requireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin endpoints are disabled, set admin.token in the config"})
+			return
+		}
+
+		given, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing bearer token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// maxPageSize bounds the pages of listings. Only NDJSON responses, the format meant for
+// exports, list everything for a size of 0 or take larger pages.
+const maxPageSize = 10000
+
+// parseQueryParams parses and validates the page and size query parameters. A size of 0
+// is a page of maxPageSize rows, all of them in NDJSON.
 func parseQueryParams(c *gin.Context) (int, int, error) {
 	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
-	if err != nil {
-		return 0, 0, err
+	if err != nil || page < 1 {
+		return 0, 0, fmt.Errorf("invalid page %q, expected a page number from 1", c.Query("page"))
 	}
 	size, err := strconv.Atoi(c.DefaultQuery("size", "1000"))
+	if err != nil || size < 0 {
+		return 0, 0, fmt.Errorf("invalid size %q, expected a number of rows per page", c.Query("size"))
+	}
+
+	format, err := negotiateFormat(c)
 	if err != nil {
 		return 0, 0, err
 	}
+	if format != "ndjson" {
+		if size > maxPageSize {
+			return 0, 0, fmt.Errorf("invalid size %d, expected at most %d, export larger listings with format=ndjson", size, maxPageSize)
+		}
+		// cursor pages need a size, parseCursor rejects 0
+		if _, cursor := c.GetQuery("cursor"); size == 0 && !cursor {
+			size = maxPageSize
+		}
+	}
+	if size > 0 && page > math.MaxInt32/size {
+		return 0, 0, fmt.Errorf("invalid page %d, too far into the listing", page)
+	}
 	return page, size, nil
 }
+
+// parseCursor parses the cursor query parameter, which selects cursor pagination: a
+// missing cursor pages with page and size, an empty one starts at the first page. A
+// cursor continues the listing it was returned by, in the same order.
+func parseCursor(c *gin.Context, sort string, desc bool, size int) (bool, *swimModels.Cursor, error) {
+	value, ok := c.GetQuery("cursor")
+	if !ok {
+		return false, nil, nil
+	}
+	if size < 1 {
+		return false, nil, fmt.Errorf("invalid size %d, expected at least 1", size)
+	}
+	if value == "" {
+		return true, nil, nil
+	}
+
+	var cursor swimModels.Cursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		return false, nil, fmt.Errorf("invalid cursor %q, pass the next cursor of the previous page", value)
+	}
+	if cursor.Sort != sort || cursor.Desc != desc {
+		return false, nil, fmt.Errorf("cursor belongs to a listing in another order, pass the same sort and order")
+	}
+	return true, &cursor, nil
+}
+
+// encodeCursor encodes cursor into the opaque string handed to clients
+func encodeCursor(cursor swimModels.Cursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseSortParams parses and validates the sort and order query parameters, keys lists
+// the sort keys of the listing.
+func parseSortParams(c *gin.Context, keys []string) (string, bool, error) {
+	sort := c.DefaultQuery("sort", "name")
+	if !slices.Contains(keys, sort) {
+		return "", false, fmt.Errorf("invalid sort %q, expected one of %s", sort, strings.Join(keys, ", "))
+	}
+
+	switch order := c.DefaultQuery("order", "asc"); order {
+	case "asc":
+		return sort, false, nil
+	case "desc":
+		return sort, true, nil
+	default:
+		return "", false, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+}
+
+// maxSearchTerms limits how many alternatives a single search can ask for
+const maxSearchTerms = 20
+
+// parseSearchParams parses the q and mode parameters of a search. q holds one or more
+// terms separated by commas or spaces, and can be given several times.
+func parseSearchParams(c *gin.Context) (swimModels.SearchQuery, error) {
+	var query swimModels.SearchQuery
+	for _, q := range c.QueryArray("q") {
+		for _, term := range strings.FieldsFunc(q, func(r rune) bool { return r == ',' || r == ' ' }) {
+			query.Terms = append(query.Terms, strings.ToLower(term))
+		}
+	}
+
+	query.Mode = c.DefaultQuery("mode", "substring")
+	if !slices.Contains(swimModels.SearchModes, query.Mode) {
+		return query, fmt.Errorf("invalid mode %q, expected one of %s", query.Mode, strings.Join(swimModels.SearchModes, ", "))
+	}
+	if query.Mode == "label" {
+		// labels are matched between dots, so dots around a term add nothing
+		for i, term := range query.Terms {
+			query.Terms[i] = strings.Trim(term, ".")
+		}
+		query.Terms = slices.DeleteFunc(query.Terms, func(term string) bool { return term == "" })
+	}
+
+	if len(query.Terms) == 0 {
+		return query, fmt.Errorf("missing search term, set q")
+	}
+	if len(query.Terms) > maxSearchTerms {
+		return query, fmt.Errorf("too many search terms, at most %d are allowed", maxSearchTerms)
+	}
+	return query, nil
+}
+
+// parseArchiveParam parses a boolean query parameter asking to include the archive, which
+// is only allowed when archive search is enabled
+func parseArchiveParam(c *gin.Context, param string, enabled bool) (bool, error) {
+	archive, err := strconv.ParseBool(c.DefaultQuery(param, "false"))
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, expected true or false", param, c.Query(param))
+	}
+	if archive && !enabled {
+		return false, fmt.Errorf("archive search is not enabled, set archive.search in the config")
+	}
+	return archive, nil
+}
+
+// parseFingerprint parses a SHA-1 certificate fingerprint given as hex, with or without
+// colons between the bytes, into the format CertStream uses
+func parseFingerprint(value string) (string, error) {
+	digits := strings.ToUpper(strings.ReplaceAll(value, ":", ""))
+	if _, err := hex.DecodeString(digits); err != nil || len(digits) != 40 {
+		return "", fmt.Errorf("invalid fingerprint %q, expected a SHA-1 fingerprint in hex", value)
+	}
+
+	pairs := make([]string, 0, 20)
+	for i := 0; i < len(digits); i += 2 {
+		pairs = append(pairs, digits[i:i+2])
+	}
+	return strings.Join(pairs, ":"), nil
+}
+
+// parseCertificateLookup parses the serial, subject_key_id and authority_key_id query
+// parameters, given as hex with or without colons. At least one of them is required.
+func parseCertificateLookup(c *gin.Context) (swimModels.CertificateLookup, error) {
+	var lookup swimModels.CertificateLookup
+	for _, param := range []struct {
+		name  string
+		value *string
+	}{
+		{"serial", &lookup.Serial},
+		{"subject_key_id", &lookup.SubjectKeyID},
+		{"authority_key_id", &lookup.AuthorityKeyID},
+	} {
+		value := strings.TrimSpace(c.Query(param.name))
+		if value == "" {
+			continue
+		}
+		// key identifiers are printed as keyid:XX:XX by OpenSSL
+		digits := strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(value, "keyid:"), ":", ""))
+		if _, err := hex.DecodeString(strings.Repeat("0", len(digits)%2) + digits); err != nil || len(digits) > 128 {
+			return lookup, fmt.Errorf("invalid %s %q, expected hex digits", param.name, value)
+		}
+		*param.value = digits
+	}
+
+	if lookup == (swimModels.CertificateLookup{}) {
+		return lookup, fmt.Errorf("missing lookup, set serial, subject_key_id or authority_key_id")
+	}
+	return lookup, nil
+}
+
+// parseTimeRange parses the since and until query parameters, given as RFC 3339 times or
+// unix timestamps. A missing parameter is returned as 0.
+func parseTimeRange(c *gin.Context) (int64, int64, error) {
+	return parseTimeParams(c, "since", "until")
+}
+
+// parseTimeParams parses the bounds of a time range from the query parameters named
+// sinceParam and untilParam like parseTimeRange
+func parseTimeParams(c *gin.Context, sinceParam, untilParam string) (int64, int64, error) {
+	var bounds [2]int64
+	for i, param := range []string{sinceParam, untilParam} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+			bounds[i] = ts
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s %q, expected an RFC 3339 time or unix timestamp", param, value)
+		}
+		bounds[i] = t.Unix()
+	}
+
+	if bounds[0] > 0 && bounds[1] > 0 && bounds[1] <= bounds[0] {
+		return 0, 0, fmt.Errorf("%s must be after %s", untilParam, sinceParam)
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// parseCertUpdateParams parses the paging, order and filter query parameters of cert
+// update listings
+func parseCertUpdateParams(c *gin.Context) (swimModels.ListOptions, error) {
+	page, size, err := parseQueryParams(c)
+	if err != nil {
+		return swimModels.ListOptions{}, err
+	}
+
+	sort, desc, err := parseSortParams(c, swimModels.CertSortKeys)
+	if err != nil {
+		return swimModels.ListOptions{}, err
+	}
+
+	since, until, err := parseTimeRange(c)
+	if err != nil {
+		return swimModels.ListOptions{}, err
+	}
+
+	filter, err := parseCertFilter(c)
+	if err != nil {
+		return swimModels.ListOptions{}, err
+	}
+
+	keyset, after, err := parseCursor(c, sort, desc, size)
+	if err != nil {
+		return swimModels.ListOptions{}, err
+	}
+
+	return swimModels.ListOptions{Page: page, Size: size, Sort: sort, Desc: desc, Since: since, Until: until, Filter: filter, Keyset: keyset, After: after}, nil
+}
+
+// parseCertFilter parses the query parameters filtering cert updates
+func parseCertFilter(c *gin.Context) (swimModels.CertFilter, error) {
+	filter := swimModels.CertFilter{
+		Name:      strings.TrimSuffix(c.Query("name"), "."),
+		Suffix:    strings.Trim(c.Query("suffix"), "."),
+		Issuer:    c.Query("issuer"),
+		EntryType: c.Query("entry_type"),
+		KeyUsage:  c.Query("key_usage"),
+	}
+	if filter.EntryType != "" && !slices.Contains(swimModels.EntryTypes, filter.EntryType) {
+		return filter, fmt.Errorf("invalid entry_type %q, expected one of %s", filter.EntryType, strings.Join(swimModels.EntryTypes, ", "))
+	}
+
+	flags := []struct {
+		param string
+		value **bool
+	}{{"wildcard", &filter.Wildcard}, {"apex", &filter.Apex}}
+	for _, flag := range flags {
+		value := c.Query(flag.param)
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s %q, expected true or false", flag.param, value)
+		}
+		*flag.value = &b
+	}
+
+	var err error
+	filter.NotBefore.Since, filter.NotBefore.Until, err = parseTimeParams(c, "not_before_since", "not_before_until")
+	if err != nil {
+		return filter, err
+	}
+	filter.NotAfter.Since, filter.NotAfter.Until, err = parseTimeParams(c, "not_after_since", "not_after_until")
+	return filter, err
+}
@@ -0,0 +1,494 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	swimConfig "github.com/dap-ware/swim/config"
+	swimModels "github.com/dap-ware/swim/models"
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// errStore is the error the fake store fails with in the error path tests
+var errStore = errors.New("database is locked")
+
+// testUpdates are the cert updates the tests are run against, two certificates for
+// example.com and one for example.org
+var testUpdates = []swimModels.CertUpdateInfo{
+	{Domain: "example.com", IsApex: true, ParentDomain: "example.com", Fingerprint: "AA", Issuer: "Let's Encrypt", Seen: 1000},
+	{Domain: "www.example.com", ParentDomain: "example.com", Fingerprint: "AA", Issuer: "Let's Encrypt", Seen: 1000},
+	{Domain: "api.example.com", ParentDomain: "example.com", Fingerprint: "AA", Issuer: "Let's Encrypt", Seen: 1000},
+	{Domain: "a.b.example.com", ParentDomain: "example.com", Fingerprint: "BB", Issuer: "=HYPERLINK(\"x\")", Seen: 2000},
+	{Domain: "example.com", IsApex: true, ParentDomain: "example.com", Fingerprint: "BB", Issuer: "=HYPERLINK(\"x\")", Seen: 2000},
+	{Domain: "example.org", IsApex: true, ParentDomain: "example.org", Fingerprint: "CC", Issuer: "DigiCert Inc", Seen: 3000},
+	{Domain: "mail.example.org", ParentDomain: "example.org", Fingerprint: "CC", Issuer: "DigiCert Inc", Seen: 3000},
+}
+
+// apiTest is a request to the API and the response expected for it
+type apiTest struct {
+	name   string
+	url    string
+	accept string // Accept header, none if empty
+	err    error  // error the store fails with
+	status int
+	want   string // JSON compared to the response, or its exact body in other formats; unchecked if empty
+	next   string // X-Next-Cursor header
+}
+
+// runAPITests runs each test against a router serving testUpdates from a fake store
+func runAPITests(t *testing.T, tests []apiTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newFakeStore()
+			if err := store.InsertBatch(testUpdates); err != nil {
+				t.Fatal(err)
+			}
+			store.err = test.err
+			r := NewRouter(store, swimConfig.GetDefaultConfig())
+
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("GET %s: status %d, want %d, body %s", test.url, rec.Code, test.status, rec.Body)
+			}
+			if next := rec.Header().Get("X-Next-Cursor"); next != test.next {
+				t.Errorf("GET %s: X-Next-Cursor %q, want %q", test.url, next, test.next)
+			}
+			if test.want == "" {
+				return
+			}
+			if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+				assertJSON(t, rec.Body.String(), test.want)
+			} else if rec.Body.String() != test.want {
+				t.Errorf("GET %s: body\n%s\nwant\n%s", test.url, rec.Body, test.want)
+			}
+		})
+	}
+}
+
+// assertJSON compares two JSON documents
+func assertJSON(t *testing.T, got, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatalf("invalid JSON %q: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("invalid expected JSON %q: %v", want, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got JSON\n%s\nwant\n%s", got, want)
+	}
+}
+
+// timeString formats a unix time like the store does
+func timeString(ts int64) string {
+	return time.Unix(ts, 0).Format(time.RFC3339)
+}
+
+// cursorAfter returns the encoded cursor of a name sorted listing after name
+func cursorAfter(name, fingerprint string) string {
+	return encodeCursor(swimModels.Cursor{Sort: "name", Name: name, Fingerprint: fingerprint})
+}
+
+func TestListApexDomains(t *testing.T) {
+	runAPITests(t, []apiTest{
+		{name: "all", url: "/v1/domains", status: http.StatusOK, want: `["example.com","example.org"]`},
+		{name: "page", url: "/v1/domains?page=2&size=1", status: http.StatusOK, want: `["example.org"]`},
+		{name: "past last page", url: "/v1/domains?page=3&size=1", status: http.StatusOK, want: `[]`},
+		{name: "first cursor page", url: "/v1/domains?size=1&cursor=", status: http.StatusOK,
+			want: `{"items":["example.com"],"next":"` + cursorAfter("example.com", "") + `"}`, next: cursorAfter("example.com", "")},
+		{name: "last cursor page", url: "/v1/domains?size=1&cursor=" + cursorAfter("example.com", ""), status: http.StatusOK,
+			want: `{"items":["example.org"]}`},
+		{name: "text", url: "/v1/domains?format=text", status: http.StatusOK, want: "example.com\nexample.org\n"},
+		{name: "csv by accept", url: "/v1/domains", accept: "text/csv", status: http.StatusOK, want: "domain\nexample.com\nexample.org\n"},
+		{name: "accept by q-value", url: "/v1/domains", accept: "text/csv;q=0.1, application/json", status: http.StatusOK,
+			want: `["example.com","example.org"]`},
+		{name: "accept higher q-value listed last", url: "/v1/domains", accept: "application/json;q=0.5, text/plain", status: http.StatusOK,
+			want: "example.com\nexample.org\n"},
+		{name: "accept first of equal q-values", url: "/v1/domains", accept: "text/plain, text/csv", status: http.StatusOK,
+			want: "example.com\nexample.org\n"},
+		{name: "accept wildcard", url: "/v1/domains", accept: "text/csv;q=0.5, */*", status: http.StatusOK,
+			want: `["example.com","example.org"]`},
+		{name: "accept q=0", url: "/v1/domains", accept: "text/csv;q=0", status: http.StatusOK,
+			want: `["example.com","example.org"]`},
+		{name: "invalid page", url: "/v1/domains?page=one", status: http.StatusBadRequest},
+		{name: "page 0", url: "/v1/domains?page=0", status: http.StatusBadRequest,
+			want: `{"error":"invalid page \"0\", expected a page number from 1"}`},
+		{name: "invalid size", url: "/v1/domains?size=many", status: http.StatusBadRequest},
+		{name: "negative size", url: "/v1/domains?size=-1", status: http.StatusBadRequest,
+			want: `{"error":"invalid size \"-1\", expected a number of rows per page"}`},
+		{name: "size above maximum", url: "/v1/domains?size=10001", status: http.StatusBadRequest,
+			want: `{"error":"invalid size 10001, expected at most 10000, export larger listings with format=ndjson"}`},
+		{name: "page too far", url: "/v1/domains?page=1000000&size=10000", status: http.StatusBadRequest},
+		{name: "ndjson size above maximum", url: "/v1/domains?size=20000&format=ndjson", status: http.StatusOK,
+			want: "\"example.com\"\n\"example.org\"\n"},
+		{name: "invalid since", url: "/v1/domains?since=yesterday", status: http.StatusBadRequest,
+			want: `{"error":"invalid since \"yesterday\", expected an RFC 3339 time or unix timestamp"}`},
+		{name: "until before since", url: "/v1/domains?since=2000&until=1000", status: http.StatusBadRequest,
+			want: `{"error":"until must be after since"}`},
+		{name: "invalid cursor", url: "/v1/domains?cursor=garbage", status: http.StatusBadRequest,
+			want: `{"error":"invalid cursor \"garbage\", pass the next cursor of the previous page"}`},
+		{name: "cursor without size", url: "/v1/domains?size=0&cursor=", status: http.StatusBadRequest},
+		{name: "invalid format", url: "/v1/domains?format=xml", status: http.StatusBadRequest,
+			want: `{"error":"invalid format \"xml\", expected one of json, ndjson, csv, tsv, text"}`},
+		{name: "store error", url: "/v1/domains", err: errStore, status: http.StatusInternalServerError,
+			want: `{"error":"failed to fetch domain names"}`},
+		{name: "store error on cursor page", url: "/v1/domains?cursor=", err: errStore, status: http.StatusInternalServerError,
+			want: `{"error":"failed to fetch page"}`},
+		{name: "unsupported cursor", url: "/v1/domains?cursor=", err: swimModels.ErrCursorUnsupported, status: http.StatusBadRequest,
+			want: `{"error":"` + swimModels.ErrCursorUnsupported.Error() + `"}`},
+	})
+}
+
+func TestListSubdomains(t *testing.T) {
+	runAPITests(t, []apiTest{
+		{name: "all", url: "/v1/subdomains/example.com?fields=domain", status: http.StatusOK,
+			want: `[{"domain":"example.com","subdomains":[{"domain":"a.b.example.com"},{"domain":"api.example.com"},{"domain":"www.example.com"}]}]`},
+		{name: "history", url: "/v1/subdomains/example.org", status: http.StatusOK,
+			want: `[{"domain":"example.org","subdomains":[{"domain":"mail.example.org","first_seen":"` + timeString(3000) + `","last_seen":"` + timeString(3000) + `","cert_count":1}]}]`},
+		{name: "depth", url: "/v1/subdomains/example.com?depth=1&fields=domain", status: http.StatusOK,
+			want: `[{"domain":"example.com","subdomains":[{"domain":"api.example.com"},{"domain":"www.example.com"}]}]`},
+		{name: "trailing dot and case", url: "/v1/subdomains/EXAMPLE.org.?fields=domain", status: http.StatusOK,
+			want: `[{"domain":"example.org","subdomains":[{"domain":"mail.example.org"}]}]`},
+		{name: "unknown domain", url: "/v1/subdomains/example.net", status: http.StatusOK,
+			want: `[{"domain":"example.net","subdomains":[]}]`},
+		{name: "cursor", url: "/v1/subdomains/example.com?fields=domain&size=2&cursor=", status: http.StatusOK,
+			want: `[{"domain":"example.com","subdomains":[{"domain":"a.b.example.com"},{"domain":"api.example.com"}],"next":"` + cursorAfter("api.example.com", "") + `"}]`,
+			next: cursorAfter("api.example.com", "")},
+		{name: "tsv", url: "/v1/subdomains/example.com?format=tsv&fields=domain,cert_count", status: http.StatusOK,
+			want: "domain\tcert_count\na.b.example.com\t1\napi.example.com\t1\nwww.example.com\t1\n"},
+		{name: "invalid sort", url: "/v1/subdomains/example.com?sort=size", status: http.StatusBadRequest,
+			want: `{"error":"invalid sort \"size\", expected one of name, first_seen, last_seen"}`},
+		{name: "invalid order", url: "/v1/subdomains/example.com?order=up", status: http.StatusBadRequest},
+		{name: "invalid depth", url: "/v1/subdomains/example.com?depth=-1", status: http.StatusBadRequest},
+		{name: "archive disabled", url: "/v1/subdomains/example.com?archive=true", status: http.StatusBadRequest,
+			want: `{"error":"archive search is not enabled, set archive.search in the config"}`},
+		{name: "cursor of another order", url: "/v1/subdomains/example.com?sort=last_seen&cursor=" + cursorAfter("api.example.com", ""), status: http.StatusBadRequest,
+			want: `{"error":"cursor belongs to a listing in another order, pass the same sort and order"}`},
+		{name: "invalid field", url: "/v1/subdomains/example.com?fields=size", status: http.StatusBadRequest},
+		{name: "store error", url: "/v1/subdomains/example.com", err: errStore, status: http.StatusInternalServerError,
+			want: `{"error":"failed to fetch subdomains"}`},
+	})
+}
+
+func TestListCertUpdates(t *testing.T) {
+	runAPITests(t, []apiTest{
+		{name: "all", url: "/v1/cert-updates?fields=domain,fingerprint", status: http.StatusOK,
+			want: `[{"domain":"a.b.example.com","fingerprint":"BB"},{"domain":"api.example.com","fingerprint":"AA"},
+				{"domain":"example.com","fingerprint":"AA"},{"domain":"example.com","fingerprint":"BB"},
+				{"domain":"example.org","fingerprint":"CC"},{"domain":"mail.example.org","fingerprint":"CC"},
+				{"domain":"www.example.com","fingerprint":"AA"}]`},
+		{name: "page", url: "/v1/cert-updates?fields=domain,fingerprint&page=2&size=2", status: http.StatusOK,
+			want: `[{"domain":"example.com","fingerprint":"AA"},{"domain":"example.com","fingerprint":"BB"}]`},
+		{name: "suffix", url: "/v1/cert-updates?fields=domain&suffix=example.org", status: http.StatusOK,
+			want: `[{"domain":"example.org"},{"domain":"mail.example.org"}]`},
+		{name: "name history", url: "/v1/cert-updates?suffix=example.com&fields=domain,cert_count&page=2&size=1", status: http.StatusOK,
+			want: `[{"domain":"api.example.com","cert_count":1}]`},
+		{name: "cursor", url: "/v1/cert-updates?fields=domain,fingerprint&size=2&cursor=" + cursorAfter("example.com", "AA"), status: http.StatusOK,
+			want: `{"items":[{"domain":"example.com","fingerprint":"BB"},{"domain":"example.org","fingerprint":"CC"}],"next":"` + cursorAfter("example.org", "CC") + `"}`,
+			next: cursorAfter("example.org", "CC")},
+		{name: "ndjson", url: "/v1/cert-updates?format=ndjson&fields=domain&suffix=example.org", status: http.StatusOK,
+			want: "{\"domain\":\"example.org\"}\n{\"domain\":\"mail.example.org\"}\n"},
+		{name: "csv neutralizes formulas", url: "/v1/cert-updates?format=csv&fields=domain,issuer&suffix=b.example.com", status: http.StatusOK,
+			want: "domain,issuer\na.b.example.com,\"'=HYPERLINK(\"\"x\"\")\"\n"},
+		{name: "tsv neutralizes formulas", url: "/v1/cert-updates?format=tsv&fields=domain,issuer&suffix=b.example.com", status: http.StatusOK,
+			want: "domain\tissuer\na.b.example.com\t'=HYPERLINK(\"x\")\n"},
+		{name: "text keeps formulas", url: "/v1/cert-updates?format=text&fields=domain,issuer&suffix=b.example.com", status: http.StatusOK,
+			want: "a.b.example.com\t=HYPERLINK(\"x\")\n"},
+		{name: "invalid sort", url: "/v1/cert-updates?sort=issuer", status: http.StatusBadRequest},
+		{name: "invalid entry type", url: "/v1/cert-updates?entry_type=crl", status: http.StatusBadRequest,
+			want: `{"error":"invalid entry_type \"crl\", expected one of x509, precert"}`},
+		{name: "invalid wildcard", url: "/v1/cert-updates?wildcard=maybe", status: http.StatusBadRequest,
+			want: `{"error":"invalid wildcard \"maybe\", expected true or false"}`},
+		{name: "invalid validity", url: "/v1/cert-updates?not_after_since=soon", status: http.StatusBadRequest},
+		{name: "store error", url: "/v1/cert-updates", err: errStore, status: http.StatusInternalServerError,
+			want: `{"error":"failed to fetch certificate updates"}`},
+		{name: "unsupported cursor", url: "/v1/cert-updates?sort=seen&cursor=", err: swimModels.ErrCursorUnsupported, status: http.StatusBadRequest},
+	})
+}
+
+func TestQuery(t *testing.T) {
+	runAPITests(t, []apiTest{
+		{name: "missing query", url: "/v1/query", status: http.StatusBadRequest, want: `{"error":"missing query, set q"}`},
+		{name: "syntax error", url: "/v1/query?q=issuer:", status: http.StatusBadRequest},
+		{name: "store error", url: "/v1/query?q=issuer:x", err: errStore, status: http.StatusInternalServerError},
+	})
+}
+
+func TestStats(t *testing.T) {
+	runAPITests(t, []apiTest{
+		{name: "totals", url: "/v1/stats", status: http.StatusOK,
+			want: `{"names":6,"apex_domains":2,"certificates":3,"totals":{"certificates":0,"sightings":0,"new_names":0,"new_apexes":0,"wildcards":0},"hourly":[],"tlds":[],"issuers":[]}`},
+		{name: "invalid top", url: "/v1/stats?top=-1", status: http.StatusBadRequest,
+			want: `{"error":"invalid top \"-1\", expected a number of entries or 0 for all"}`},
+		{name: "invalid range", url: "/v1/stats?since=2024-01-02T00:00:00Z&until=2024-01-01T00:00:00Z", status: http.StatusBadRequest},
+		{name: "store error", url: "/v1/stats", err: errStore, status: http.StatusInternalServerError,
+			want: `{"error":"failed to fetch stats"}`},
+	})
+}
+
+func TestOptionalStores(t *testing.T) {
+	// the fake store implements none of the optional interfaces
+	runAPITests(t, []apiTest{
+		{name: "domain detail", url: "/v1/domains/example.com", status: http.StatusNotImplemented},
+		{name: "certificate", url: "/v1/certificates/" + strings.Repeat("AA", 20), status: http.StatusNotImplemented},
+		{name: "expiring", url: "/v1/expiring", status: http.StatusNotImplemented},
+	})
+}
+
+func TestPageSizeBounds(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		size int
+	}{
+		{"/v1/domains", 1000},
+		{"/v1/domains?size=0", maxPageSize},
+		{"/v1/domains?size=0&format=csv", maxPageSize},
+		{"/v1/domains?size=0&format=ndjson", 0},
+		{"/v1/cert-updates?size=0", maxPageSize},
+		{"/v1/cert-updates?size=50000&format=ndjson", 50000},
+		{"/v1/search?q=example&size=0", maxPageSize},
+	} {
+		store := newFakeStore()
+		if err := store.InsertBatch(testUpdates); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		NewRouter(store, swimConfig.GetDefaultConfig()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d, body %s", test.url, rec.Code, rec.Body)
+		}
+		if store.opts.Size != test.size {
+			t.Errorf("GET %s listed pages of %d rows, want %d", test.url, store.opts.Size, test.size)
+		}
+	}
+}
+
+// snapshotStore is a fake store that can take snapshots, it counts them
+type snapshotStore struct {
+	*fakeStore
+	snapshots int
+}
+
+func (s *snapshotStore) Snapshot(dir string, keep int) (*swimModels.Snapshot, error) {
+	s.snapshots++
+	return &swimModels.Snapshot{Path: dir + "/swim-20240131T020000.000Z.db", Created: "2024-01-31T02:00:00Z"}, nil
+}
+
+func TestAdminToken(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		token         string // configured token
+		authorization string // Authorization header, none if empty
+		snapshots     bool   // whether the store takes snapshots
+		status        int
+	}{
+		{name: "no token configured", authorization: "Bearer ", snapshots: true, status: http.StatusForbidden},
+		{name: "no token configured without header", snapshots: true, status: http.StatusForbidden},
+		{name: "missing header", token: "secret", snapshots: true, status: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", authorization: "Bearer guess", snapshots: true, status: http.StatusUnauthorized},
+		{name: "token prefix", token: "secret", authorization: "Bearer secre", snapshots: true, status: http.StatusUnauthorized},
+		{name: "other scheme", token: "secret", authorization: "Basic secret", snapshots: true, status: http.StatusUnauthorized},
+		{name: "lowercase scheme", token: "secret", authorization: "bearer secret", snapshots: true, status: http.StatusUnauthorized},
+		{name: "valid token", token: "secret", authorization: "Bearer secret", snapshots: true, status: http.StatusCreated},
+		{name: "store without snapshots", token: "secret", authorization: "Bearer secret", status: http.StatusNotImplemented},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := swimConfig.GetDefaultConfig()
+			cfg.Admin.Token = test.token
+			cfg.Backup.Dir = "backups"
+
+			store := &snapshotStore{fakeStore: newFakeStore()}
+			var r http.Handler
+			if test.snapshots {
+				r = NewRouter(store, cfg)
+			} else {
+				r = NewRouter(store.fakeStore, cfg)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/admin/snapshot", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, test.status, rec.Body)
+			}
+			// only an authorized request reaches the store
+			want := 0
+			if test.status == http.StatusCreated {
+				want = 1
+			}
+			if store.snapshots != want {
+				t.Errorf("%d snapshots taken, want %d", store.snapshots, want)
+			}
+		})
+	}
+}
+
+// rawStore is a fake store keeping the DER of one certificate and its chain
+type rawStore struct {
+	*fakeStore
+	cert swimModels.RawCertificate
+}
+
+func (s *rawStore) RawCertificate(fingerprint string) (*swimModels.RawCertificate, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if fingerprint != s.cert.Fingerprint {
+		return nil, nil
+	}
+	return &s.cert, nil
+}
+
+func TestRawCertificate(t *testing.T) {
+	fingerprint := strings.TrimSuffix(strings.Repeat("AB:", 20), ":")
+	leaf, issuer := []byte("leaf certificate"), []byte("issuer certificate")
+	var chainPEM []byte
+	for _, der := range [][]byte{leaf, issuer} {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	file := strings.Repeat("AB", 20)
+
+	for _, test := range []struct {
+		name        string
+		url         string
+		err         error
+		status      int
+		contentType string
+		filename    string
+		body        []byte
+	}{
+		{name: "der", url: "/v1/certificates/" + fingerprint + ".der", status: http.StatusOK, contentType: "application/pkix-cert", filename: file + ".der", body: leaf},
+		{name: "pem with chain", url: "/v1/certificates/" + fingerprint + ".pem", status: http.StatusOK, contentType: "application/x-pem-file", filename: file + ".pem", body: chainPEM},
+		{name: "lowercase bare hex", url: "/v1/certificates/" + strings.ToLower(file) + ".pem", status: http.StatusOK, contentType: "application/x-pem-file", filename: file + ".pem", body: chainPEM},
+		{name: "not stored", url: "/v1/certificates/" + strings.Repeat("CD", 20) + ".der", status: http.StatusNotFound},
+		{name: "unknown extension", url: "/v1/certificates/" + fingerprint + ".crt", status: http.StatusNotFound},
+		{name: "invalid fingerprint", url: "/v1/certificates/ABCD.pem", status: http.StatusBadRequest},
+		{name: "store error", url: "/v1/certificates/" + fingerprint + ".der", err: errStore, status: http.StatusInternalServerError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := &rawStore{fakeStore: newFakeStore(), cert: swimModels.RawCertificate{Fingerprint: fingerprint, DER: leaf, Chain: [][]byte{issuer}}}
+			store.err = test.err
+			r := NewRouter(store, swimConfig.GetDefaultConfig())
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.url, nil))
+
+			if rec.Code != test.status {
+				t.Fatalf("GET %s: status %d, want %d, body %s", test.url, rec.Code, test.status, rec.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			if got := rec.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("GET %s: Content-Type %q, want %q", test.url, got, test.contentType)
+			}
+			if got, want := rec.Header().Get("Content-Disposition"), `attachment; filename="`+test.filename+`"`; got != want {
+				t.Errorf("GET %s: Content-Disposition %q, want %q", test.url, got, want)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), test.body) {
+				t.Errorf("GET %s returned\n%s\nwant\n%s", test.url, rec.Body, test.body)
+			}
+		})
+	}
+
+	// the fake store keeps no DER
+	runAPITests(t, []apiTest{
+		{name: "raw certificates not stored", url: "/v1/certificates/" + fingerprint + ".pem", status: http.StatusNotImplemented},
+	})
+}
+
+func TestParseFingerprint(t *testing.T) {
+	colons := strings.TrimSuffix(strings.Repeat("AB:", 20), ":")
+	for _, test := range []struct {
+		value string
+		want  string // empty if the value is invalid
+	}{
+		{colons, colons},
+		{strings.Repeat("AB", 20), colons},
+		{strings.ToLower(colons), colons},
+		{strings.Repeat("ab", 10) + ":" + strings.Repeat("AB", 10), colons},
+		{strings.Repeat("AB", 19), ""},
+		{strings.Repeat("AB", 21), ""},
+		{strings.Repeat("AB", 19) + "AG", ""},
+		{strings.Repeat("AB", 20) + "\n", ""},
+		{"", ""},
+	} {
+		got, err := parseFingerprint(test.value)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("parseFingerprint(%q) = %q, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseFingerprint(%q) = %q, %v, want %q", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestParseCertificateLookup(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  swimModels.CertificateLookup
+		err   string // part of the error, none if empty
+	}{
+		{"serial=0a:1b", swimModels.CertificateLookup{Serial: "0A1B"}, ""},
+		{"serial=A1B", swimModels.CertificateLookup{Serial: "A1B"}, ""},
+		{"serial=000A1B", swimModels.CertificateLookup{Serial: "000A1B"}, ""},
+		{"subject_key_id=01:02:03", swimModels.CertificateLookup{SubjectKeyID: "010203"}, ""},
+		{"authority_key_id=keyid:AB:CD", swimModels.CertificateLookup{AuthorityKeyID: "ABCD"}, ""},
+		// the newline CertStream leaves at the end of authority key identifiers, copied along
+		{"authority_key_id=keyid:AB:CD%0A", swimModels.CertificateLookup{AuthorityKeyID: "ABCD"}, ""},
+		{"authority_key_id=%20abcd%20&serial=1", swimModels.CertificateLookup{Serial: "1", AuthorityKeyID: "ABCD"}, ""},
+		{"serial=&subject_key_id=", swimModels.CertificateLookup{}, "missing lookup"},
+		{"", swimModels.CertificateLookup{}, "missing lookup"},
+		{"serial=XYZ", swimModels.CertificateLookup{}, `invalid serial "XYZ"`},
+		{"subject_key_id=keyid:AB", swimModels.CertificateLookup{SubjectKeyID: "AB"}, ""},
+		{"subject_key_id=AB-CD", swimModels.CertificateLookup{}, "invalid subject_key_id"},
+		{"serial=" + strings.Repeat("A", 129), swimModels.CertificateLookup{}, "invalid serial"},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/v1/certificates?"+test.query, nil)
+
+		got, err := parseCertificateLookup(c)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseCertificateLookup(%q) returned %v, want %q", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseCertificateLookup(%q) = %+v, %v, want %+v", test.query, got, err, test.want)
+		}
+	}
+}